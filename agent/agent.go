@@ -4,39 +4,49 @@ import (
 	"DistributedCalculator/db"
 	"errors"
 	"fmt"
-	"strconv"
 	"strings"
-	"sync"
-	"time"
 )
 
-func isOperator(c rune) bool {
-	return c == '+' || c == '-' || c == '*' || c == '/'
-}
-
-func priority(c rune) int {
-	if c == '+' || c == '-' {
+// priority returns the priority of the binary operator, operators with a higher priority bind tighter.
+func priority(op string) int {
+	switch op {
+	case "||":
 		return 1
-	}
-	if c == '*' || c == '/' {
+	case "&&":
 		return 2
+	case "<", "<=", "==", "!=", ">", ">=":
+		return 3
+	case "+", "-":
+		return 4
+	case "*", "/", "%", "//":
+		return 5
+	case "^":
+		return maxPriority
 	}
 	return 0
 }
 
+// maxPriority is the priority of the operators that bind tightest.
+const maxPriority = 6
+
+// rightAssociative reports whether the operator is evaluated from right to left, like 2^3^2 = 2^(3^2).
+func rightAssociative(op string) bool {
+	return op == "^"
+}
+
 // PrepareEquation prepares the equation for evaluation.
-// It removes all spaces and replaces commas with dots.
+// It removes all spaces and replaces decimal commas with dots.
 // It also removes unnecessary outer parentheses.
 // For example, "((1+2))" becomes "(1+2)" and "(((1+2)))" becomes "(1+2)".
 func PrepareEquation(equation string) string {
 	// Remove all spaces from the equation
 	equation = strings.ReplaceAll(equation, " ", "")
-	// Replace all commas with dots
-	equation = strings.ReplaceAll(equation, ",", ".")
+	// Replace decimal commas with dots, commas between the arguments of functions are kept
+	equation = DecimalCommas(equation)
 	// Loop until there are no unnecessary outer parentheses
 	for {
 		// If the equation does not start and end with parentheses, return the equation
-		if equation[0] != '(' || equation[len(equation)-1] != ')' {
+		if len(equation) < 2 || equation[0] != '(' || equation[len(equation)-1] != ')' {
 			return equation
 		}
 		// Initialize a counter for the number of open parentheses
@@ -60,68 +70,51 @@ func PrepareEquation(equation string) string {
 				}
 			}
 		}
+		// If the parentheses are not balanced, like in "(()", return the equation
+		if parenthesis != 0 {
+			return equation
+		}
 	}
 }
 
 // ValidEquation checks if the equation is valid.
-// It removes all spaces and replaces commas with dots.
+// It removes all spaces and replaces decimal commas with dots.
 // It then checks if the equation is valid from the start to the end index.
+// Spaces that separate tokens, like in "1 2" or "< =", make the equation invalid, as Parse reads it with the spaces.
 // It returns true if the equation is valid, and false otherwise.
 func ValidEquation(equation string, start, end int) bool {
 	// If the end index is less than or equal to the start index, return false
 	if end-start <= 0 {
 		return false
 	}
+	original := equation
 	// Remove all spaces from the equation.
 	equation = strings.ReplaceAll(equation, " ", "")
-	equation = strings.ReplaceAll(equation, ",", ".")
+	equation = DecimalCommas(equation)
+	if !sameTokens(original, equation) {
+		return false
+	}
 	end = min(end, len(equation))
-	seenDot := false
-	for i := start; i < end; i++ {
-		if equation[i] == '(' {
-			seenDot = false
-			validInner := false
-			parenthesis := 1
-			for j := i + 1; j < end; j++ {
-				if equation[j] == '(' {
-					parenthesis++
-				} else if equation[j] == ')' {
-					parenthesis--
-					if parenthesis == 0 {
-						if !ValidEquation(equation, i+1, j) {
-							return false
-						}
-						i = j + 1
-						validInner = true
-						break
-					}
-				}
-			}
-			if !validInner {
-				return false
-			}
-		} else if equation[i] == ')' {
+	if start >= end {
+		return false
+	}
+	_, err := Parse(equation[start:end])
+	return err == nil
+}
+
+// sameTokens reports whether both equations are split into the same tokens.
+func sameTokens(a, b string) bool {
+	aTokens, err := Tokenize(a)
+	if err != nil {
+		return false
+	}
+	bTokens, err := Tokenize(b)
+	if err != nil || len(aTokens) != len(bTokens) {
+		return false
+	}
+	for i := range aTokens {
+		if aTokens[i].Kind != bTokens[i].Kind || aTokens[i].Text != bTokens[i].Text {
 			return false
-		} else if isOperator(rune(equation[i])) {
-			seenDot = false
-			if i == start {
-				if equation[i] == '*' || equation[i] == '/' {
-					return false
-				}
-			} else {
-				if isOperator(rune(equation[i-1])) {
-					return false
-				}
-			}
-			if i == end-1 || isOperator(rune(equation[i+1])) {
-				return false
-			}
-		} else if !('0' <= equation[i] && equation[i] <= '9') {
-			if equation[i] == '.' && !seenDot {
-				seenDot = true
-			} else {
-				return false
-			}
 		}
 	}
 	return true
@@ -129,49 +122,84 @@ func ValidEquation(equation string, start, end int) bool {
 
 // LastOperation returns the index of the last operator in the equation.
 // It first prepares the equation by removing unnecessary outer parentheses.
-// Then it iterates over the characters in the equation.
-// If it encounters an open parenthesis, it skips to the corresponding close parenthesis.
-// If it encounters an operator, and it's not the first character, it checks the operator's priority.
+// Then it iterates over the tokens of the equation, skipping the tokens in parentheses.
+// If it encounters an operator between two operands, it checks the operator's priority.
 // If the operator's priority is less than or equal to the current operator's priority, it updates the last operator and its priority.
-// The function returns the index of the last operator in the equation.
-// | (1+2)+(3+4) | -1/35 | 1*2+3 | 1+2+3 |
-// |      ^          ^        ^       ^
+// Right associative operators of the same priority are not updated, so the first one of them is returned.
+// The function returns the index of the last operator in the prepared equation, or -1 if there is none.
+// | (1+2)+(3+4) | -1/35 | 1*2+3 | 1+2+3 | 2^3^2 |
+// |      ^          ^        ^       ^      ^
 func LastOperation(equation string) int {
 	// Prepare the equation by removing unnecessary outer parentheses
 	equation = PrepareEquation(equation)
-	// Initialize the index of the last operator and its priority
+	tokens, err := Tokenize(equation)
+	if err != nil {
+		return -1
+	}
+	lastOperator, err := lastOperatorToken(tokens)
+	if err != nil || lastOperator == -1 {
+		return -1
+	}
+	return tokens[lastOperator].Pos
+}
+
+// operandEnd reports whether a token of the kind can end an operand,
+// so that an operator after it is binary.
+func operandEnd(kind TokenKind) bool {
+	return kind == NumberToken || kind == RightParenToken || kind == IdentToken || kind == ReferenceToken
+}
+
+// lastOperatorToken returns the index of the token of the last operation in the tokens, or -1 if there is none.
+// An operator is binary if it follows the end of an operand, otherwise it is a unary sign.
+// A leading sign binds looser than ^, so there is no last operation in "-2^2": the sign applies to the whole power.
+// It returns an error if the parentheses are not balanced.
+func lastOperatorToken(tokens []Token) (int, error) {
 	lastOperator := -1
-	operatorPriority := 2
-	// Iterate over the characters in the equation
-	for i := 0; i < len(equation); i++ {
-		c := rune(equation[i])
-		if c == '(' {
-			// If the current character is an open parenthesis, skip to the corresponding close parenthesis
-			parenthesis := 1
-			for j := i + 1; j < len(equation); j++ {
-				if equation[j] == '(' {
-					parenthesis++
-				} else if equation[j] == ')' {
-					parenthesis--
-					if parenthesis == 0 {
-						i = j
-						break
-					}
-				}
+	operatorPriority := maxPriority
+	parenthesis := 0
+	opened := 0
+	for i, token := range tokens {
+		switch token.Kind {
+		case LeftParenToken:
+			if parenthesis == 0 {
+				opened = token.Pos
+			}
+			parenthesis++
+		case RightParenToken:
+			parenthesis--
+			if parenthesis < 0 {
+				return -1, &SyntaxError{Pos: token.Pos, Msg: "unexpected )"}
+			}
+		case CommaToken:
+			if parenthesis == 0 {
+				return -1, &SyntaxError{Pos: token.Pos, Msg: "unexpected ,"}
 			}
-		} else if isOperator(c) && i != 0 {
-			// If the current character is an operator, and it's not the first character, check its priority
-			if priority(c) <= operatorPriority {
-				// If the operator's priority is less than or equal to the current operator's priority, update the last operator and its priority
+		case AssignToken, SemicolonToken:
+			// Assignments and statements are only allowed in scripts, see ParseScript
+			return -1, &SyntaxError{Pos: token.Pos, Msg: "unexpected " + token.Text}
+		case OperatorToken:
+			if parenthesis != 0 || i == 0 || !operandEnd(tokens[i-1].Kind) || token.Text == "!" {
+				continue
+			}
+			p := priority(token.Text)
+			if p < operatorPriority || (p == operatorPriority && !(rightAssociative(token.Text) && lastOperator != -1)) {
 				lastOperator = i
-				operatorPriority = priority(c)
+				operatorPriority = p
 			}
 		}
 	}
-	// Return the index of the last operator
-	return lastOperator
+	if parenthesis != 0 {
+		return -1, &SyntaxError{Pos: opened, Msg: "unclosed ("}
+	}
+	if lastOperator != -1 && operatorPriority == maxPriority && tokens[0].Kind == OperatorToken {
+		return -1, nil
+	}
+	return lastOperator, nil
 }
 
+// Evaluate evaluates the equation with the given id and stores the result in the database.
+// For a script the result is the value of the last statement, the values of the assigned variables are stored as its bindings.
+// The operations are placed on the computers from the Computers table.
 func Evaluate(equationID int) error {
 	database, _ := db.Connect("data.db")
 	defer func(database *db.DB) {
@@ -180,129 +208,113 @@ func Evaluate(equationID int) error {
 			return
 		}
 	}(database)
-	err := database.UpdateEquation(equationID, "Computing", 0)
-	if err != nil {
+	equation, _, _, userID := database.GetEquationInfo(equationID)
+	// setStatus stores the status of the equation and publishes it on the Events bus
+	setStatus := func(status string) error {
+		err := database.UpdateEquation(equationID, status, 0)
+		if err == nil {
+			Events.Publish(Event{Type: StatusEvent, EquationID: equationID, UserID: userID, Status: status})
+		}
 		return err
 	}
-	mu := &sync.Mutex{}
-	equation := database.GetEquationText(equationID)
-	var result float64
-	result, err = evaluateRec(database, equationID, equation, mu)
+	// An expression cancelled in the queue is not evaluated
+	cancel := cancellation(equationID)
+	defer forgetCancellation(equationID)
+	select {
+	case <-cancel:
+		return setStatus(CancelledStatus)
+	default:
+	}
+	options := ParseOptions(database.GetEquationOptions(equationID))
+	snapshot := ParseSnapshot(database.GetEquationVariables(equationID))
+	script, err := BuildScript(equation, options)
 	if err != nil {
-		err = database.UpdateEquation(equationID, fmt.Sprintf("Error %s", err), 0)
+		return setStatus(fmt.Sprintf("Error %s", err))
+	}
+	// Wait for the results of the referenced expressions
+	var references Results
+	if ids := script.References(); len(ids) > 0 {
+		err = setStatus("Waiting")
 		if err != nil {
 			return err
 		}
-		return err
+		references, err = waitReferences(database, RealClock, ids, options.Arithmetic(), cancel)
+		if errors.Is(err, ErrCancelled) {
+			return setStatus(CancelledStatus)
+		}
+		if err != nil {
+			return setStatus(fmt.Sprintf("Error %s", err))
+		}
 	}
-	err = database.UpdateEquation(equationID, "Computed", result)
+	err = setStatus("Computing")
 	if err != nil {
 		return err
 	}
-	return nil
-}
+	// Substitute the values of the variables taken at submission and the results of the references,
+	// the statements of a script share the trees of the assigned variables
+	roots, err := script.Link(snapshot, references)
+	if err != nil {
+		return setStatus(fmt.Sprintf("Error %s", err))
+	}
+	// Track the computed operations for the estimates
+	startProgress(equationID, roots)
+	defer finishProgress(equationID)
+	total := uniqueOperations(roots)
+	Events.Publish(Event{Type: ProgressEvent, EquationID: equationID, UserID: userID, Total: total})
 
-// evaluateRec recursively evaluates the given equation.
-// It first prepares the equation by removing unnecessary outer parentheses.
-// Then it finds the last operator in the equation.
-// If there is no operator, it parses the equation as a float64 and returns the result.
-// If there is an operator, it splits the equation into two parts at the operator and recursively evaluates each part.
-// It then performs the operation indicated by the operator on the results of the two parts.
-// The function returns the result of the operation and any error that occurred during the process.
-func evaluateRec(database *db.DB, equationID int, equation string, mu *sync.Mutex) (float64, error) {
-	var err error = nil
-	// Prepare the equation by removing unnecessary outer parentheses
-	equation = PrepareEquation(equation)
-	// Find the last operator in the equation
-	lastOperator := LastOperation(equation)
-	if lastOperator == -1 {
-		// If there is no operator, parse the equation as a float64 and return the result
-		value := 0.0
-		value, err = strconv.ParseFloat(equation, 64)
-		if err != nil {
-			return 0, err
-		}
-		return value, nil
+	evaluator := &Evaluator{
+		Clock:      RealClock,
+		Pool:       dbPool{database: database},
+		Durations:  database.GetOperationTimes,
+		Cache:      Cache,
+		Database:   database,
+		Arithmetic: options.Arithmetic(),
+		Cancel:     cancel,
+		OnTask: func(task Task) {
+			completed := markDone(equationID, task.Node)
+			Events.Publish(Event{Type: ProgressEvent, EquationID: equationID, UserID: userID, Completed: completed, Total: total})
+		},
 	}
-	// Create channels to receive the results of the recursive evaluations
-	lChan := make(chan float64)
-	rChan := make(chan float64)
-	// Recursively evaluate the left part of the equation
-	go func() {
-		lValue, _ := evaluateRec(database, equationID, equation[:lastOperator], mu)
-		lChan <- lValue
-	}()
-	// Recursively evaluate the right part of the equation
-	go func() {
-		rValue, _ := evaluateRec(database, equationID, equation[lastOperator+1:], mu)
-		rChan <- rValue
-	}()
-	// Receive the results of the recursive evaluations
-	left := <-lChan
-	right := <-rChan
-	// Find an empty computer to perform the operation
-	emptyComputer := 0
-	for {
-		mu.Lock()
-		emptyComputer, err = database.GetEmptyComputer()
-		mu.Unlock()
+	equationIDs := make([]int, len(roots))
+	for i := range equationIDs {
+		equationIDs[i] = equationID
+	}
+	results, err := evaluator.Run(roots, equationIDs)
+	if errors.Is(err, ErrCancelled) {
+		return setStatus(CancelledStatus)
+	}
+	if err != nil {
+		err = setStatus(fmt.Sprintf("Error %s", err))
 		if err != nil {
-			return 0, err
+			return err
 		}
-		if emptyComputer != 0 {
-			mu.Lock()
-			err = database.UpdateComputer(emptyComputer, equationID)
-			mu.Unlock()
-			if err != nil {
-				return 0, err
-			}
-			break
-		} else {
-			time.Sleep(5 * time.Millisecond)
+		return err
+	}
+	// The value of the script is the value of its last statement
+	bindings := Bindings{}
+	for i, statement := range script.Statements {
+		if statement.Name != "" {
+			bindings[statement.Name] = evaluator.Arithmetic.Format(results[i])
 		}
 	}
-	// Perform the operation indicated by the operator on the results of the two parts
-	var result float64
-	switch equation[lastOperator] {
-	case '+':
-		mu.Lock()
-		durationTime, _ := database.GetOperationTime("+")
-		mu.Unlock()
-		time.Sleep(time.Duration(durationTime) * time.Millisecond)
-		result = left + right
-	case '-':
-		mu.Lock()
-		durationTime, _ := database.GetOperationTime("-")
-		mu.Unlock()
-		time.Sleep(time.Duration(durationTime) * time.Millisecond)
-		result = left - right
-	case '*':
-		mu.Lock()
-		durationTime, _ := database.GetOperationTime("*")
-		mu.Unlock()
-		time.Sleep(time.Duration(durationTime) * time.Millisecond)
-		result = left * right
-	case '/':
-		if right == 0 {
-			err = database.UpdateComputer(emptyComputer, 0)
-			if err != nil {
-				return 0, err
-			}
-			return 0, errors.New("division by zero")
+	if len(bindings) > 0 {
+		err = database.SetEquationBindings(equationID, bindings.String())
+		if err != nil {
+			return err
 		}
-		mu.Lock()
-		durationTime, _ := database.GetOperationTime("/")
-		mu.Unlock()
-		time.Sleep(time.Duration(durationTime) * time.Millisecond)
-		result = left / right
 	}
-	// Update the computer to be empty again
-	mu.Lock()
-	err = database.UpdateComputer(emptyComputer, 0)
+	result := results[len(results)-1]
+	err = database.SetEquationResult(equationID, result.Float64(), evaluator.Arithmetic.Format(result))
 	if err != nil {
-		return 0, err
+		return err
 	}
-	mu.Unlock()
-	// Return the result of the operation
-	return result, nil
+	Events.Publish(Event{
+		Type:       ResultEvent,
+		EquationID: equationID,
+		UserID:     userID,
+		Status:     "Computed",
+		Result:     result.Float64(),
+		ResultText: evaluator.Arithmetic.Format(result),
+	})
+	return nil
 }
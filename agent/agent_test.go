@@ -20,19 +20,49 @@ func TestValidEquation(t *testing.T) {
 		{"1+)2*3(", 0, 7, false},
 		{"1+(2+(3+4)+5)", 0, 13, true},
 		// Test operators [Operators must be between two numbers]
-		// Except + and - that can be at the beginning of the equation
+		// Except unary + and - that can be at the beginning, after an operator or after an opening parenthesis
 		{"1+2*3", 0, 5, true},
 		{"1+*2", 0, 4, false},
 		{"1+2*", 0, 4, false},
 		{"-1+2*3", 0, 6, true},
 		{"+1+*2", 0, 5, false},
 		{"+1+(-1)", 0, 7, true},
+		{"2*-3", 0, 4, true},
+		{"2--3", 0, 4, true},
+		{"-(1+2)", 0, 6, true},
+		{"--(-1)", 0, 6, true},
+		{"2*-", 0, 3, false},
+		{"2-*3", 0, 4, false},
 		// Test numbers [Only digits and a single dot are allowed]
 		{"1.2.3", 0, 5, false},
 		{"1..2", 0, 4, false},
+		// Scientific notation, hexadecimal and binary integers and _ separators
+		{"1e-9+2.5E3", 0, 10, true},
+		{".5*2", 0, 4, true},
+		{"0xFF+0b1010", 0, 11, true},
+		{"1_000_000", 0, 9, true},
+		{"1e", 0, 2, false},
+		{"0x", 0, 2, false},
+		{"1__0", 0, 4, false},
 		// Test spaces [Spaces are allowed and should be ignored]
 		{"1 + 2 * 3", 0, 9, true},
 		{"1       +2 -     3", 0, 15, true},
+		// Spaces still separate the tokens
+		{"1 2", 0, 3, false},
+		{"x y", 0, 3, false},
+		{"7 / / 2", 0, 7, false},
+		{"1 < = 2", 0, 7, false},
+		// Test exponentiation [^ is a binary operator]
+		{"2^3^2", 0, 5, true},
+		{"(1+2)^-1", 0, 8, true},
+		{"2^(0-1)", 0, 7, true},
+		{"^2", 0, 2, false},
+		{"2^", 0, 2, false},
+		// Test modulo and integer division [% and // are binary operators]
+		{"7 % 3 // 2", 0, 10, true},
+		{"7 /// 2", 0, 7, false},
+		{"7 %% 2", 0, 6, false},
+		{"%7", 0, 2, false},
 	}
 
 	for _, tc := range testCases {
@@ -60,6 +90,29 @@ func TestLastOperation(t *testing.T) {
 		{"(1+2)*3", 5},
 		{"(1+2)*3+4", 7},
 		{"(1+(2+3)+(4+5))", 7},
+		// Test exponentiation [^ is right associative and has the highest priority]
+		{"2^3", 1},
+		{"2^3^2", 1},
+		{"2*3^2", 1},
+		{"2^3*2", 3},
+		{"(2^3)^2", 5},
+		{"-2^2", -1},
+		{"(-2)^2", 4},
+		// Test unary operators [A sign is not an operation between two operands]
+		{"-(1+2)", -1},
+		{"2*-3", 1},
+		{"2--3", 1},
+		{"-(1+2)*-3", 6},
+		// Test modulo and integer division [// is a single operator of the * priority]
+		{"7//2", 1},
+		{"1+7//2", 1},
+		{"7//2%3", 4},
+		{"7%2//3", 3},
+		// Test empty and unbalanced equations [found by FuzzParse]
+		{"", -1},
+		{"()", -1},
+		{"(()", -1},
+		{"())(", -1},
 	}
 
 	for _, tc := range testCases {
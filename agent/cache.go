@@ -0,0 +1,80 @@
+package agent
+
+import (
+	"DistributedCalculator/db"
+	"fmt"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// ResultCache keeps the results of previously computed sub-expressions in the
+// ResultCache table, so that a repeated sub-expression does not occupy a computer again.
+// A nil *ResultCache disables caching.
+type ResultCache struct {
+	// Size is the maximum number of entries kept in the table, 0 means unlimited.
+	Size int
+	// TTL is the time an entry stays valid, 0 means forever.
+	TTL time.Duration
+
+	hits   atomic.Int64
+	misses atomic.Int64
+}
+
+// Cache is the cache consulted by Evaluate. It is nil unless enabled by the server.
+var Cache *ResultCache
+
+// NewResultCache creates a cache with the given size and TTL.
+func NewResultCache(size int, ttl time.Duration) *ResultCache {
+	return &ResultCache{Size: size, TTL: ttl}
+}
+
+// CacheKey builds the cache key of a sub-expression.
+// The key consists of the normalised sub-expression and the operation durations,
+// so that changing the timings on the operations page does not reuse old entries.
+// For example, "(1 + 2)" with all durations set to 1 becomes "1+2|*=1;+=1;-=1;/=1".
+func CacheKey(equation string, durations map[string]int) string {
+	types := make([]string, 0, len(durations))
+	for opType := range durations {
+		types = append(types, opType)
+	}
+	sort.Strings(types)
+	timings := make([]string, len(types))
+	for i, opType := range types {
+		timings[i] = fmt.Sprintf("%s=%d", opType, durations[opType])
+	}
+	return PrepareEquation(equation) + "|" + strings.Join(timings, ";")
+}
+
+// Get returns the cached result for the key and records a hit or a miss.
+func (c *ResultCache) Get(database *db.DB, key string) (float64, bool) {
+	notBefore := int64(0)
+	if c.TTL > 0 {
+		notBefore = time.Now().Add(-c.TTL).Unix()
+	}
+	result, ok, err := database.GetCachedResult(key, notBefore)
+	if err != nil || !ok {
+		c.misses.Add(1)
+		return 0, false
+	}
+	c.hits.Add(1)
+	return result, true
+}
+
+// Put stores the result for the key and evicts the oldest entries above the size limit.
+func (c *ResultCache) Put(database *db.DB, key string, result float64) error {
+	err := database.AddCachedResult(key, result, time.Now().Unix())
+	if err != nil {
+		return err
+	}
+	if c.Size > 0 {
+		return database.TrimResultCache(c.Size)
+	}
+	return nil
+}
+
+// Stats returns the number of cache hits and misses since the server started.
+func (c *ResultCache) Stats() (hits, misses int64) {
+	return c.hits.Load(), c.misses.Load()
+}
@@ -0,0 +1,183 @@
+package agent
+
+import (
+	"DistributedCalculator/db"
+	"fmt"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// newTestDatabase returns a new database with the tables of the server.
+func newTestDatabase(t *testing.T) *db.DB {
+	database, err := db.Connect(filepath.Join(t.TempDir(), "data.db"))
+	if err != nil {
+		t.Fatalf("Connect returned error %v", err)
+	}
+	t.Cleanup(func() { database.Close() })
+	if err = database.Init(); err != nil {
+		t.Fatalf("Init returned error %v", err)
+	}
+	return database
+}
+
+func TestCacheKey(t *testing.T) {
+	durations := map[string]int{"+": 1, "-": 2, "*": 3, "/": 4}
+	testCases := []struct {
+		equation string
+		want     string
+	}{
+		{"1+2", "1+2|*=3;+=1;-=2;/=4"},
+		// Spaces, commas and outer parentheses do not change the key
+		{"((1 + 2))", "1+2|*=3;+=1;-=2;/=4"},
+		{"1,5*2", "1.5*2|*=3;+=1;-=2;/=4"},
+		{"(1+2)*3", "(1+2)*3|*=3;+=1;-=2;/=4"},
+	}
+
+	for _, tc := range testCases {
+		got := CacheKey(tc.equation, durations)
+		if got != tc.want {
+			t.Errorf("CacheKey(%q) = %q; want %q", tc.equation, got, tc.want)
+		}
+	}
+
+	// Different timings must produce different keys
+	if CacheKey("1+2", durations) == CacheKey("1+2", map[string]int{"+": 5}) {
+		t.Errorf("CacheKey does not depend on the operation durations")
+	}
+}
+
+func TestResultCache(t *testing.T) {
+	database := newTestDatabase(t)
+	now := time.Now().Unix()
+	// The entries stored before the test, from the oldest to the newest
+	stored := []struct {
+		key       string
+		result    float64
+		createdAt int64
+	}{
+		{"old", 1, now - 3*3600},
+		{"older than an hour", 2, now - 2*3600},
+		{"recent", 3, now - 60},
+	}
+	for _, entry := range stored {
+		if err := database.AddCachedResult(entry.key, entry.result, entry.createdAt); err != nil {
+			t.Fatalf("AddCachedResult returned error %v", err)
+		}
+	}
+	cache := NewResultCache(3, time.Hour)
+	if err := cache.Put(database, "new", 4); err != nil {
+		t.Fatalf("Put returned error %v", err)
+	}
+
+	testCases := []struct {
+		key   string
+		want  float64
+		found bool
+	}{
+		{"new", 4, true},
+		{"recent", 3, true},
+		// Expired by the TTL
+		{"older than an hour", 0, false},
+		// Evicted by the size limit as the oldest entry
+		{"old", 0, false},
+		{"missing", 0, false},
+	}
+
+	for _, tc := range testCases {
+		got, found := cache.Get(database, tc.key)
+		if got != tc.want || found != tc.found {
+			t.Errorf("Get(%q) = %v, %v; want %v, %v", tc.key, got, found, tc.want, tc.found)
+		}
+	}
+	if hits, misses := cache.Stats(); hits != 2 || misses != 3 {
+		t.Errorf("Stats() = %d hits, %d misses; want 2 hits, 3 misses", hits, misses)
+	}
+
+	// Without the TTL the expired entries are valid, the evicted ones are gone
+	unlimited := NewResultCache(0, 0)
+	if got, found := unlimited.Get(database, "older than an hour"); !found || got != 2 {
+		t.Errorf("Get without TTL = %v, %v; want 2, true", got, found)
+	}
+	if _, found := unlimited.Get(database, "old"); found {
+		t.Errorf("Get of an evicted entry found it")
+	}
+}
+
+func TestEvaluatorCache(t *testing.T) {
+	database := newTestDatabase(t)
+	cache := NewResultCache(0, 0)
+	durations := map[string]int{"+": 10, "*": 20}
+	testCases := []struct {
+		equation string
+		want     []string
+		result   float64
+		hits     int64
+		misses   int64
+	}{
+		// Every operation is computed and stored
+		{"(1+2)*3", []string{"1+2@1:0-10", "(1+2)*3@1:10-30"}, 9, 0, 2},
+		// The whole expression comes from the cache, with no computer
+		{"(1+2)*3", []string{"(1+2)*3@0:0-0"}, 9, 1, 2},
+		// Only the sub-expression comes from the cache
+		{"(1+2)*4", []string{"1+2@0:0-0", "(1+2)*4@1:0-20"}, 12, 2, 3},
+	}
+
+	for _, tc := range testCases {
+		root, _ := Parse(tc.equation)
+		evaluator, tasks := newTestEvaluator(1, durations)
+		evaluator.Cache = cache
+		evaluator.Database = database
+		results, err := evaluator.Run([]*Node{root}, []int{1})
+		if err != nil {
+			t.Fatalf("Run(%q) returned error %v", tc.equation, err)
+		}
+		if results[0].Float64() != tc.result {
+			t.Errorf("Run(%q) = %v; want %v", tc.equation, results[0].Float64(), tc.result)
+		}
+		if got := scheduleOf(*tasks); fmt.Sprint(got) != fmt.Sprint(tc.want) {
+			t.Errorf("Run(%q) scheduled %q; want %q", tc.equation, got, tc.want)
+		}
+		if hits, misses := cache.Stats(); hits != tc.hits || misses != tc.misses {
+			t.Errorf("after Run(%q) Stats() = %d hits, %d misses; want %d hits, %d misses", tc.equation, hits, misses, tc.hits, tc.misses)
+		}
+	}
+}
+
+func TestProgressOfCachedOperations(t *testing.T) {
+	const equationID = -1
+	testCases := []struct {
+		equation string
+		reported []string
+		want     []int
+	}{
+		// A result from the cache completes the operations under it
+		{"(1+2)*(3+4)", []string{"(1+2)*(3+4)"}, []int{3}},
+		{"(1+2)*(3+4)", []string{"1+2", "(1+2)*(3+4)"}, []int{1, 3}},
+		// So does an if, whose branch that is not chosen is never computed
+		{"if(1<2, 3+4, 5*6)", []string{"1<2", "3+4", "if(1<2,3+4,5*6)"}, []int{1, 2, 4}},
+	}
+
+	for _, tc := range testCases {
+		root, _ := Parse(tc.equation)
+		startProgress(equationID, []*Node{root})
+		nodes := make(map[string]*Node)
+		var walk func(n *Node)
+		walk = func(n *Node) {
+			nodes[n.String()] = n
+			for _, arg := range n.Args {
+				walk(arg)
+			}
+		}
+		walk(root)
+		for i, reported := range tc.reported {
+			if got := markDone(equationID, nodes[reported]); got != tc.want[i] {
+				t.Errorf("%s: markDone(%s) = %d; want %d", tc.equation, reported, got, tc.want[i])
+			}
+		}
+		if completed, total, _ := Progress(equationID); completed != total {
+			t.Errorf("%s: Progress() = %d of %d; want all operations completed", tc.equation, completed, total)
+		}
+		finishProgress(equationID)
+	}
+}
@@ -0,0 +1,51 @@
+package agent
+
+import (
+	"sync"
+)
+
+// CancelledStatus is the status of a cancelled expression.
+const CancelledStatus = "Cancelled"
+
+// cancellations holds the channels that cancel the evaluations of the expressions, by their IDs.
+var cancellations = struct {
+	sync.Mutex
+	channels map[int]chan struct{}
+}{channels: make(map[int]chan struct{})}
+
+// Cancel cancels the evaluation of the expression.
+// An expression that is still in the queue is cancelled as soon as Evaluate starts it.
+// The caller checks that the expression is not finished, a cancellation of a finished expression is kept until the server restarts.
+func Cancel(equationID int) {
+	cancellations.Lock()
+	defer cancellations.Unlock()
+	c, ok := cancellations.channels[equationID]
+	if !ok {
+		c = make(chan struct{})
+		cancellations.channels[equationID] = c
+	}
+	select {
+	case <-c:
+	default:
+		close(c)
+	}
+}
+
+// cancellation returns the channel that is closed when the evaluation of the expression is cancelled.
+func cancellation(equationID int) <-chan struct{} {
+	cancellations.Lock()
+	defer cancellations.Unlock()
+	c, ok := cancellations.channels[equationID]
+	if !ok {
+		c = make(chan struct{})
+		cancellations.channels[equationID] = c
+	}
+	return c
+}
+
+// forgetCancellation removes the channel of the finished evaluation.
+func forgetCancellation(equationID int) {
+	cancellations.Lock()
+	defer cancellations.Unlock()
+	delete(cancellations.channels, equationID)
+}
@@ -0,0 +1,61 @@
+package agent
+
+import (
+	"sync"
+	"time"
+)
+
+// Clock is the source of time of the evaluator.
+type Clock interface {
+	Now() time.Time
+	Sleep(d time.Duration)
+}
+
+// realClock is the Clock backed by the time package.
+type realClock struct{}
+
+func (realClock) Now() time.Time {
+	return time.Now()
+}
+
+func (realClock) Sleep(d time.Duration) {
+	time.Sleep(d)
+}
+
+// RealClock is the Clock used by Evaluate.
+var RealClock Clock = realClock{}
+
+// FakeClock is a Clock with virtual time for tests and simulations.
+// Sleep does not block, it moves the time forward at once,
+// so a single evaluation loop runs instantly and its schedule is exact.
+type FakeClock struct {
+	mu  sync.Mutex
+	now time.Time
+}
+
+// NewFakeClock creates a FakeClock starting at the Unix epoch.
+func NewFakeClock() *FakeClock {
+	return &FakeClock{now: time.Unix(0, 0).UTC()}
+}
+
+// Now returns the virtual time.
+func (c *FakeClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+// Sleep moves the virtual time forward by d.
+func (c *FakeClock) Sleep(d time.Duration) {
+	c.Advance(d)
+}
+
+// Advance moves the virtual time forward by d.
+func (c *FakeClock) Advance(d time.Duration) {
+	if d <= 0 {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.now = c.now.Add(d)
+}
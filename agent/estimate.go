@@ -0,0 +1,167 @@
+package agent
+
+import (
+	"DistributedCalculator/db"
+	"sync"
+)
+
+// Estimate is the predicted evaluation time of an expression.
+type Estimate struct {
+	// Remaining is the time left until the expression is computed, in milliseconds.
+	Remaining int `json:"remaining_ms"`
+	// CriticalPath is the time the remaining operations need with unlimited free computers, in milliseconds.
+	CriticalPath int `json:"critical_path_ms"`
+	// Operations is the number of operations left.
+	Operations int `json:"operations"`
+	// Computers is the number of computers the estimate was made for.
+	Computers int `json:"computers"`
+}
+
+// progress holds the trees of the statements of an expression being evaluated together with its computed operations.
+type progress struct {
+	roots []*Node
+	done  map[*Node]bool
+}
+
+// inFlight holds the progress of the expressions being evaluated by Evaluate, by their IDs.
+var inFlight = struct {
+	sync.Mutex
+	evaluations map[int]*progress
+}{evaluations: make(map[int]*progress)}
+
+// startProgress registers the trees of the expression as being evaluated.
+func startProgress(equationID int, roots []*Node) {
+	inFlight.Lock()
+	defer inFlight.Unlock()
+	inFlight.evaluations[equationID] = &progress{roots: roots, done: make(map[*Node]bool)}
+}
+
+// markDone records that the operation of the expression is computed, together with the operations under it
+// that are not computed: the ones of a result taken from the cache and of the branch of an if that is not chosen.
+// It returns the number of the computed operations of the expression.
+func markDone(equationID int, node *Node) int {
+	inFlight.Lock()
+	defer inFlight.Unlock()
+	p, ok := inFlight.evaluations[equationID]
+	if !ok {
+		return 0
+	}
+	// The operations under a computed one are marked with it, so the walk stops at them
+	var mark func(n *Node)
+	mark = func(n *Node) {
+		if n.IsLeaf() || p.done[n] {
+			return
+		}
+		p.done[n] = true
+		for _, arg := range n.Args {
+			mark(arg)
+		}
+	}
+	mark(node)
+	return len(p.done)
+}
+
+// Progress returns the number of the computed operations and of all operations of the expression being evaluated,
+// or false if the expression is not being evaluated.
+func Progress(equationID int) (completed, total int, ok bool) {
+	inFlight.Lock()
+	defer inFlight.Unlock()
+	p, ok := inFlight.evaluations[equationID]
+	if !ok {
+		return 0, 0, false
+	}
+	return len(p.done), uniqueOperations(p.roots), true
+}
+
+// finishProgress removes the expression from the expressions being evaluated.
+func finishProgress(equationID int) {
+	inFlight.Lock()
+	defer inFlight.Unlock()
+	delete(inFlight.evaluations, equationID)
+}
+
+// remainingTrees returns the trees of the operations left to compute.
+// Computed operations are replaced with leaves, shared nodes stay shared.
+func remainingTrees(roots []*Node, done map[*Node]bool) []*Node {
+	memo := make(map[*Node]*Node)
+	var remaining func(n *Node) *Node
+	remaining = func(n *Node) *Node {
+		if n.IsLeaf() || done[n] {
+			return &Node{Value: "0"}
+		}
+		if tree, ok := memo[n]; ok {
+			return tree
+		}
+		args := make([]*Node, len(n.Args))
+		for i, arg := range n.Args {
+			args[i] = remaining(arg)
+		}
+		memo[n] = &Node{Kind: n.Kind, Op: n.Op, Args: args}
+		return memo[n]
+	}
+	trees := make([]*Node, len(roots))
+	for i, root := range roots {
+		trees[i] = remaining(root)
+	}
+	return trees
+}
+
+// EstimateQueue predicts when every unfinished expression will be computed.
+// It simulates the remaining operations of all unfinished expressions on the current computers,
+// earlier expressions first. Operations that are already computed are skipped,
+// operations that are being computed are counted as if they have just started.
+// The result maps the IDs of the expressions to their estimates.
+func EstimateQueue(database *db.DB) (map[int]Estimate, error) {
+	equations, err := database.GetUnfinishedEquations()
+	if err != nil {
+		return nil, err
+	}
+	computers, err := database.CountComputers()
+	if err != nil {
+		return nil, err
+	}
+	durations, err := database.GetOperationTimes()
+	if err != nil {
+		return nil, err
+	}
+
+	// The trees of the statements of all expressions are simulated together, first[i] is the first tree of the i-th expression
+	var ids []int
+	var roots []*Node
+	var first []int
+	inFlight.Lock()
+	for _, equation := range equations {
+		var trees []*Node
+		if p, ok := inFlight.evaluations[equation.ID]; ok {
+			trees = remainingTrees(p.roots, p.done)
+		} else {
+			script, err := BuildScript(equation.Text, ParseOptions(equation.Options))
+			if err != nil {
+				// Invalid expressions fail at once without using computers
+				continue
+			}
+			trees = script.Roots()
+		}
+		ids = append(ids, equation.ID)
+		first = append(first, len(roots))
+		roots = append(roots, trees...)
+	}
+	first = append(first, len(roots))
+	inFlight.Unlock()
+
+	schedule, err := Simulate(roots, Computers(computers), durations)
+	if err != nil {
+		return nil, err
+	}
+	estimates := make(map[int]Estimate, len(ids))
+	for i, id := range ids {
+		trees := roots[first[i]:first[i+1]]
+		estimate := Estimate{Operations: uniqueOperations(trees), Computers: computers}
+		for j, tree := range trees {
+			estimate.Remaining = max(estimate.Remaining, schedule.Finish[first[i]+j])
+			estimate.CriticalPath = max(estimate.CriticalPath, tree.CriticalPath(durations))
+		}
+		estimates[id] = estimate
+	}
+	return estimates, nil
+}
@@ -0,0 +1,445 @@
+package agent
+
+import (
+	"DistributedCalculator/db"
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+	"time"
+)
+
+// pollInterval is the time the evaluator waits before asking the pool for a free computer again.
+const pollInterval = 5 * time.Millisecond
+
+// cancelPollInterval is the longest time a cancellable evaluation waits before it checks whether it is cancelled.
+const cancelPollInterval = 100 * time.Millisecond
+
+// ErrCancelled is returned by Run when the evaluation is cancelled.
+var ErrCancelled = errors.New("cancelled")
+
+// Evaluator evaluates expression trees on the computers of a pool.
+// Every operation occupies a computer for the duration of the operation.
+type Evaluator struct {
+	// Clock measures the durations of the operations.
+	Clock Clock
+	// Pool hands out the computers.
+	Pool Pool
+	// Durations returns the current durations of the operations in milliseconds.
+	Durations func() (map[string]int, error)
+	// Cache is consulted before the operations are placed on computers, if it is not nil.
+	// It is stored in Database.
+	Cache    *ResultCache
+	Database *db.DB
+	// Arithmetic performs the operations, the zero Arithmetic computes with float64.
+	Arithmetic Arithmetic
+	// OnTask is called for every computed operation.
+	// Operations taken from the cache have no computer, their Computer is 0.
+	OnTask func(task Task)
+	// Cancel stops the evaluation with ErrCancelled when it is closed, if it is not nil.
+	// The running operations are abandoned and their computers are freed.
+	Cancel <-chan struct{}
+
+	// dryRun skips the arithmetic, so that only the schedule is computed.
+	dryRun bool
+}
+
+// taskKey orders the ready operations: earlier expressions first, then operations in post-order.
+type taskKey struct {
+	expression int
+	order      int
+}
+
+// runningTask is an operation being computed on a computer.
+type runningTask struct {
+	task Task
+	end  time.Time
+}
+
+// Run evaluates the expression trees and returns their values.
+// The computers for the i-th tree are taken for equationIDs[i].
+// The trees may share nodes, like the trees of the statements of a script; a shared node is computed once.
+// It works like this:
+//  1. The numbers in the leaves are available at once, the cache is consulted for the operations from the root down.
+//  2. An operation becomes ready when all of its operands are computed.
+//     Ready operations are placed on free computers, earlier trees first.
+//     The branches of if(c, a, b) are not computed in advance: when c is computed, only the chosen branch is collected,
+//     and the if becomes ready when the branch is computed.
+//  3. The clock sleeps until the next operation is finished, or for pollInterval if some ready operations wait for a computer.
+//  4. Finished operations free their computers, and the loop repeats until all trees are computed.
+func (e *Evaluator) Run(roots []*Node, equationIDs []int) ([]Value, error) {
+	start := e.Clock.Now()
+	elapsed := func(t time.Time) int {
+		return int(t.Sub(start).Milliseconds())
+	}
+	durations, err := e.Durations()
+	if err != nil {
+		return nil, err
+	}
+
+	// Collect the operations and the number of operands every operation waits for
+	values := make(map[*Node]Value)
+	// A node has several parents if it is shared by the trees of the statements of a script
+	parents := make(map[*Node][]*Node)
+	pending := make(map[*Node]int)
+	keys := make(map[*Node]taskKey)
+	// branches holds the chosen branch of every conditional whose condition is computed
+	branches := make(map[*Node]*Node)
+	orders := make([]int, len(roots))
+	var ready []*Node
+	less := func(a, b *Node) bool {
+		if keys[a].expression != keys[b].expression {
+			return keys[a].expression < keys[b].expression
+		}
+		return keys[a].order < keys[b].order
+	}
+	var walk func(i int, n *Node) error
+	// schedule adds the operation to the ready operations, keeping them ordered.
+	// A conditional with a computed condition is not ready yet: its chosen branch is collected instead,
+	// and the conditional becomes ready when the branch is computed.
+	var schedule func(n *Node) error
+	schedule = func(n *Node) error {
+		if n.conditional() && branches[n] == nil {
+			branch := e.branch(n, values[n.Args[0]], durations)
+			branches[n] = branch
+			if err := walk(keys[n].expression, branch); err != nil {
+				return err
+			}
+			parents[branch] = append(parents[branch], n)
+			if _, ok := values[branch]; !ok {
+				pending[n]++
+				return nil
+			}
+		}
+		i := sort.Search(len(ready), func(i int) bool { return less(n, ready[i]) })
+		ready = append(ready, nil)
+		copy(ready[i+1:], ready[i:])
+		ready[i] = n
+		return nil
+	}
+	walk = func(i int, n *Node) error {
+		if _, ok := keys[n]; ok {
+			// A shared node is collected once
+			return nil
+		}
+		if _, ok := values[n]; ok {
+			return nil
+		}
+		if n.IsLeaf() {
+			value, err := e.leafValue(n)
+			if err != nil {
+				return err
+			}
+			values[n] = value
+			return nil
+		}
+		if value, ok := e.cached(n, durations); ok {
+			values[n] = value
+			e.report(Task{Expression: i, Node: n, Start: elapsed(e.Clock.Now()), End: elapsed(e.Clock.Now())})
+			return nil
+		}
+		operands := n.Args
+		if n.conditional() {
+			// The branches wait for the condition
+			operands = operands[:1]
+		}
+		for _, operand := range operands {
+			if err := walk(i, operand); err != nil {
+				return err
+			}
+			parents[operand] = append(parents[operand], n)
+			if _, ok := values[operand]; !ok {
+				pending[n]++
+			}
+		}
+		keys[n] = taskKey{expression: i, order: orders[i]}
+		orders[i]++
+		if pending[n] == 0 {
+			return schedule(n)
+		}
+		return nil
+	}
+	for i, root := range roots {
+		if err := walk(i, root); err != nil {
+			return nil, err
+		}
+	}
+
+	var running []runningTask
+	// fail frees the computers of the running operations and returns the error
+	fail := func(err error) ([]Value, error) {
+		for _, r := range running {
+			_ = e.Pool.Release(r.task.Computer)
+		}
+		return nil, err
+	}
+	for len(ready) > 0 || len(running) > 0 {
+		select {
+		case <-e.Cancel:
+			return fail(ErrCancelled)
+		default:
+		}
+		// Place the ready operations on the free computers
+		if len(ready) > 0 {
+			durations, err = e.Durations()
+			if err != nil {
+				return fail(err)
+			}
+		}
+		for len(ready) > 0 {
+			node := ready[0]
+			if !e.dryRun && !node.conditional() {
+				if err := e.Arithmetic.check(node, operands(node, values)); err != nil {
+					return fail(err)
+				}
+			}
+			computer, ok, err := e.Pool.Acquire(equationIDs[keys[node].expression])
+			if err != nil {
+				return fail(err)
+			}
+			if !ok {
+				break
+			}
+			ready = ready[1:]
+			duration := e.Pool.Duration(computer, durations[node.OperationType()])
+			now := e.Clock.Now()
+			running = append(running, runningTask{
+				task: Task{
+					Expression: keys[node].expression,
+					Node:       node,
+					Computer:   computer,
+					Start:      elapsed(now),
+				},
+				end: now.Add(time.Duration(duration) * time.Millisecond),
+			})
+		}
+
+		// Wait for the next operation to finish
+		if len(running) == 0 {
+			// All computers are busy with other expressions
+			e.Clock.Sleep(pollInterval)
+			continue
+		}
+		next := running[0].end
+		for _, r := range running[1:] {
+			if r.end.Before(next) {
+				next = r.end
+			}
+		}
+		wait := next.Sub(e.Clock.Now())
+		if len(ready) > 0 && wait > pollInterval {
+			wait = pollInterval
+		}
+		if e.Cancel != nil && wait > cancelPollInterval {
+			wait = cancelPollInterval
+		}
+		e.Clock.Sleep(wait)
+
+		// Free the computers of the finished operations
+		now := e.Clock.Now()
+		stillRunning := running[:0]
+		for i, r := range running {
+			if r.end.After(now) {
+				stillRunning = append(stillRunning, r)
+				continue
+			}
+			// The computer of this operation is released, fail releases only the others
+			failAfterRelease := func(err error) ([]Value, error) {
+				running = append(stillRunning, running[i+1:]...)
+				return fail(err)
+			}
+			if err := e.Pool.Release(r.task.Computer); err != nil {
+				return failAfterRelease(err)
+			}
+			node := r.task.Node
+			if branch, ok := branches[node]; ok {
+				values[node] = values[branch]
+			} else if !e.dryRun {
+				value, err := e.Arithmetic.apply(node, operands(node, values))
+				if err != nil {
+					return failAfterRelease(err)
+				}
+				values[node] = value
+				if err := e.store(node, values[node], durations); err != nil {
+					return failAfterRelease(err)
+				}
+			} else {
+				values[node] = Value{}
+			}
+			r.task.End = elapsed(now)
+			e.report(r.task)
+			for _, parent := range parents[node] {
+				pending[parent]--
+				if pending[parent] == 0 {
+					if err := schedule(parent); err != nil {
+						return failAfterRelease(err)
+					}
+				}
+			}
+		}
+		running = stillRunning
+	}
+
+	results := make([]Value, len(roots))
+	for i, root := range roots {
+		results[i] = values[root]
+	}
+	return results, nil
+}
+
+// branch returns the branch of the conditional chosen by the value of its condition.
+// Without the arithmetic the condition is unknown, so the branch that takes longer is chosen.
+func (e *Evaluator) branch(n *Node, condition Value, durations map[string]int) *Node {
+	if e.dryRun {
+		if n.Args[2].CriticalPath(durations) > n.Args[1].CriticalPath(durations) {
+			return n.Args[2]
+		}
+		return n.Args[1]
+	}
+	if !condition.IsZero() {
+		return n.Args[1]
+	}
+	return n.Args[2]
+}
+
+// leafValue parses the number in the leaf.
+func (e *Evaluator) leafValue(n *Node) (Value, error) {
+	if e.dryRun {
+		return Value{}, nil
+	}
+	switch n.Kind {
+	case VariableNode:
+		// Variables and references are substituted before the evaluation
+		return Value{}, fmt.Errorf("unknown variable %s", n.Value)
+	case ReferenceNode:
+		return Value{}, fmt.Errorf("unknown expression %s", n.Value)
+	}
+	return e.Arithmetic.Parse(n.Value)
+}
+
+// cached looks up the result of the operation in the cache.
+// The cache keeps float64 results, so it is only used in FloatMode.
+func (e *Evaluator) cached(n *Node, durations map[string]int) (Value, bool) {
+	if e.Cache == nil || e.Database == nil || e.dryRun || e.Arithmetic.exact() {
+		return Value{}, false
+	}
+	value, ok := e.Cache.Get(e.Database, CacheKey(n.String(), durations))
+	return Value{float: value}, ok
+}
+
+// store remembers the result of the operation in the cache.
+func (e *Evaluator) store(n *Node, value Value, durations map[string]int) error {
+	if e.Cache == nil || e.Database == nil || e.Arithmetic.exact() {
+		return nil
+	}
+	return e.Cache.Put(e.Database, CacheKey(n.String(), durations), value.float)
+}
+
+// report passes the computed operation to OnTask.
+func (e *Evaluator) report(task Task) {
+	if e.OnTask != nil {
+		e.OnTask(task)
+	}
+}
+
+// operands returns the values of the operands of the operation.
+func operands(n *Node, values map[*Node]Value) []Value {
+	args := make([]Value, len(n.Args))
+	for i, arg := range n.Args {
+		args[i] = values[arg]
+	}
+	return args
+}
+
+// check returns an error if the operation cannot be performed on the operands.
+// It is called before the operation is placed on a computer.
+func check(n *Node, args []float64) error {
+	if n.Kind == CallNode {
+		if function := Functions[n.Op]; function.Check != nil {
+			return function.Check(args)
+		}
+		return nil
+	}
+	if n.Kind != BinaryNode {
+		return nil
+	}
+	left, right := args[0], args[1]
+	switch n.Op {
+	case "/", "//", "%":
+		if right == 0 {
+			return errors.New("division by zero")
+		}
+	case "^":
+		if left == 0 && right < 0 {
+			return errors.New("division by zero")
+		}
+		if left < 0 && right != math.Trunc(right) {
+			return errors.New("negative base with fractional exponent")
+		}
+	}
+	return nil
+}
+
+// apply performs the operation on the operands.
+func apply(n *Node, args []float64) float64 {
+	if n.Kind == CallNode {
+		return Functions[n.Op].Apply(args)
+	}
+	if n.Kind == UnaryNode {
+		switch n.Op {
+		case "-":
+			return -args[0]
+		case "!":
+			return truth(args[0] == 0)
+		}
+		return args[0]
+	}
+	left, right := args[0], args[1]
+	switch n.Op {
+	case "+":
+		return left + right
+	case "-":
+		return left - right
+	case "*":
+		return left * right
+	case "/":
+		return left / right
+	case "//":
+		// Integer division rounds down, so -7//2 = -4
+		return math.Floor(left / right)
+	case "%":
+		// The remainder has the sign of the divisor, so that left = right*(left//right) + left%right
+		remainder := math.Mod(left, right)
+		if remainder != 0 && (remainder < 0) != (right < 0) {
+			remainder += right
+		}
+		return remainder
+	case "^":
+		return math.Pow(left, right)
+	case "<":
+		return truth(left < right)
+	case "<=":
+		return truth(left <= right)
+	case "==":
+		return truth(left == right)
+	case "!=":
+		return truth(left != right)
+	case ">":
+		return truth(left > right)
+	case ">=":
+		return truth(left >= right)
+	case "&&":
+		return truth(left != 0 && right != 0)
+	case "||":
+		return truth(left != 0 || right != 0)
+	}
+	return 0
+}
+
+// truth returns 1 for true and 0 for false.
+func truth(b bool) float64 {
+	if b {
+		return 1
+	}
+	return 0
+}
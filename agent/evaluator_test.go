@@ -0,0 +1,383 @@
+package agent
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+// newTestEvaluator returns an evaluator with a fake clock and a pool of n computers,
+// which records the computed operations.
+func newTestEvaluator(n int, durations map[string]int) (*Evaluator, *[]Task) {
+	tasks := &[]Task{}
+	evaluator := &Evaluator{
+		Clock: NewFakeClock(),
+		Pool:  NewMemoryPool(Computers(n)),
+		Durations: func() (map[string]int, error) {
+			return durations, nil
+		},
+		OnTask: func(task Task) {
+			*tasks = append(*tasks, task)
+		},
+	}
+	return evaluator, tasks
+}
+
+// scheduleOf describes the tasks as "operation@computer:start-end" with the times in milliseconds.
+func scheduleOf(tasks []Task) []string {
+	var schedule []string
+	for _, task := range tasks {
+		schedule = append(schedule, fmt.Sprintf("%s@%d:%d-%d", task.Node, task.Computer, task.Start, task.End))
+	}
+	return schedule
+}
+
+func TestEvaluatorSchedule(t *testing.T) {
+	durations := map[string]int{"+": 10, "-": 10, "*": 20, "/": 20}
+	testCases := []struct {
+		equation  string
+		computers int
+		want      []string
+		result    float64
+	}{
+		// The examples from the README
+		{"(1+2)+(3+4)", 1, []string{"1+2@1:0-10", "3+4@1:10-20", "1+2+(3+4)@1:20-30"}, 10},
+		{"(1+2)+(3+4)", 2, []string{"1+2@1:0-10", "3+4@2:0-10", "1+2+(3+4)@1:10-20"}, 10},
+		{"(1+2)+(3+4)", 4, []string{"1+2@1:0-10", "3+4@2:0-10", "1+2+(3+4)@1:10-20"}, 10},
+		// Operations of different durations finish in their own time
+		{"(2*3)-(8/4)+1", 2, []string{"2*3@1:0-20", "8/4@2:0-20", "2*3-8/4@1:20-30", "2*3-8/4+1@1:30-40"}, 5},
+		{"1*2+3", 2, []string{"1*2@1:0-20", "1*2+3@1:20-30"}, 5},
+		{"-1,5", 1, nil, -1.5},
+	}
+
+	for _, tc := range testCases {
+		root, err := Parse(tc.equation)
+		if err != nil {
+			t.Fatalf("Parse(%q) returned error %v", tc.equation, err)
+		}
+		evaluator, tasks := newTestEvaluator(tc.computers, durations)
+		results, err := evaluator.Run([]*Node{root}, []int{1})
+		if err != nil {
+			t.Errorf("Run(%q) returned error %v", tc.equation, err)
+			continue
+		}
+		if results[0].Float64() != tc.result {
+			t.Errorf("Run(%q) = %v; want %v", tc.equation, results[0].Float64(), tc.result)
+		}
+		got := scheduleOf(*tasks)
+		if len(got) != len(tc.want) {
+			t.Errorf("Run(%q) with %d computers scheduled %q; want %q", tc.equation, tc.computers, got, tc.want)
+			continue
+		}
+		for i := range got {
+			if got[i] != tc.want[i] {
+				t.Errorf("Run(%q) with %d computers scheduled %q; want %q", tc.equation, tc.computers, got, tc.want)
+				break
+			}
+		}
+	}
+}
+
+func TestEvaluatorPower(t *testing.T) {
+	durations := map[string]int{"+": 1, "-": 1, "*": 1, "/": 1, "^": 1, "neg": 1}
+	testCases := []struct {
+		equation string
+		want     float64
+		err      string
+	}{
+		{"2^3^2", 512, ""},
+		{"-2^2", -4, ""},
+		{"0-2^2", -4, ""},
+		{"(-2)^2", 4, ""},
+		{"2^-1", 0.5, ""},
+		{"(2^3)^2", 64, ""},
+		{"2*3^2", 18, ""},
+		{"4^0,5", 2, ""},
+		{"(0-8)^3", -512, ""},
+		{"2^(0-2)", 0.25, ""},
+		{"(0-8)^(1/3)", 0, "negative base with fractional exponent"},
+		{"0^(0-1)", 0, "division by zero"},
+	}
+
+	for _, tc := range testCases {
+		root, err := Parse(tc.equation)
+		if err != nil {
+			t.Fatalf("Parse(%q) returned error %v", tc.equation, err)
+		}
+		evaluator, _ := newTestEvaluator(2, durations)
+		results, err := evaluator.Run([]*Node{root}, []int{1})
+		if tc.err != "" {
+			if err == nil || err.Error() != tc.err {
+				t.Errorf("Run(%q) returned error %v; want %s", tc.equation, err, tc.err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("Run(%q) returned error %v", tc.equation, err)
+		} else if results[0].Float64() != tc.want {
+			t.Errorf("Run(%q) = %v; want %v", tc.equation, results[0].Float64(), tc.want)
+		}
+	}
+}
+
+func TestEvaluatorModulo(t *testing.T) {
+	durations := map[string]int{"%": 1, "//": 1, "-": 1}
+	testCases := []struct {
+		equation string
+		want     float64
+	}{
+		{"7//2", 3},
+		{"(0-7)//2", -4},
+		{"7//(0-2)", -4},
+		{"7,5//2", 3},
+		{"7%3", 1},
+		{"(0-7)%3", 2},
+		{"7%(0-3)", -2},
+		{"(0-7)%(0-3)", -1},
+		{"5,5%2", 1.5},
+		{"6%3", 0},
+	}
+
+	for _, tc := range testCases {
+		root, err := Parse(tc.equation)
+		if err != nil {
+			t.Fatalf("Parse(%q) returned error %v", tc.equation, err)
+		}
+		evaluator, _ := newTestEvaluator(1, durations)
+		results, err := evaluator.Run([]*Node{root}, []int{1})
+		if err != nil {
+			t.Errorf("Run(%q) returned error %v", tc.equation, err)
+		} else if results[0].Float64() != tc.want {
+			t.Errorf("Run(%q) = %v; want %v", tc.equation, results[0].Float64(), tc.want)
+		}
+	}
+
+	for _, equation := range []string{"1%0", "1//0", "1%(1-1)"} {
+		root, _ := Parse(equation)
+		evaluator, _ := newTestEvaluator(1, durations)
+		if _, err := evaluator.Run([]*Node{root}, []int{1}); err == nil || err.Error() != "division by zero" {
+			t.Errorf("Run(%q) returned error %v; want division by zero", equation, err)
+		}
+	}
+}
+
+func TestEvaluatorUnary(t *testing.T) {
+	durations := map[string]int{"+": 10, "*": 20, "neg": 5, "pos": 3}
+	testCases := []struct {
+		equation string
+		want     float64
+		schedule []string
+	}{
+		{"-1", -1, nil},
+		{"--1", 1, []string{"-(-1)@1:0-5"}},
+		{"-(1+2)", -3, []string{"1+2@1:0-10", "-(1+2)@1:10-15"}},
+		{"-(-(1+2))", 3, []string{"1+2@1:0-10", "-(1+2)@1:10-15", "-(-(1+2))@1:15-20"}},
+		{"2*-(1+2)", -6, []string{"1+2@1:0-10", "-(1+2)@1:10-15", "2*(-(1+2))@1:15-35"}},
+		{"+(1+2)", 3, []string{"1+2@1:0-10", "+(1+2)@1:10-13"}},
+	}
+
+	for _, tc := range testCases {
+		root, err := Parse(tc.equation)
+		if err != nil {
+			t.Fatalf("Parse(%q) returned error %v", tc.equation, err)
+		}
+		evaluator, tasks := newTestEvaluator(1, durations)
+		results, err := evaluator.Run([]*Node{root}, []int{1})
+		if err != nil {
+			t.Errorf("Run(%q) returned error %v", tc.equation, err)
+			continue
+		}
+		if results[0].Float64() != tc.want {
+			t.Errorf("Run(%q) = %v; want %v", tc.equation, results[0].Float64(), tc.want)
+		}
+		if got := scheduleOf(*tasks); fmt.Sprint(got) != fmt.Sprint(tc.schedule) {
+			t.Errorf("Run(%q) schedule = %v; want %v", tc.equation, got, tc.schedule)
+		}
+	}
+}
+
+func TestEvaluatorFunctions(t *testing.T) {
+	durations := map[string]int{"+": 10, "*": 20, "sqrt": 30, "max": 5}
+	testCases := []struct {
+		equation string
+		want     float64
+		err      string
+	}{
+		{"sqrt(16)*max(3,4,5)", 20, ""},
+		{"max(0xFF, 1e3, 0b1)", 1000, ""},
+		{"min(3,-1,2)", -1, ""},
+		{"abs(-2.5)", 2.5, ""},
+		{"round(2.5)", 3, ""},
+		{"round(3.14159,2)", 3.14, ""},
+		{"log(8,2)", 3, ""},
+		{"log(1)", 0, ""},
+		{"sqrt(0-4)", 0, "square root of a negative number"},
+		{"log(0)", 0, "logarithm of a non-positive number"},
+		{"log(8,1)", 0, "invalid base of logarithm"},
+		{"round(1,0.5)", 0, "the number of digits must be an integer"},
+	}
+
+	for _, tc := range testCases {
+		root, err := Parse(tc.equation)
+		if err != nil {
+			t.Fatalf("Parse(%q) returned error %v", tc.equation, err)
+		}
+		evaluator, _ := newTestEvaluator(2, durations)
+		results, err := evaluator.Run([]*Node{root}, []int{1})
+		if tc.err != "" {
+			if err == nil || err.Error() != tc.err {
+				t.Errorf("Run(%q) returned error %v; want %s", tc.equation, err, tc.err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("Run(%q) returned error %v", tc.equation, err)
+		} else if results[0].Float64() != tc.want {
+			t.Errorf("Run(%q) = %v; want %v", tc.equation, results[0].Float64(), tc.want)
+		}
+	}
+
+	// The arguments of a call are computed in parallel, then the call takes its own duration
+	root, _ := Parse("max(1+2,3*4)")
+	evaluator, tasks := newTestEvaluator(2, durations)
+	if _, err := evaluator.Run([]*Node{root}, []int{1}); err != nil {
+		t.Fatalf("Run returned error %v", err)
+	}
+	want := []string{"1+2@1:0-10", "3*4@2:0-20", "max(1+2,3*4)@1:20-25"}
+	if got := scheduleOf(*tasks); fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("Run schedule = %v; want %v", got, want)
+	}
+}
+
+func TestEvaluatorConditions(t *testing.T) {
+	durations := map[string]int{"+": 10, "*": 20, "/": 20, "<": 5, ">": 5, "if": 1}
+	testCases := []struct {
+		equation string
+		want     float64
+	}{
+		{"1 < 2", 1},
+		{"2 <= 1", 0},
+		{"0.5 == 1/2", 1},
+		{"1 != 1", 0},
+		{"3 > 2 && 2 >= 3", 0},
+		{"3 > 2 || 2 >= 3", 1},
+		{"!0 + !5", 1},
+		{"1 + 2 < 2 * 2", 1},
+		{"if(100 > 50, 100*0.02, 1)", 2},
+		{"if(0, 1, -1)", -1},
+		// The other branch is not computed, so it does not fail
+		{"if(1 > 0, 1, 1/0)", 1},
+	}
+
+	for _, tc := range testCases {
+		root, err := Parse(tc.equation)
+		if err != nil {
+			t.Fatalf("Parse(%q) returned error %v", tc.equation, err)
+		}
+		evaluator, _ := newTestEvaluator(2, durations)
+		results, err := evaluator.Run([]*Node{root}, []int{1})
+		if err != nil {
+			t.Errorf("Run(%q) returned error %v", tc.equation, err)
+		} else if results[0].Float64() != tc.want {
+			t.Errorf("Run(%q) = %v; want %v", tc.equation, results[0].Float64(), tc.want)
+		}
+	}
+
+	// Only the chosen branch is placed on the computers, after the condition
+	root, _ := Parse("if(1 < 2, 3*4, 5+6)")
+	evaluator, tasks := newTestEvaluator(2, durations)
+	if _, err := evaluator.Run([]*Node{root}, []int{1}); err != nil {
+		t.Fatalf("Run returned error %v", err)
+	}
+	want := []string{"1<2@1:0-5", "3*4@1:5-25", "if(1<2,3*4,5+6)@1:25-26"}
+	if got := scheduleOf(*tasks); fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("Run schedule = %v; want %v", got, want)
+	}
+}
+
+func TestEvaluatorDivisionByZero(t *testing.T) {
+	root, _ := Parse("1+2/(3-3)")
+	evaluator, _ := newTestEvaluator(2, map[string]int{"+": 1, "-": 1, "*": 1, "/": 1})
+	if _, err := evaluator.Run([]*Node{root}, []int{1}); err == nil || err.Error() != "division by zero" {
+		t.Errorf("Run returned error %v; want division by zero", err)
+	}
+	// The computers must be free after the error
+	pool := evaluator.Pool.(*MemoryPool)
+	for i, busy := range pool.busy {
+		if busy {
+			t.Errorf("computer %d is still busy", i+1)
+		}
+	}
+}
+
+// busyPool is a pool whose computers are taken by other expressions until the given time.
+type busyPool struct {
+	*MemoryPool
+	clock Clock
+	until time.Time
+}
+
+func (p busyPool) Acquire(equationID int) (int, bool, error) {
+	if p.clock.Now().Before(p.until) {
+		return 0, false, nil
+	}
+	return p.MemoryPool.Acquire(equationID)
+}
+
+func TestEvaluatorWaitsForComputer(t *testing.T) {
+	root, _ := Parse("1+2")
+	clock := NewFakeClock()
+	evaluator, tasks := newTestEvaluator(1, map[string]int{"+": 10})
+	evaluator.Clock = clock
+	evaluator.Pool = busyPool{MemoryPool: NewMemoryPool(Computers(1)), clock: clock, until: clock.Now().Add(12 * time.Millisecond)}
+	if _, err := evaluator.Run([]*Node{root}, []int{1}); err != nil {
+		t.Fatalf("Run returned error %v", err)
+	}
+	// The computer is polled every 5 ms
+	want := []string{"1+2@1:15-25"}
+	if got := scheduleOf(*tasks); len(got) != 1 || got[0] != want[0] {
+		t.Errorf("Run scheduled %q; want %q", got, want)
+	}
+}
+
+func TestEvaluatorPoolDuration(t *testing.T) {
+	root, _ := Parse("1+2")
+	clock := NewFakeClock()
+	evaluator, tasks := newTestEvaluator(1, map[string]int{"+": 10})
+	evaluator.Clock = clock
+	// The speed of a computer applies to any pool, not only to MemoryPool itself
+	evaluator.Pool = busyPool{MemoryPool: NewMemoryPool([]Computer{{Name: "fast", Speed: 2}}), clock: clock, until: clock.Now()}
+	if _, err := evaluator.Run([]*Node{root}, []int{1}); err != nil {
+		t.Fatalf("Run returned error %v", err)
+	}
+	want := []string{"1+2@1:0-5"}
+	if got := scheduleOf(*tasks); fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("Run scheduled %q; want %q", got, want)
+	}
+}
+
+func TestEvaluatorCancel(t *testing.T) {
+	root, _ := Parse("2*3+(1+2)")
+	pool := NewMemoryPool(Computers(2))
+	cancel := make(chan struct{})
+	evaluator, tasks := newTestEvaluator(2, map[string]int{"+": 10, "*": 1000})
+	evaluator.Pool = pool
+	evaluator.Cancel = cancel
+	evaluator.OnTask = func(task Task) {
+		*tasks = append(*tasks, task)
+		close(cancel)
+	}
+	if _, err := evaluator.Run([]*Node{root}, []int{1}); err != ErrCancelled {
+		t.Fatalf("Run returned error %v; want %v", err, ErrCancelled)
+	}
+	// The running multiplication is abandoned and its computer is free again
+	want := []string{"1+2@2:0-10"}
+	if got := scheduleOf(*tasks); fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("Run computed %q; want %q", got, want)
+	}
+	for i := 0; i < 2; i++ {
+		if _, ok, _ := pool.Acquire(1); !ok {
+			t.Errorf("the computers are not released after the cancellation")
+		}
+	}
+}
@@ -0,0 +1,119 @@
+package agent
+
+import (
+	"strings"
+	"sync"
+)
+
+// The types of the events.
+const (
+	// StatusEvent reports the new status of an expression, like "Computing", "Cancelled" or "Error division by zero".
+	StatusEvent = "status"
+	// ProgressEvent reports the number of the computed operations of an expression.
+	ProgressEvent = "progress"
+	// ResultEvent reports the result of a computed expression.
+	ResultEvent = "result"
+	// ComputerEvent reports that a computer has taken an operation of an expression or has become free.
+	ComputerEvent = "computer"
+)
+
+// subscriptionBuffer is the number of the events a subscriber may fall behind before it misses events.
+const subscriptionBuffer = 64
+
+// Event is a change of an expression or a computer.
+type Event struct {
+	Type       string
+	EquationID int
+	// UserID is the owner of the expression, it is 0 for the events of the computers.
+	UserID int
+	// Status is the status of a status or a result event.
+	Status string
+	// Completed and Total are the computed and all operations of a progress event.
+	// The branches of if that are not chosen are never computed, so Completed may stay below Total.
+	Completed int
+	Total     int
+	// Result and ResultText are the result of a result event, as the float64 and the exact text.
+	Result     float64
+	ResultText string
+	// Computer is the computer of a computer event, its EquationID is 0 when it becomes free.
+	Computer int
+}
+
+// Payload returns the data of the event for the clients.
+func (e Event) Payload() map[string]interface{} {
+	switch e.Type {
+	case ProgressEvent:
+		return map[string]interface{}{"id": e.EquationID, "completed": e.Completed, "total": e.Total}
+	case ResultEvent:
+		return map[string]interface{}{"id": e.EquationID, "status": e.Status, "result": e.Result, "result_text": e.ResultText}
+	case ComputerEvent:
+		return map[string]interface{}{"computer": e.Computer, "equation_id": e.EquationID}
+	}
+	return map[string]interface{}{"id": e.EquationID, "status": e.Status}
+}
+
+// Final reports whether the expression is finished with the event.
+func (e Event) Final() bool {
+	return e.Type == ResultEvent || (e.Type == StatusEvent && Finished(e.Status))
+}
+
+// Finished reports whether an expression with the status is computed, has failed or has been cancelled.
+func Finished(status string) bool {
+	return status == "Computed" || strings.HasPrefix(status, "Error") || status == CancelledStatus
+}
+
+// Bus delivers the published events to the subscribers.
+// Publishing never blocks: a subscriber that falls behind by more than subscriptionBuffer events misses the newer ones.
+type Bus struct {
+	mu          sync.Mutex
+	subscribers map[*Subscription]bool
+}
+
+// Subscription receives the events accepted by its filter from C until it is closed.
+type Subscription struct {
+	C      <-chan Event
+	c      chan Event
+	filter func(Event) bool
+	bus    *Bus
+}
+
+// Events is the bus of the changes of the expressions and the computers, fed by Evaluate.
+var Events = &Bus{}
+
+// Subscribe subscribes to the events accepted by the filter, the nil filter accepts all events.
+func (b *Bus) Subscribe(filter func(Event) bool) *Subscription {
+	c := make(chan Event, subscriptionBuffer)
+	s := &Subscription{C: c, c: c, filter: filter, bus: b}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.subscribers == nil {
+		b.subscribers = make(map[*Subscription]bool)
+	}
+	b.subscribers[s] = true
+	return s
+}
+
+// Close stops the subscription and closes C.
+func (s *Subscription) Close() {
+	s.bus.mu.Lock()
+	defer s.bus.mu.Unlock()
+	if s.bus.subscribers[s] {
+		delete(s.bus.subscribers, s)
+		close(s.c)
+	}
+}
+
+// Publish delivers the event to the subscribers that accept it.
+func (b *Bus) Publish(e Event) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for s := range b.subscribers {
+		if s.filter != nil && !s.filter(e) {
+			continue
+		}
+		select {
+		case s.c <- e:
+		default:
+		}
+	}
+}
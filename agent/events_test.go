@@ -0,0 +1,49 @@
+package agent
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestBus(t *testing.T) {
+	bus := &Bus{}
+	all := bus.Subscribe(nil)
+	user := bus.Subscribe(func(e Event) bool {
+		return e.UserID == 1
+	})
+	bus.Publish(Event{Type: StatusEvent, EquationID: 1, UserID: 1, Status: "Computing"})
+	bus.Publish(Event{Type: StatusEvent, EquationID: 2, UserID: 2, Status: "Computing"})
+	bus.Publish(Event{Type: ResultEvent, EquationID: 1, UserID: 1, Status: "Computed", Result: 3, ResultText: "3"})
+
+	if got := len(all.C); got != 3 {
+		t.Errorf("the subscription without a filter received %d events; want 3", got)
+	}
+	var got []string
+	for len(user.C) > 0 {
+		e := <-user.C
+		got = append(got, fmt.Sprintf("%s %v %v", e.Type, e.Payload(), e.Final()))
+	}
+	want := []string{
+		"status map[id:1 status:Computing] false",
+		"result map[id:1 result:3 result_text:3 status:Computed] true",
+	}
+	if fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("the filtered subscription received %v; want %v", got, want)
+	}
+
+	// A closed subscription receives nothing, publishing to a full subscription does not block
+	user.Close()
+	user.Close()
+	if _, ok := <-user.C; ok {
+		t.Errorf("the closed subscription received an event")
+	}
+	for i := 0; i < 2*subscriptionBuffer; i++ {
+		bus.Publish(Event{Type: ProgressEvent, EquationID: 1, UserID: 1, Completed: i, Total: 100})
+	}
+	if got := len(all.C); got != subscriptionBuffer {
+		t.Errorf("the full subscription holds %d events; want %d", got, subscriptionBuffer)
+	}
+	if got := (Event{Type: StatusEvent, Status: "Error division by zero"}).Final(); !got {
+		t.Errorf("Final() of an error status = false; want true")
+	}
+}
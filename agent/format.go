@@ -0,0 +1,171 @@
+package agent
+
+import (
+	"errors"
+	"fmt"
+	"math/big"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// formatPrecision is the precision in bits used to format exact results in scientific notation.
+const formatPrecision = 512
+
+// NumberFormat describes how results are shown to the user.
+// Formatting does not change the stored results, which keep their full precision.
+type NumberFormat struct {
+	// Digits is the number of significant digits, 0 keeps all digits.
+	Digits int
+	// Decimals is the number of digits after the decimal point, -1 keeps all digits.
+	// It is used when Digits is 0.
+	Decimals int
+	// Scientific shows the numbers like 1.5e+06.
+	Scientific bool
+	// Group separates the thousands of the integer part, the empty Group does not separate them.
+	Group string
+	// Decimal is the decimal separator.
+	Decimal string
+}
+
+// DefaultNumberFormat shows the results as they are stored.
+var DefaultNumberFormat = NumberFormat{Decimals: -1, Decimal: "."}
+
+// separators are the names of the separators accepted by ParseNumberFormat.
+var separators = map[string]string{
+	"none":       "",
+	"dot":        ".",
+	"comma":      ",",
+	"space":      " ",
+	"nbsp":       "\u00a0",
+	"apostrophe": "'",
+}
+
+// ParseNumberFormat reads the format from the query parameters, starting with the defaults:
+//   - digits — the number of significant digits
+//   - decimals — the number of digits after the decimal point
+//   - notation — plain or scientific
+//   - group and decimal — the separators: none, dot, comma, space, nbsp or apostrophe
+func ParseNumberFormat(query url.Values, defaults NumberFormat) (NumberFormat, error) {
+	format := defaults
+	if value := query.Get("digits"); value != "" {
+		digits, err := strconv.Atoi(value)
+		if err != nil || digits <= 0 || digits > MaxDigits {
+			return format, fmt.Errorf("digits must be an integer from 1 to %d", MaxDigits)
+		}
+		format.Digits = digits
+	}
+	if value := query.Get("decimals"); value != "" {
+		decimals, err := strconv.Atoi(value)
+		if err != nil || decimals < 0 || decimals > MaxDigits {
+			return format, fmt.Errorf("decimals must be an integer from 0 to %d", MaxDigits)
+		}
+		format.Decimals = decimals
+	}
+	switch query.Get("notation") {
+	case "":
+	case "plain":
+		format.Scientific = false
+	case "scientific":
+		format.Scientific = true
+	default:
+		return format, fmt.Errorf("unknown notation %q", query.Get("notation"))
+	}
+	for _, parameter := range []string{"group", "decimal"} {
+		name := query.Get(parameter)
+		if name == "" {
+			continue
+		}
+		separator, ok := separators[name]
+		if !ok {
+			return format, fmt.Errorf("unknown separator %q", name)
+		}
+		if parameter == "group" {
+			format.Group = separator
+		} else {
+			format.Decimal = separator
+		}
+	}
+	if format.Decimal == "" || format.Decimal == format.Group {
+		return format, errors.New("the decimal separator must differ from the group separator")
+	}
+	return format, nil
+}
+
+// Format formats a result stored as text: a float64, a fraction like 1/3 or a decimal.
+// A fraction is kept as it is unless digits or decimals are requested.
+func (f NumberFormat) Format(text string) string {
+	r, ok := new(big.Rat).SetString(text)
+	if !ok {
+		return text
+	}
+	var number string
+	switch {
+	case f.Scientific:
+		digits := -1
+		if f.Digits > 0 {
+			digits = f.Digits - 1
+		} else if f.Decimals >= 0 {
+			digits = f.Decimals
+		}
+		if digits < 0 {
+			value, _ := r.Float64()
+			number = strconv.FormatFloat(value, 'e', -1, 64)
+		} else {
+			number = new(big.Float).SetPrec(formatPrecision).SetRat(r).Text('e', digits)
+		}
+	case f.Digits > 0:
+		number = significant(r, f.Digits)
+	case f.Decimals >= 0:
+		number = r.FloatString(f.Decimals)
+	case strings.Contains(text, "/"):
+		return text
+	case strings.ContainsAny(text, "eE"):
+		// Large and small float64 results are stored with an exponent
+		value, _ := r.Float64()
+		number = strconv.FormatFloat(value, 'f', -1, 64)
+	default:
+		number = strings.TrimPrefix(text, "+")
+	}
+	return f.separate(number)
+}
+
+// significant rounds r to the number of significant digits and formats it without an exponent.
+func significant(r *big.Rat, digits int) string {
+	if r.Sign() == 0 {
+		return "0"
+	}
+	// The exponent of the leading digit, like 2 for 123.4
+	mantissa := new(big.Float).SetPrec(formatPrecision).SetRat(r).Text('e', digits-1)
+	exponent, _ := strconv.Atoi(mantissa[strings.LastIndexByte(mantissa, 'e')+1:])
+	decimals := digits - 1 - exponent
+	rounded := roundRat(r, decimals)
+	return rounded.FloatString(max(decimals, 0))
+}
+
+// separate replaces the decimal point and groups the thousands of the number.
+func (f NumberFormat) separate(number string) string {
+	sign := ""
+	if strings.HasPrefix(number, "-") {
+		sign, number = "-", number[1:]
+	}
+	exponent := ""
+	if i := strings.IndexAny(number, "eE"); i >= 0 {
+		number, exponent = number[:i], number[i:]
+	}
+	integer, fraction, hasFraction := strings.Cut(number, ".")
+	if f.Group != "" && len(integer) > 3 {
+		var grouped strings.Builder
+		for i, digit := range integer {
+			if i > 0 && (len(integer)-i)%3 == 0 {
+				grouped.WriteString(f.Group)
+			}
+			grouped.WriteRune(digit)
+		}
+		integer = grouped.String()
+	}
+	if hasFraction {
+		integer += f.Decimal + fraction
+	}
+	return sign + integer + exponent
+}
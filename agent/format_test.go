@@ -0,0 +1,60 @@
+package agent
+
+import (
+	"net/url"
+	"testing"
+)
+
+func TestNumberFormat(t *testing.T) {
+	russian := NumberFormat{Decimals: -1, Group: " ", Decimal: ","}
+	testCases := []struct {
+		text   string
+		format NumberFormat
+		want   string
+	}{
+		{"0.30000000000000004", DefaultNumberFormat, "0.30000000000000004"},
+		{"1234567.5", DefaultNumberFormat, "1234567.5"},
+		{"1234567.5", russian, "1 234 567,5"},
+		{"1.234567891e+06", russian, "1 234 567,891"},
+		{"1e-07", DefaultNumberFormat, "0.0000001"},
+		{"-1234", russian, "-1 234"},
+		{"123", russian, "123"},
+		{"1/3", russian, "1/3"},
+		{"0.30000000000000004", NumberFormat{Decimals: 2, Decimal: "."}, "0.30"},
+		{"1/3", NumberFormat{Decimals: 4, Decimal: ","}, "0,3333"},
+		{"2/3", NumberFormat{Decimals: 0, Decimal: "."}, "1"},
+		{"123456", NumberFormat{Digits: 2, Decimals: -1, Decimal: "."}, "120000"},
+		{"0.00123456", NumberFormat{Digits: 3, Decimals: -1, Decimal: "."}, "0.00123"},
+		{"999.96", NumberFormat{Digits: 4, Decimals: -1, Decimal: "."}, "1000"},
+		{"1500000", NumberFormat{Decimals: -1, Scientific: true, Decimal: "."}, "1.5e+06"},
+		{"1500000", NumberFormat{Digits: 3, Decimals: -1, Scientific: true, Decimal: ","}, "1,50e+06"},
+		{"1/3", NumberFormat{Decimals: 2, Scientific: true, Decimal: "."}, "3.33e-01"},
+		{"1267650600228229401496703205376", NumberFormat{Decimals: -1, Group: "'", Decimal: "."}, "1'267'650'600'228'229'401'496'703'205'376"},
+		{"Infinity", DefaultNumberFormat, "Infinity"},
+	}
+
+	for _, tc := range testCases {
+		if got := tc.format.Format(tc.text); got != tc.want {
+			t.Errorf("%+v.Format(%q) = %q; want %q", tc.format, tc.text, got, tc.want)
+		}
+	}
+}
+
+func TestParseNumberFormat(t *testing.T) {
+	query, _ := url.ParseQuery("digits=3&notation=scientific&group=space&decimal=comma")
+	format, err := ParseNumberFormat(query, DefaultNumberFormat)
+	if err != nil {
+		t.Fatalf("ParseNumberFormat returned error %v", err)
+	}
+	want := NumberFormat{Digits: 3, Decimals: -1, Scientific: true, Group: " ", Decimal: ","}
+	if format != want {
+		t.Errorf("ParseNumberFormat = %+v; want %+v", format, want)
+	}
+
+	for _, invalid := range []string{"digits=0", "decimals=-1", "notation=fancy", "group=tab", "group=dot"} {
+		query, _ := url.ParseQuery(invalid)
+		if _, err := ParseNumberFormat(query, DefaultNumberFormat); err == nil {
+			t.Errorf("ParseNumberFormat(%q) returned no error", invalid)
+		}
+	}
+}
@@ -0,0 +1,130 @@
+package agent
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+)
+
+// Function is a built-in function that can be called in an expression, like sqrt(2).
+// A call is an operation of its own: it is placed on a computer for the duration
+// of the operation type named after the function.
+type Function struct {
+	// MinArgs and MaxArgs limit the number of arguments, MaxArgs is -1 for any number.
+	MinArgs int
+	MaxArgs int
+	// Check returns an error if the function cannot be applied to the arguments.
+	Check func(args []float64) error
+	Apply func(args []float64) float64
+}
+
+// Functions are the built-in functions by name.
+var Functions = map[string]Function{
+	"sqrt": {
+		MinArgs: 1,
+		MaxArgs: 1,
+		Check: func(args []float64) error {
+			if args[0] < 0 {
+				return errors.New("square root of a negative number")
+			}
+			return nil
+		},
+		Apply: func(args []float64) float64 {
+			return math.Sqrt(args[0])
+		},
+	},
+	"abs": {
+		MinArgs: 1,
+		MaxArgs: 1,
+		Apply: func(args []float64) float64 {
+			return math.Abs(args[0])
+		},
+	},
+	"min": {
+		MinArgs: 1,
+		MaxArgs: -1,
+		Apply: func(args []float64) float64 {
+			result := args[0]
+			for _, arg := range args[1:] {
+				result = math.Min(result, arg)
+			}
+			return result
+		},
+	},
+	"max": {
+		MinArgs: 1,
+		MaxArgs: -1,
+		Apply: func(args []float64) float64 {
+			result := args[0]
+			for _, arg := range args[1:] {
+				result = math.Max(result, arg)
+			}
+			return result
+		},
+	},
+	// round(x) rounds to an integer, round(x, n) keeps n digits after the decimal point.
+	// Halves are rounded away from zero.
+	"round": {
+		MinArgs: 1,
+		MaxArgs: 2,
+		Check: func(args []float64) error {
+			if len(args) == 2 && args[1] != math.Trunc(args[1]) {
+				return errors.New("the number of digits must be an integer")
+			}
+			if len(args) == 2 && math.Abs(args[1]) > MaxDigits {
+				return fmt.Errorf("the number of digits must be between -%d and %d", MaxDigits, MaxDigits)
+			}
+			return nil
+		},
+		Apply: func(args []float64) float64 {
+			if len(args) == 1 {
+				return math.Round(args[0])
+			}
+			scale := math.Pow(10, args[1])
+			return math.Round(args[0]*scale) / scale
+		},
+	},
+	// log(x) is the natural logarithm, log(x, b) is the logarithm to the base b.
+	"log": {
+		MinArgs: 1,
+		MaxArgs: 2,
+		Check: func(args []float64) error {
+			if args[0] <= 0 {
+				return errors.New("logarithm of a non-positive number")
+			}
+			if len(args) == 2 && (args[1] <= 0 || args[1] == 1) {
+				return errors.New("invalid base of logarithm")
+			}
+			return nil
+		},
+		Apply: func(args []float64) float64 {
+			if len(args) == 1 {
+				return math.Log(args[0])
+			}
+			return math.Log(args[0]) / math.Log(args[1])
+		},
+	},
+	// if(c, a, b) is a if c is not zero and b otherwise.
+	// The evaluator computes the condition first and then only the chosen branch.
+	"if": {
+		MinArgs: 3,
+		MaxArgs: 3,
+		Apply: func(args []float64) float64 {
+			if args[0] != 0 {
+				return args[1]
+			}
+			return args[2]
+		},
+	},
+}
+
+// FunctionNames returns the names of the built-in functions in alphabetical order.
+func FunctionNames() []string {
+	names := make([]string, 0, len(Functions))
+	for name := range Functions {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
@@ -0,0 +1,167 @@
+package agent
+
+import (
+	"testing"
+)
+
+// fuzzSeeds are the seed corpus of the fuzz tests, the corner cases of the grammar.
+var fuzzSeeds = []string{
+	"",
+	"()",
+	"1+2*3",
+	"(1+2)+(3+4)",
+	"-1,5",
+	"2^-3^2",
+	"7 % 3 // 2",
+	"max(1, 2, 3) + min(4,5)",
+	"round(2,567, 2)",
+	"sqrt(-1)",
+	"1/0",
+	"0*(1/0)",
+	"if(1<2, 3*4, 5+6)",
+	"!(1==2) && 3 >= 4 || 5 != 6",
+	"--1",
+	"1e308*10",
+	"0x1F + 1_000",
+	"x*2 + #1",
+	"a = 1; b = a + 2; a*b",
+	"1 2",
+	"1 < = 2",
+	"max(1; 2)",
+	"((((1))))",
+}
+
+// fuzzDurations makes every operation take one millisecond.
+func fuzzDurations() map[string]int {
+	durations := map[string]int{}
+	for _, op := range []string{"+", "-", "*", "/", "//", "%", "^", "neg", "pos", "not", "<", "<=", "==", "!=", ">", ">=", "&&", "||"} {
+		durations[op] = 1
+	}
+	for name := range Functions {
+		durations[name] = 1
+	}
+	return durations
+}
+
+// evaluateSequential is the reference evaluator: it computes the tree recursively on one goroutine.
+func evaluateSequential(n *Node, arithmetic Arithmetic) (Value, error) {
+	if n.IsLeaf() {
+		return arithmetic.Parse(n.Value)
+	}
+	if n.conditional() {
+		condition, err := evaluateSequential(n.Args[0], arithmetic)
+		if err != nil {
+			return Value{}, err
+		}
+		if condition.IsZero() {
+			return evaluateSequential(n.Args[2], arithmetic)
+		}
+		return evaluateSequential(n.Args[1], arithmetic)
+	}
+	args := make([]Value, len(n.Args))
+	for i, arg := range n.Args {
+		var err error
+		if args[i], err = evaluateSequential(arg, arithmetic); err != nil {
+			return Value{}, err
+		}
+	}
+	if err := arithmetic.check(n, args); err != nil {
+		return Value{}, err
+	}
+	return arithmetic.apply(n, args)
+}
+
+func FuzzTokenize(f *testing.F) {
+	for _, seed := range fuzzSeeds {
+		f.Add(seed)
+	}
+	f.Fuzz(func(t *testing.T, equation string) {
+		tokens, err := Tokenize(equation)
+		if err != nil {
+			return
+		}
+		pos := -1
+		for _, token := range tokens {
+			if token.Pos <= pos || token.Pos >= len(equation) {
+				t.Fatalf("Tokenize(%q) returned token %q at position %d after %d", equation, token.Text, token.Pos, pos)
+			}
+			pos = token.Pos
+		}
+	})
+}
+
+func FuzzParse(f *testing.F) {
+	for _, seed := range fuzzSeeds {
+		f.Add(seed)
+	}
+	f.Fuzz(func(t *testing.T, equation string) {
+		// None of the entry points may panic
+		PrepareEquation(equation)
+		LastOperation(equation)
+		_, _ = ParseImplicit(equation)
+		_, _ = Options{}.ParseScript(equation)
+
+		root, err := Parse(equation)
+		if err != nil {
+			return
+		}
+		// The canonical form is parsed into the same tree
+		canonical := root.String()
+		again, err := Parse(canonical)
+		if err != nil {
+			t.Fatalf("Parse(%q) returned error %v for the canonical form of %q", canonical, err, equation)
+		}
+		if again.String() != canonical || again.Depth() != root.Depth() || again.Operations() != root.Operations() {
+			t.Fatalf("Parse(%q) = %q; want the tree of %q", canonical, again, equation)
+		}
+	})
+}
+
+func FuzzEvaluate(f *testing.F) {
+	for _, seed := range fuzzSeeds {
+		f.Add(seed, uint8(2))
+	}
+	durations := fuzzDurations()
+	f.Fuzz(func(t *testing.T, equation string, computers uint8) {
+		if len(equation) > 200 {
+			return
+		}
+		root, err := Parse(equation)
+		if err != nil || len(root.Variables()) > 0 || len(root.References()) > 0 {
+			return
+		}
+		for _, root := range []*Node{root, Rebalance(root)} {
+			want, wantErr := evaluateSequential(root, Arithmetic{})
+			evaluator, _ := newTestEvaluator(int(computers%4)+1, durations)
+			results, err := evaluator.Run([]*Node{root}, []int{1})
+			if (err == nil) != (wantErr == nil) {
+				t.Fatalf("Run(%q) returned error %v; the sequential evaluation returned %v", root, err, wantErr)
+			}
+			if err != nil {
+				continue
+			}
+			if got := (Arithmetic{}).Format(results[0]); got != (Arithmetic{}).Format(want) {
+				t.Fatalf("Run(%q) = %s; the sequential evaluation gives %s", root, got, (Arithmetic{}).Format(want))
+			}
+		}
+	})
+}
+
+func FuzzValidEquation(f *testing.F) {
+	for _, seed := range fuzzSeeds {
+		f.Add(seed)
+	}
+	durations := fuzzDurations()
+	f.Fuzz(func(t *testing.T, equation string) {
+		_, err := Parse(equation)
+		if valid := ValidEquation(equation, 0, len(equation)); valid != (err == nil) {
+			t.Fatalf("ValidEquation(%q) = %v; Parse returned error %v", equation, valid, err)
+		}
+		// The validation endpoint accepts the same scripts as the evaluation
+		_, validateErr := Validate(equation, Options{}, 1, durations)
+		_, buildErr := BuildScript(equation, Options{})
+		if (validateErr == nil) != (buildErr == nil) {
+			t.Fatalf("Validate(%q) returned error %v; BuildScript returned %v", equation, validateErr, buildErr)
+		}
+	})
+}
@@ -0,0 +1,244 @@
+package agent
+
+import (
+	"fmt"
+	"math/big"
+	"strings"
+	"unicode/utf8"
+)
+
+// TokenKind is the kind of a token.
+type TokenKind int
+
+const (
+	NumberToken TokenKind = iota
+	OperatorToken
+	LeftParenToken
+	RightParenToken
+	IdentToken
+	CommaToken
+	ReferenceToken
+	AssignToken
+	SemicolonToken
+)
+
+// Token is a lexical unit of an expression.
+// Pos is the byte offset of the token in the expression.
+type Token struct {
+	Kind TokenKind
+	Text string
+	Pos  int
+}
+
+// SyntaxError describes an invalid expression.
+// Pos is the byte offset of the error in the expression.
+type SyntaxError struct {
+	Pos int
+	Msg string
+}
+
+func (e *SyntaxError) Error() string {
+	return fmt.Sprintf("%s at position %d", e.Msg, e.Pos)
+}
+
+// operators are the operators, longer ones first so that "//" is not read as two "/" and "<=" is not read as "<".
+// ! is the only operator that is always unary.
+var operators = []string{"//", "<=", ">=", "==", "!=", "&&", "||", "+", "-", "*", "/", "%", "^", "<", ">", "!"}
+
+func isDigit(c byte) bool {
+	return '0' <= c && c <= '9'
+}
+
+func isSpace(c byte) bool {
+	return c == ' ' || c == '\t' || c == '\n' || c == '\r'
+}
+
+func isLetter(c byte) bool {
+	return 'a' <= c && c <= 'z' || 'A' <= c && c <= 'Z' || c == '_'
+}
+
+// callParen reports whether the parenthesis at index i of the equation opens the arguments of a function,
+// that is, whether it follows a name.
+func callParen(equation string, i int) bool {
+	j := i
+	for j > 0 && isSpace(equation[j-1]) {
+		j--
+	}
+	start := j
+	for start > 0 && (isLetter(equation[start-1]) || isDigit(equation[start-1])) {
+		start--
+	}
+	// The word before the parenthesis may be a number like 0xFF or a number followed by a name like 2max
+	tokens, err := Tokenize(equation[start:j])
+	return err == nil && len(tokens) > 0 && tokens[len(tokens)-1].Kind == IdentToken
+}
+
+// DecimalCommas replaces the commas used as decimal points with dots.
+// Commas in the arguments of a function separate the arguments and are kept,
+// so "1,5+max(2,3)" becomes "1.5+max(2,3)".
+func DecimalCommas(equation string) string {
+	result := []byte(equation)
+	var calls []bool
+	for i := 0; i < len(result); i++ {
+		switch result[i] {
+		case '(':
+			calls = append(calls, callParen(equation, i))
+		case ')':
+			if len(calls) > 0 {
+				calls = calls[:len(calls)-1]
+			}
+		case ',':
+			if len(calls) == 0 || !calls[len(calls)-1] {
+				result[i] = '.'
+			}
+		}
+	}
+	return string(result)
+}
+
+// scanNumber reads the number starting at index i of the equation.
+// It returns the number in the decimal form and the index after it.
+// Commas are read as decimal points if decimalComma is true.
+func scanNumber(equation string, i int, decimalComma bool) (string, int, error) {
+	// Hexadecimal and binary integers
+	if equation[i] == '0' && i+1 < len(equation) && strings.ContainsRune("xXbB", rune(equation[i+1])) {
+		base := 16
+		if equation[i+1] == 'b' || equation[i+1] == 'B' {
+			base = 2
+		}
+		j := i + 2
+		for j < len(equation) && (isLetter(equation[j]) || isDigit(equation[j])) {
+			j++
+		}
+		digits, ok := removeSeparators(equation[i+2:j], isHexDigit)
+		value, valid := new(big.Int).SetString(digits, base)
+		if !ok || !valid {
+			return "", j, &SyntaxError{Pos: i, Msg: "invalid number " + equation[i:j]}
+		}
+		return value.String(), j, nil
+	}
+
+	j := i
+	for j < len(equation) && (isDigit(equation[j]) || equation[j] == '.' || equation[j] == '_' || (equation[j] == ',' && decimalComma)) {
+		j++
+	}
+	// The exponent, the e is a part of the number only if digits follow it
+	if j < len(equation) && (equation[j] == 'e' || equation[j] == 'E') {
+		k := j + 1
+		if k < len(equation) && (equation[k] == '+' || equation[k] == '-') {
+			k++
+		}
+		if k < len(equation) && isDigit(equation[k]) {
+			for k < len(equation) && (isDigit(equation[k]) || equation[k] == '_') {
+				k++
+			}
+			j = k
+		}
+	}
+	text, ok := removeSeparators(strings.ReplaceAll(equation[i:j], ",", "."), isDigit)
+	if !ok {
+		return "", j, &SyntaxError{Pos: i, Msg: "invalid number " + equation[i:j]}
+	}
+	return text, j, nil
+}
+
+// removeSeparators removes the _ between digits.
+// It returns false if a separator is not between two digits.
+func removeSeparators(number string, digit func(c byte) bool) (string, bool) {
+	if !strings.Contains(number, "_") {
+		return number, true
+	}
+	for i := 0; i < len(number); i++ {
+		if number[i] == '_' && (i == 0 || i == len(number)-1 || !digit(number[i-1]) || !digit(number[i+1])) {
+			return "", false
+		}
+	}
+	return strings.ReplaceAll(number, "_", ""), true
+}
+
+func isHexDigit(c byte) bool {
+	return isDigit(c) || 'a' <= c && c <= 'f' || 'A' <= c && c <= 'F'
+}
+
+// Tokenize splits the equation into tokens, skipping spaces.
+// Numbers consist of digits and a decimal point with an optional exponent, like 2.5e-3,
+// or they are hexadecimal and binary integers, like 0xFF and 0b1010. Digits may be separated with _.
+// The text of a number token is always a decimal number without separators.
+// Commas are treated as decimal points except in the arguments of a function, where they separate the arguments.
+// Names start with a letter or an underscore and may contain digits.
+// A reference to the result of another expression is # followed by its ID, like #42.
+// Statements of a script are separated with ;, a single = assigns a variable.
+// For example, "1,5 // max(2,3)" becomes [1.5] [//] [max] [(] [2] [,] [3] [)].
+func Tokenize(equation string) ([]Token, error) {
+	var tokens []Token
+	// calls tells for every open parenthesis whether it holds the arguments of a function
+	var calls []bool
+	inCall := func() bool {
+		return len(calls) > 0 && calls[len(calls)-1]
+	}
+	for i := 0; i < len(equation); {
+		c := equation[i]
+		switch {
+		case isSpace(c):
+			i++
+		case c == '(':
+			calls = append(calls, len(tokens) > 0 && tokens[len(tokens)-1].Kind == IdentToken)
+			tokens = append(tokens, Token{Kind: LeftParenToken, Text: "(", Pos: i})
+			i++
+		case c == ')':
+			if len(calls) > 0 {
+				calls = calls[:len(calls)-1]
+			}
+			tokens = append(tokens, Token{Kind: RightParenToken, Text: ")", Pos: i})
+			i++
+		case c == ',' && inCall():
+			tokens = append(tokens, Token{Kind: CommaToken, Text: ",", Pos: i})
+			i++
+		case c == ';':
+			tokens = append(tokens, Token{Kind: SemicolonToken, Text: ";", Pos: i})
+			i++
+		case c == '=' && !strings.HasPrefix(equation[i:], "=="):
+			tokens = append(tokens, Token{Kind: AssignToken, Text: "=", Pos: i})
+			i++
+		case c == '#':
+			j := i + 1
+			for j < len(equation) && isDigit(equation[j]) {
+				j++
+			}
+			if j == i+1 {
+				return nil, &SyntaxError{Pos: j, Msg: "expected the ID of an expression after #"}
+			}
+			tokens = append(tokens, Token{Kind: ReferenceToken, Text: equation[i:j], Pos: i})
+			i = j
+		case isLetter(c):
+			j := i
+			for j < len(equation) && (isLetter(equation[j]) || isDigit(equation[j])) {
+				j++
+			}
+			tokens = append(tokens, Token{Kind: IdentToken, Text: equation[i:j], Pos: i})
+			i = j
+		case isDigit(c) || c == '.' || c == ',':
+			text, j, err := scanNumber(equation, i, !inCall())
+			if err != nil {
+				return nil, err
+			}
+			tokens = append(tokens, Token{Kind: NumberToken, Text: text, Pos: i})
+			i = j
+		default:
+			op := ""
+			for _, operator := range operators {
+				if strings.HasPrefix(equation[i:], operator) {
+					op = operator
+					break
+				}
+			}
+			if op == "" {
+				symbol, _ := utf8.DecodeRuneInString(equation[i:])
+				return nil, &SyntaxError{Pos: i, Msg: fmt.Sprintf("unexpected symbol %q", symbol)}
+			}
+			tokens = append(tokens, Token{Kind: OperatorToken, Text: op, Pos: i})
+			i += len(op)
+		}
+	}
+	return tokens, nil
+}
@@ -0,0 +1,122 @@
+package agent
+
+import "testing"
+
+func TestTokenize(t *testing.T) {
+	testCases := []struct {
+		equation string
+		want     []Token
+	}{
+		{"1,5 // (2+3)", []Token{
+			{NumberToken, "1.5", 0},
+			{OperatorToken, "//", 4},
+			{LeftParenToken, "(", 7},
+			{NumberToken, "2", 8},
+			{OperatorToken, "+", 9},
+			{NumberToken, "3", 10},
+			{RightParenToken, ")", 11},
+		}},
+		{"7%-2^3", []Token{
+			{NumberToken, "7", 0},
+			{OperatorToken, "%", 1},
+			{OperatorToken, "-", 2},
+			{NumberToken, "2", 3},
+			{OperatorToken, "^", 4},
+			{NumberToken, "3", 5},
+		}},
+		{"1,5+max(2,3)", []Token{
+			{NumberToken, "1.5", 0},
+			{OperatorToken, "+", 3},
+			{IdentToken, "max", 4},
+			{LeftParenToken, "(", 7},
+			{NumberToken, "2", 8},
+			{CommaToken, ",", 9},
+			{NumberToken, "3", 10},
+			{RightParenToken, ")", 11},
+		}},
+		{"min((1,5),2)", []Token{
+			{IdentToken, "min", 0},
+			{LeftParenToken, "(", 3},
+			{LeftParenToken, "(", 4},
+			{NumberToken, "1.5", 5},
+			{RightParenToken, ")", 8},
+			{CommaToken, ",", 9},
+			{NumberToken, "2", 10},
+			{RightParenToken, ")", 11},
+		}},
+		{"1e-9+2.5E3*.5", []Token{
+			{NumberToken, "1e-9", 0},
+			{OperatorToken, "+", 4},
+			{NumberToken, "2.5E3", 5},
+			{OperatorToken, "*", 10},
+			{NumberToken, ".5", 11},
+		}},
+		{"0xFF-0b1010+1_000_000", []Token{
+			{NumberToken, "255", 0},
+			{OperatorToken, "-", 4},
+			{NumberToken, "10", 5},
+			{OperatorToken, "+", 11},
+			{NumberToken, "1000000", 12},
+		}},
+		// An e without digits is a name
+		{"2e+e", []Token{
+			{NumberToken, "2", 0},
+			{IdentToken, "e", 1},
+			{OperatorToken, "+", 2},
+			{IdentToken, "e", 3},
+		}},
+		{"", nil},
+	}
+
+	for _, tc := range testCases {
+		got, err := Tokenize(tc.equation)
+		if err != nil {
+			t.Errorf("Tokenize(%q) returned error %v", tc.equation, err)
+			continue
+		}
+		if len(got) != len(tc.want) {
+			t.Errorf("Tokenize(%q) = %v; want %v", tc.equation, got, tc.want)
+			continue
+		}
+		for i := range got {
+			if got[i] != tc.want[i] {
+				t.Errorf("Tokenize(%q) = %v; want %v", tc.equation, got, tc.want)
+				break
+			}
+		}
+	}
+
+	_, err := Tokenize("1 + $")
+	if syntaxError, ok := err.(*SyntaxError); !ok || syntaxError.Pos != 4 {
+		t.Errorf("Tokenize(%q) returned error %v; want a syntax error at position 4", "1 + $", err)
+	}
+}
+
+func TestTokenizeInvalidNumbers(t *testing.T) {
+	for _, equation := range []string{"0x", "0xFG", "0b102", "1__0", "1_", "1_.5", "1_e5", "0x_FF"} {
+		if tokens, err := Tokenize(equation); err == nil && len(tokens) == 1 {
+			t.Errorf("Tokenize(%q) = %v; want an error", equation, tokens)
+		}
+	}
+}
+
+func TestDecimalCommas(t *testing.T) {
+	testCases := []struct {
+		equation string
+		want     string
+	}{
+		{"1,5+2,5", "1.5+2.5"},
+		{"max(1,5)", "max(1,5)"},
+		{"max (1,5)", "max (1,5)"},
+		{"max((1,5),2)*(3,5)", "max((1.5),2)*(3.5)"},
+		{"2(1,5)", "2(1.5)"},
+		{"0xFF(1,5)", "0xFF(1.5)"},
+		{"2max(1,5)", "2max(1,5)"},
+	}
+
+	for _, tc := range testCases {
+		if got := DecimalCommas(tc.equation); got != tc.want {
+			t.Errorf("DecimalCommas(%q) = %q; want %q", tc.equation, got, tc.want)
+		}
+	}
+}
@@ -0,0 +1,282 @@
+package agent
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"math/big"
+	"strconv"
+)
+
+// Mode is the numeric mode an expression is evaluated in.
+type Mode string
+
+const (
+	// FloatMode computes with float64, so 0.1+0.2 gives 0.30000000000000004.
+	FloatMode Mode = "float"
+	// RationalMode computes with exact fractions, so 1/3*3 gives exactly 1.
+	RationalMode Mode = "rational"
+	// DecimalMode computes with exact fractions and rounds the result of every operation
+	// to the given number of digits after the decimal point.
+	DecimalMode Mode = "decimal"
+)
+
+// DefaultPrecision is the number of digits after the decimal point in DecimalMode if none is given.
+const DefaultPrecision = 20
+
+// maxExactExponent limits the exponents that are raised exactly, larger ones are computed with float64.
+const maxExactExponent = 10000
+
+// maxExactBits limits the size of the numerator and the denominator of an exact value in bits, about 40000 decimal digits.
+// Powers that would exceed it are computed with float64, other operations fail.
+const maxExactBits = 1 << 17
+
+// MaxDigits limits the number of digits after the decimal point of round, of the precision of DecimalMode
+// and of the number formats, negative numbers of digits of round are limited the same way.
+const MaxDigits = 1000
+
+// errOutOfRange is the error of the operations whose result is too large for the numeric mode.
+var errOutOfRange = errors.New("result is out of range")
+
+// ParseMode parses the name of a numeric mode, the empty name is FloatMode.
+func ParseMode(name string) (Mode, error) {
+	switch Mode(name) {
+	case "", FloatMode:
+		return FloatMode, nil
+	case RationalMode, DecimalMode:
+		return Mode(name), nil
+	}
+	return "", fmt.Errorf("unknown numeric mode %q", name)
+}
+
+// Value is a number in one of the numeric modes.
+// FloatMode keeps a float64, the exact modes keep a fraction.
+type Value struct {
+	float float64
+	rat   *big.Rat
+}
+
+// Float64 returns the nearest float64 of the value.
+func (v Value) Float64() float64 {
+	if v.rat != nil {
+		f, _ := v.rat.Float64()
+		return f
+	}
+	return v.float
+}
+
+// IsZero reports whether the value is zero, that is, false in a condition.
+func (v Value) IsZero() bool {
+	if v.rat != nil {
+		return v.rat.Sign() == 0
+	}
+	return v.float == 0
+}
+
+// Arithmetic performs the operations in one of the numeric modes.
+// The zero Arithmetic computes with float64.
+type Arithmetic struct {
+	Mode Mode
+	// Precision is the number of digits after the decimal point in DecimalMode.
+	Precision int
+}
+
+// exact reports whether the values are fractions.
+func (a Arithmetic) exact() bool {
+	return a.Mode == RationalMode || a.Mode == DecimalMode
+}
+
+// precision returns the number of digits after the decimal point in DecimalMode.
+func (a Arithmetic) precision() int {
+	if a.Precision <= 0 {
+		return DefaultPrecision
+	}
+	return a.Precision
+}
+
+// Parse parses a number like the ones in the leaves of the tree.
+func (a Arithmetic) Parse(s string) (Value, error) {
+	if a.exact() {
+		r, ok := new(big.Rat).SetString(s)
+		if !ok {
+			return Value{}, fmt.Errorf("invalid number %s", s)
+		}
+		return Value{rat: r}, nil
+	}
+	f, err := strconv.ParseFloat(s, 64)
+	if err != nil {
+		return Value{}, err
+	}
+	return Value{float: f}, nil
+}
+
+// Format returns the text of the value: the shortest float64, a fraction like 1/3,
+// or a decimal with Precision digits after the decimal point.
+func (a Arithmetic) Format(v Value) string {
+	switch {
+	case v.rat == nil:
+		return strconv.FormatFloat(v.float, 'g', -1, 64)
+	case a.Mode == DecimalMode:
+		return v.rat.FloatString(a.precision())
+	}
+	return v.rat.RatString()
+}
+
+// floats converts the values to float64.
+func floats(args []Value) []float64 {
+	result := make([]float64, len(args))
+	for i, arg := range args {
+		result[i] = arg.Float64()
+	}
+	return result
+}
+
+// check returns an error if the operation cannot be performed on the operands.
+func (a Arithmetic) check(n *Node, args []Value) error {
+	if !a.exact() || n.Kind != BinaryNode {
+		return check(n, floats(args))
+	}
+	left, right := args[0].rat, args[1].rat
+	switch n.Op {
+	case "/", "//", "%":
+		if right.Sign() == 0 {
+			return errors.New("division by zero")
+		}
+	case "^":
+		if left.Sign() == 0 && right.Sign() < 0 {
+			return errors.New("division by zero")
+		}
+		if left.Sign() < 0 && !right.IsInt() {
+			return errors.New("negative base with fractional exponent")
+		}
+	}
+	return nil
+}
+
+// apply performs the operation on the operands.
+// In the exact modes the operations without an exact result, like sqrt, are computed with float64.
+// It fails if the result of an exact mode is an infinity, NaN or exceeds maxExactBits.
+func (a Arithmetic) apply(n *Node, args []Value) (Value, error) {
+	if !a.exact() {
+		return Value{float: apply(n, floats(args))}, nil
+	}
+	result, ok := applyExact(n, args)
+	if !ok {
+		// Infinity and NaN have no fractions
+		result = new(big.Rat).SetFloat64(apply(n, floats(args)))
+		if result == nil {
+			return Value{}, errOutOfRange
+		}
+	}
+	if result.Num().BitLen() > maxExactBits || result.Denom().BitLen() > maxExactBits {
+		return Value{}, errOutOfRange
+	}
+	if a.Mode == DecimalMode {
+		result = roundRat(result, a.precision())
+	}
+	return Value{rat: result}, nil
+}
+
+// applyExact performs the operation on fractions.
+// It returns false if the operation has no exact result.
+func applyExact(n *Node, args []Value) (*big.Rat, bool) {
+	switch n.Kind {
+	case UnaryNode:
+		switch n.Op {
+		case "-":
+			return new(big.Rat).Neg(args[0].rat), true
+		case "!":
+			return new(big.Rat).SetFloat64(truth(args[0].rat.Sign() == 0)), true
+		}
+		return args[0].rat, true
+	case CallNode:
+		switch n.Op {
+		case "abs":
+			return new(big.Rat).Abs(args[0].rat), true
+		case "min", "max":
+			result := args[0].rat
+			for _, arg := range args[1:] {
+				if (n.Op == "min") == (arg.rat.Cmp(result) < 0) {
+					result = arg.rat
+				}
+			}
+			return result, true
+		case "round":
+			digits := 0
+			if len(args) == 2 {
+				digits = int(args[1].rat.Num().Int64())
+			}
+			return roundRat(args[0].rat, digits), true
+		case "if":
+			if args[0].rat.Sign() != 0 {
+				return args[1].rat, true
+			}
+			return args[2].rat, true
+		}
+		return nil, false
+	}
+	left, right := args[0].rat, args[1].rat
+	switch n.Op {
+	case "+":
+		return new(big.Rat).Add(left, right), true
+	case "-":
+		return new(big.Rat).Sub(left, right), true
+	case "*":
+		return new(big.Rat).Mul(left, right), true
+	case "/":
+		return new(big.Rat).Quo(left, right), true
+	case "//":
+		return new(big.Rat).SetInt(floorRat(new(big.Rat).Quo(left, right))), true
+	case "%":
+		// left - right*(left//right), so the remainder has the sign of the divisor
+		quotient := new(big.Rat).SetInt(floorRat(new(big.Rat).Quo(left, right)))
+		return new(big.Rat).Sub(left, quotient.Mul(quotient, right)), true
+	case "^":
+		if !right.IsInt() || right.Num().CmpAbs(big.NewInt(maxExactExponent)) > 0 {
+			return nil, false
+		}
+		exponent := new(big.Int).Abs(right.Num())
+		// The power has about as many bits as the base times the exponent
+		if int64(max(left.Num().BitLen(), left.Denom().BitLen()))*exponent.Int64() > maxExactBits {
+			return nil, false
+		}
+		num := new(big.Int).Exp(left.Num(), exponent, nil)
+		denom := new(big.Int).Exp(left.Denom(), exponent, nil)
+		if right.Sign() < 0 {
+			num, denom = denom, num
+		}
+		return new(big.Rat).SetFrac(num, denom), true
+	case "<", "<=", "==", "!=", ">", ">=":
+		cmp := left.Cmp(right)
+		result := map[string]bool{"<": cmp < 0, "<=": cmp <= 0, "==": cmp == 0, "!=": cmp != 0, ">": cmp > 0, ">=": cmp >= 0}[n.Op]
+		return new(big.Rat).SetFloat64(truth(result)), true
+	case "&&":
+		return new(big.Rat).SetFloat64(truth(left.Sign() != 0 && right.Sign() != 0)), true
+	case "||":
+		return new(big.Rat).SetFloat64(truth(left.Sign() != 0 || right.Sign() != 0)), true
+	}
+	return nil, false
+}
+
+// floorRat returns the largest integer not greater than r.
+func floorRat(r *big.Rat) *big.Int {
+	// The denominator is positive, so the Euclidean division rounds down
+	return new(big.Int).Div(r.Num(), r.Denom())
+}
+
+// roundRat rounds r to the given number of digits after the decimal point, halves away from zero.
+// Negative digits round to tens, hundreds and so on. The digits are limited to MaxDigits either way.
+func roundRat(r *big.Rat, digits int) *big.Rat {
+	digits = max(-MaxDigits, min(digits, MaxDigits))
+	scale := new(big.Rat).SetInt(new(big.Int).Exp(big.NewInt(10), big.NewInt(int64(math.Abs(float64(digits)))), nil))
+	if digits < 0 {
+		scale.Inv(scale)
+	}
+	scaled := new(big.Rat).Mul(new(big.Rat).Abs(r), scale)
+	rounded := floorRat(scaled.Add(scaled, big.NewRat(1, 2)))
+	if r.Sign() < 0 {
+		rounded.Neg(rounded)
+	}
+	result := new(big.Rat).SetInt(rounded)
+	return result.Quo(result, scale)
+}
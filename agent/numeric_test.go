@@ -0,0 +1,84 @@
+package agent
+
+import "testing"
+
+func TestArithmetic(t *testing.T) {
+	durations := map[string]int{}
+	testCases := []struct {
+		equation   string
+		arithmetic Arithmetic
+		want       string
+		err        string
+	}{
+		{"0.1+0.2", Arithmetic{}, "0.30000000000000004", ""},
+		{"0.1+0.2", Arithmetic{Mode: RationalMode}, "3/10", ""},
+		{"0.1+0.2", Arithmetic{Mode: DecimalMode, Precision: 5}, "0.30000", ""},
+		{"1/3*3", Arithmetic{Mode: RationalMode}, "1", ""},
+		{"1e-3+2.5E3-0xFF", Arithmetic{Mode: RationalMode}, "2245001/1000", ""},
+		{"2^100+1", Arithmetic{Mode: RationalMode}, "1267650600228229401496703205377", ""},
+		{"10^-2", Arithmetic{Mode: RationalMode}, "1/100", ""},
+		{"-7//2", Arithmetic{Mode: RationalMode}, "-4", ""},
+		{"-7%3", Arithmetic{Mode: RationalMode}, "2", ""},
+		{"7.5%-2", Arithmetic{Mode: RationalMode}, "-1/2", ""},
+		{"max(1/3, 0.3, -1)", Arithmetic{Mode: RationalMode}, "1/3", ""},
+		{"round(-2.5)", Arithmetic{Mode: RationalMode}, "-3", ""},
+		{"round(1/3, 3)", Arithmetic{Mode: RationalMode}, "333/1000", ""},
+		{"sqrt(4)", Arithmetic{Mode: RationalMode}, "2", ""},
+		// Comparisons are exact too
+		{"0.1+0.2 == 0.3", Arithmetic{}, "0", ""},
+		{"0.1+0.2 == 0.3", Arithmetic{Mode: RationalMode}, "1", ""},
+		{"if(1/3 > 0.3 && !0, 1/3, 0)", Arithmetic{Mode: RationalMode}, "1/3", ""},
+		// Every operation is rounded in the decimal mode
+		{"1/3", Arithmetic{Mode: DecimalMode, Precision: 5}, "0.33333", ""},
+		{"2/3", Arithmetic{Mode: DecimalMode, Precision: 2}, "0.67", ""},
+		{"1/3*3", Arithmetic{Mode: DecimalMode, Precision: 2}, "0.99", ""},
+		{"1/3", Arithmetic{Mode: DecimalMode}, "0.33333333333333333333", ""},
+		// Exact zero is detected where float64 sees a tiny number
+		{"1/(0.1+0.2-0.3)", Arithmetic{Mode: RationalMode}, "", "division by zero"},
+		{"1//(0.1+0.2-0.3)", Arithmetic{Mode: DecimalMode}, "", "division by zero"},
+		{"(0-8)^(1/3)", Arithmetic{Mode: RationalMode}, "", "negative base with fractional exponent"},
+		// Results beyond float64 and the size limit are errors instead of zero
+		{"2^20000", Arithmetic{Mode: RationalMode}, "", "result is out of range"},
+		{"2^20000", Arithmetic{Mode: DecimalMode}, "", "result is out of range"},
+		{"((10^10000)^10000)^10000", Arithmetic{Mode: RationalMode}, "", "result is out of range"},
+		{"(10^10000)*(10^10000)*(10^10000)*(10^10000)", Arithmetic{Mode: RationalMode}, "", "result is out of range"},
+		{"(1/2)^2000", Arithmetic{Mode: DecimalMode, Precision: 3}, "0.000", ""},
+		{"round(1, 1e18)", Arithmetic{Mode: RationalMode}, "", "the number of digits must be between -1000 and 1000"},
+		{"round(1, 1e18)", Arithmetic{}, "", "the number of digits must be between -1000 and 1000"},
+		{"round(1234, -3)", Arithmetic{Mode: RationalMode}, "1000", ""},
+	}
+
+	for _, tc := range testCases {
+		root, err := Parse(tc.equation)
+		if err != nil {
+			t.Fatalf("Parse(%q) returned error %v", tc.equation, err)
+		}
+		evaluator, _ := newTestEvaluator(1, durations)
+		evaluator.Arithmetic = tc.arithmetic
+		results, err := evaluator.Run([]*Node{root}, []int{1})
+		if tc.err != "" {
+			if err == nil || err.Error() != tc.err {
+				t.Errorf("Run(%q) in mode %q returned error %v; want %s", tc.equation, tc.arithmetic.Mode, err, tc.err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("Run(%q) in mode %q returned error %v", tc.equation, tc.arithmetic.Mode, err)
+			continue
+		}
+		if got := tc.arithmetic.Format(results[0]); got != tc.want {
+			t.Errorf("Run(%q) in mode %q = %s; want %s", tc.equation, tc.arithmetic.Mode, got, tc.want)
+		}
+	}
+}
+
+func TestParseMode(t *testing.T) {
+	for _, name := range []string{"", "float", "rational", "decimal"} {
+		if _, err := ParseMode(name); err != nil {
+			t.Errorf("ParseMode(%q) returned error %v", name, err)
+		}
+	}
+	if _, err := ParseMode("double"); err == nil {
+		t.Errorf("ParseMode(%q) returned no error", "double")
+	}
+}
@@ -0,0 +1,75 @@
+package agent
+
+import "encoding/json"
+
+// Options are the evaluation settings of a single expression.
+// They are stored as JSON together with the expression, so that it can be evaluated again in the same way.
+type Options struct {
+	// Rebalance turns chains of + and * into balanced trees, see Rebalance.
+	Rebalance bool `json:"rebalance,omitempty"`
+	// ImplicitMultiplication accepts expressions like 2(3+4), see ParseImplicit.
+	ImplicitMultiplication bool `json:"implicit_multiplication,omitempty"`
+	// Simplify folds the operations on numbers and applies the algebraic identities, see Simplify.
+	Simplify bool `json:"simplify,omitempty"`
+	// Mode is the numeric mode, the empty mode is FloatMode.
+	Mode Mode `json:"mode,omitempty"`
+	// Precision is the number of digits after the decimal point in DecimalMode.
+	Precision int `json:"precision,omitempty"`
+}
+
+// DefaultOptions are the options every new expression starts with.
+// The server sets them from the command line flags.
+var DefaultOptions Options
+
+// ParseOptions decodes options stored with an expression.
+// Empty or malformed options are treated as the zero Options.
+func ParseOptions(data string) Options {
+	var options Options
+	if data == "" {
+		return options
+	}
+	if err := json.Unmarshal([]byte(data), &options); err != nil {
+		return Options{}
+	}
+	return options
+}
+
+// String encodes the options as JSON.
+func (o Options) String() string {
+	data, err := json.Marshal(o)
+	if err != nil {
+		return ""
+	}
+	return string(data)
+}
+
+// Arithmetic returns the arithmetic of the numeric mode of the options.
+func (o Options) Arithmetic() Arithmetic {
+	return Arithmetic{Mode: o.Mode, Precision: o.Precision}
+}
+
+// Parse parses the equation with the grammar enabled in the options.
+func (o Options) Parse(equation string) (*Node, error) {
+	if o.ImplicitMultiplication {
+		return ParseImplicit(equation)
+	}
+	return Parse(equation)
+}
+
+// BuildTree parses the equation with the grammar of the options and applies the optimisation passes enabled in the options.
+func BuildTree(equation string, options Options) (*Node, error) {
+	root, err := options.Parse(equation)
+	if err != nil {
+		return nil, err
+	}
+	if options.Simplify {
+		root, err = Simplify(root, options.Arithmetic())
+		if err != nil {
+			return nil, err
+		}
+	}
+	if options.Rebalance {
+		root = Rebalance(root)
+	}
+	return root, nil
+}
@@ -0,0 +1,97 @@
+package agent
+
+import (
+	"DistributedCalculator/db"
+	"math"
+	"sync"
+)
+
+// Pool hands out the computers that perform the operations.
+type Pool interface {
+	// Acquire takes a free computer for the expression.
+	// It returns false if all computers are busy.
+	Acquire(equationID int) (int, bool, error)
+	// Release makes the computer free again.
+	Release(computer int) error
+	// Duration returns the time the computer spends on an operation of the given duration.
+	Duration(computer int, duration int) int
+}
+
+// computersMu guards the Computers table, so that two expressions never take the same computer.
+var computersMu sync.Mutex
+
+// dbPool is the Pool of the computers in the Computers table.
+type dbPool struct {
+	database *db.DB
+}
+
+func (p dbPool) Acquire(equationID int) (int, bool, error) {
+	computersMu.Lock()
+	defer computersMu.Unlock()
+	computer, err := p.database.GetEmptyComputer()
+	if err != nil || computer == 0 {
+		return 0, false, err
+	}
+	err = p.database.UpdateComputer(computer, equationID)
+	if err != nil {
+		return 0, false, err
+	}
+	Events.Publish(Event{Type: ComputerEvent, Computer: computer, EquationID: equationID})
+	return computer, true, nil
+}
+
+func (p dbPool) Release(computer int) error {
+	computersMu.Lock()
+	defer computersMu.Unlock()
+	err := p.database.UpdateComputer(computer, 0)
+	if err == nil {
+		Events.Publish(Event{Type: ComputerEvent, Computer: computer})
+	}
+	return err
+}
+
+// Duration returns the duration unchanged, the computers in the table are equally fast.
+func (p dbPool) Duration(_ int, duration int) int {
+	return duration
+}
+
+// MemoryPool is a Pool of computers kept in memory, used by Simulate and tests.
+// The computers are numbered from 1 and the first free one is always taken.
+type MemoryPool struct {
+	mu        sync.Mutex
+	computers []Computer
+	busy      []bool
+}
+
+// NewMemoryPool creates a pool of the given computers.
+func NewMemoryPool(computers []Computer) *MemoryPool {
+	return &MemoryPool{computers: computers, busy: make([]bool, len(computers))}
+}
+
+func (p *MemoryPool) Acquire(int) (int, bool, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for i, busy := range p.busy {
+		if !busy {
+			p.busy[i] = true
+			return i + 1, true, nil
+		}
+	}
+	return 0, false, nil
+}
+
+func (p *MemoryPool) Release(computer int) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.busy[computer-1] = false
+	return nil
+}
+
+// Duration returns the duration divided by the speed of the computer.
+func (p *MemoryPool) Duration(computer int, duration int) int {
+	speed := p.computers[computer-1].Speed
+	if speed <= 0 || speed == 1 {
+		return duration
+	}
+	return int(math.Round(float64(duration) / speed))
+}
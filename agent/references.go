@@ -0,0 +1,145 @@
+package agent
+
+import (
+	"DistributedCalculator/db"
+	"fmt"
+	"math/big"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// referencePollInterval is the time Evaluate waits before checking the referenced expressions again.
+const referencePollInterval = 100 * time.Millisecond
+
+// References returns the IDs of the expressions referenced in the tree in ascending order.
+func (n *Node) References() []int {
+	seen := make(map[int]bool)
+	var walk func(n *Node)
+	walk = func(n *Node) {
+		if n.Kind == ReferenceNode {
+			id, _ := strconv.Atoi(n.Value[1:])
+			seen[id] = true
+		}
+		for _, arg := range n.Args {
+			walk(arg)
+		}
+	}
+	walk(n)
+	ids := make([]int, 0, len(seen))
+	for id := range seen {
+		ids = append(ids, id)
+	}
+	sort.Ints(ids)
+	return ids
+}
+
+// EquationLookup returns the text and the owner of the expression, or false if there is no such expression.
+type EquationLookup func(id int) (text string, userID int, ok bool)
+
+// textReferences returns the IDs of the expressions referenced in the text.
+// Only the tokens are read, so the text may use any grammar.
+func textReferences(text string) []int {
+	tokens, _ := Tokenize(text)
+	var ids []int
+	for _, token := range tokens {
+		if token.Kind == ReferenceToken {
+			id, _ := strconv.Atoi(token.Text[1:])
+			ids = append(ids, id)
+		}
+	}
+	return ids
+}
+
+// CheckReferences checks the references of the script submitted by the user.
+// Every referenced expression must exist and belong to the user, and the references must not form a cycle.
+// Expressions of other users are reported as unknown, so their IDs are not disclosed.
+func CheckReferences(script *Script, userID int, lookup EquationLookup) error {
+	const (
+		visiting = 1
+		visited  = 2
+	)
+	state := make(map[int]int)
+	var visit func(id int, path []int) error
+	visit = func(id int, path []int) error {
+		switch state[id] {
+		case visited:
+			return nil
+		case visiting:
+			return fmt.Errorf("cyclic reference %s", referencePath(append(path, id)))
+		}
+		text, owner, ok := lookup(id)
+		if !ok || owner != userID {
+			return fmt.Errorf("unknown expression #%d", id)
+		}
+		state[id] = visiting
+		for _, ref := range textReferences(text) {
+			if err := visit(ref, append(path, id)); err != nil {
+				return err
+			}
+		}
+		state[id] = visited
+		return nil
+	}
+	for _, id := range script.References() {
+		if err := visit(id, nil); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// referencePath formats the chain of references like "#1 -> #2 -> #1".
+func referencePath(ids []int) string {
+	parts := make([]string, len(ids))
+	for i, id := range ids {
+		parts[i] = "#" + strconv.Itoa(id)
+	}
+	return strings.Join(parts, " -> ")
+}
+
+// Results holds the results of the referenced expressions by keys like "#42",
+// as the numbers of the leaves that replace the references, see referenceValue.
+type Results map[string]string
+
+// referenceValue returns the number replacing a reference to the expression with the result text,
+// parsed in the numeric mode of the referencing expression: the exact fraction in the exact modes, like "1/3",
+// and the nearest float64 otherwise. The result is used for the expressions stored without the text.
+func referenceValue(text string, result float64, arithmetic Arithmetic) string {
+	r, ok := new(big.Rat).SetString(text)
+	if !ok {
+		return strconv.FormatFloat(result, 'g', -1, 64)
+	}
+	if arithmetic.exact() {
+		return r.RatString()
+	}
+	f, _ := r.Float64()
+	return strconv.FormatFloat(f, 'g', -1, 64)
+}
+
+// waitReferences waits until the referenced expressions are computed and returns their results in the numeric mode
+// of the waiting expression. It returns an error if one of them has failed or has been cancelled,
+// and ErrCancelled if the waiting expression is cancelled.
+func waitReferences(database *db.DB, clock Clock, ids []int, arithmetic Arithmetic, cancel <-chan struct{}) (Results, error) {
+	results := make(Results, len(ids))
+	for _, id := range ids {
+		for {
+			_, status, result, _ := database.GetEquationInfo(id)
+			if status == "Computed" {
+				results["#"+strconv.Itoa(id)] = referenceValue(database.GetEquationResultText(id), result, arithmetic)
+				break
+			}
+			if status == "" || strings.HasPrefix(status, "Error") || status == CancelledStatus {
+				return nil, fmt.Errorf("expression #%d failed", id)
+			}
+			select {
+			case <-cancel:
+				return nil, ErrCancelled
+			default:
+			}
+			clock.Sleep(referencePollInterval)
+		}
+	}
+	return results, nil
+}
@@ -0,0 +1,106 @@
+package agent
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestReferences(t *testing.T) {
+	root, err := Parse("#3 + #1*#3 - max(#2, 1)")
+	if err != nil {
+		t.Fatalf("Parse returned error %v", err)
+	}
+	if got := fmt.Sprint(root.References()); got != "[1 2 3]" {
+		t.Errorf("References() = %s; want [1 2 3]", got)
+	}
+}
+
+func TestCheckReferences(t *testing.T) {
+	type equation struct {
+		text   string
+		userID int
+	}
+	equations := map[int]equation{
+		1: {"1+2", 1},
+		2: {"#1*2", 1},
+		3: {"5", 2},
+		// Cycles cannot be submitted, but they are detected in the stored expressions as well
+		4: {"#5+1", 1},
+		5: {"#4+1", 1},
+	}
+	lookup := func(id int) (string, int, bool) {
+		e, ok := equations[id]
+		return e.text, e.userID, ok
+	}
+	testCases := []struct {
+		equation string
+		err      string
+	}{
+		{"1+2", ""},
+		{"#1+#2", ""},
+		{"#3", "unknown expression #3"},
+		{"#9", "unknown expression #9"},
+		{"#4*2", "cyclic reference #4 -> #5 -> #4"},
+		{"a = #1; a + #3", "unknown expression #3"},
+	}
+
+	for _, tc := range testCases {
+		script, err := Options{}.ParseScript(tc.equation)
+		if err != nil {
+			t.Fatalf("ParseScript(%q) returned error %v", tc.equation, err)
+		}
+		err = CheckReferences(script, 1, lookup)
+		if tc.err == "" {
+			if err != nil {
+				t.Errorf("CheckReferences(%q) returned error %v", tc.equation, err)
+			}
+		} else if err == nil || err.Error() != tc.err {
+			t.Errorf("CheckReferences(%q) returned error %v; want %s", tc.equation, err, tc.err)
+		}
+	}
+}
+
+func TestReferenceValue(t *testing.T) {
+	rational := Arithmetic{Mode: RationalMode}
+	decimal := Arithmetic{Mode: DecimalMode, Precision: 2}
+	testCases := []struct {
+		text       string
+		result     float64
+		arithmetic Arithmetic
+		want       string
+	}{
+		// The exact modes keep the exact result of the referenced expression, whatever its mode
+		{"1/3", 0.3333333333333333, rational, "1/3"},
+		{"0.1", 0.1, rational, "1/10"},
+		{"-2/3", -0.6666666666666666, decimal, "-2/3"},
+		{"0.30000000000000004", 0.30000000000000004, rational, "7500000000000001/25000000000000000"},
+		// The float mode takes the nearest float64
+		{"1/3", 0.3333333333333333, Arithmetic{}, "0.3333333333333333"},
+		{"1e+21", 1e21, Arithmetic{}, "1e+21"},
+		// The expressions stored without the text give their float result
+		{"", 0.5, rational, "0.5"},
+	}
+
+	for _, tc := range testCases {
+		got := referenceValue(tc.text, tc.result, tc.arithmetic)
+		if got != tc.want {
+			t.Errorf("referenceValue(%q, %v, %s) = %s; want %s", tc.text, tc.result, tc.arithmetic.Mode, got, tc.want)
+		}
+	}
+
+	// A rational result stays exact in the referencing expression
+	script, _ := Options{}.ParseScript("#1*3")
+	roots, err := script.Link(nil, Results{"#1": referenceValue("1/3", 1.0/3, rational)})
+	if err != nil {
+		t.Fatalf("Link returned error %v", err)
+	}
+	evaluator, _ := newTestEvaluator(1, map[string]int{"*": 1})
+	evaluator.Arithmetic = rational
+	results, err := evaluator.Run(roots, []int{1})
+	if err != nil {
+		t.Fatalf("Run returned error %v", err)
+	}
+	if got := rational.Format(results[0]); got != "1" {
+		t.Errorf("#1*3 with #1 = 1/3 gives %s; want 1", got)
+	}
+}
@@ -0,0 +1,90 @@
+package agent
+
+import (
+	"errors"
+	"sort"
+	"strconv"
+)
+
+// Computer describes a computer for Simulate.
+// An operation takes its duration divided by Speed on the computer.
+type Computer struct {
+	Name  string
+	Speed float64
+}
+
+// Computers returns n identical computers named by their numbers, like in the Computers table.
+func Computers(n int) []Computer {
+	computers := make([]Computer, n)
+	for i := range computers {
+		computers[i] = Computer{Name: strconv.Itoa(i + 1), Speed: 1}
+	}
+	return computers
+}
+
+// Task is an operation of an expression tree placed on a computer.
+// Computer is the number of the computer starting from 1,
+// Start and End are in milliseconds from the beginning of the evaluation.
+type Task struct {
+	Expression int
+	Node       *Node
+	Computer   int
+	Start      int
+	End        int
+}
+
+// Schedule is the result of Simulate.
+type Schedule struct {
+	// Tasks are ordered by their start time.
+	Tasks []Task
+	// Finish holds the time every expression is computed at, in the order they were passed.
+	Finish []int
+	// Makespan is the time the last expression is computed at.
+	Makespan int
+}
+
+// Simulate runs the scheduler of the agent on the expression trees with a FakeClock and a MemoryPool,
+// so no time passes and no computers of the server are taken. The arithmetic is skipped.
+// Ready operations are placed on free computers in the order of the expressions,
+// faster computers are not preferred, a ready operation takes the first free computer.
+// It returns an error if there are operations to compute, but no computers.
+func Simulate(roots []*Node, computers []Computer, durations map[string]int) (Schedule, error) {
+	schedule := Schedule{Finish: make([]int, len(roots))}
+	operations := 0
+	for _, root := range roots {
+		operations += root.Operations()
+	}
+	if operations == 0 {
+		return schedule, nil
+	}
+	if len(computers) == 0 {
+		return schedule, errors.New("no computers")
+	}
+
+	evaluator := &Evaluator{
+		Clock: NewFakeClock(),
+		Pool:  NewMemoryPool(computers),
+		Durations: func() (map[string]int, error) {
+			return durations, nil
+		},
+		OnTask: func(task Task) {
+			schedule.Tasks = append(schedule.Tasks, task)
+			// The trees of a script share nodes, so the task may finish several trees
+			for i, root := range roots {
+				if task.Node == root {
+					schedule.Finish[i] = task.End
+				}
+			}
+			schedule.Makespan = max(schedule.Makespan, task.End)
+		},
+		dryRun: true,
+	}
+	if _, err := evaluator.Run(roots, make([]int, len(roots))); err != nil {
+		return schedule, err
+	}
+	// The tasks are reported when they finish
+	sort.SliceStable(schedule.Tasks, func(i, j int) bool {
+		return schedule.Tasks[i].Start < schedule.Tasks[j].Start
+	})
+	return schedule, nil
+}
@@ -0,0 +1,75 @@
+package agent
+
+import "testing"
+
+func TestSimulate(t *testing.T) {
+	durations := map[string]int{"+": 10, "-": 10, "*": 20, "/": 20}
+	testCases := []struct {
+		equations []string
+		computers int
+		finish    []int
+	}{
+		// The examples from the README
+		{[]string{"(1+2)+(3+4)"}, 1, []int{30}},
+		{[]string{"(1+2)+(3+4)"}, 2, []int{20}},
+		{[]string{"(1+2)+(3+4)"}, 4, []int{20}},
+		// A chain is sequential no matter how many computers there are
+		{[]string{"1+2+3+4"}, 4, []int{30}},
+		{[]string{"1", "2*3"}, 1, []int{0, 20}},
+		// Earlier expressions are computed first
+		{[]string{"1*2+3*4", "5+6"}, 1, []int{50, 60}},
+		{[]string{"1*2+3*4", "5+6"}, 2, []int{30, 30}},
+		{[]string{"1*2+3*4", "5+6"}, 3, []int{30, 10}},
+	}
+
+	for _, tc := range testCases {
+		var roots []*Node
+		for _, equation := range tc.equations {
+			root, err := Parse(equation)
+			if err != nil {
+				t.Fatalf("Parse(%q) returned error %v", equation, err)
+			}
+			roots = append(roots, root)
+		}
+		schedule, err := Simulate(roots, Computers(tc.computers), durations)
+		if err != nil {
+			t.Errorf("Simulate(%q, %d) returned error %v", tc.equations, tc.computers, err)
+			continue
+		}
+		makespan := 0
+		for i, want := range tc.finish {
+			if schedule.Finish[i] != want {
+				t.Errorf("Simulate(%q, %d) finishes %q at %d; want %d", tc.equations, tc.computers, tc.equations[i], schedule.Finish[i], want)
+			}
+			makespan = max(makespan, want)
+		}
+		if schedule.Makespan != makespan {
+			t.Errorf("Simulate(%q, %d).Makespan = %d; want %d", tc.equations, tc.computers, schedule.Makespan, makespan)
+		}
+	}
+
+	root, _ := Parse("1+2")
+	if _, err := Simulate([]*Node{root}, nil, durations); err == nil {
+		t.Errorf("Simulate without computers returned no error")
+	}
+
+	// A twice faster computer takes half of the duration
+	root, _ = Parse("(1*2)+(3*4)")
+	schedule, err := Simulate([]*Node{root}, []Computer{{Name: "fast", Speed: 2}, {Name: "slow", Speed: 0.5}}, durations)
+	if err != nil {
+		t.Fatalf("Simulate returned error %v", err)
+	}
+	want := []Task{
+		{Node: root.Args[0], Computer: 1, Start: 0, End: 10},
+		{Node: root.Args[1], Computer: 2, Start: 0, End: 40},
+		{Node: root, Computer: 1, Start: 40, End: 45},
+	}
+	if len(schedule.Tasks) != len(want) {
+		t.Fatalf("Simulate returned %d tasks; want %d", len(schedule.Tasks), len(want))
+	}
+	for i, task := range schedule.Tasks {
+		if task != want[i] {
+			t.Errorf("Simulate task %d = %+v; want %+v", i, task, want[i])
+		}
+	}
+}
@@ -0,0 +1,320 @@
+package agent
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// Statement is a statement of a script: an assignment like a = 3*4 or an expression.
+type Statement struct {
+	// Name is the assigned variable, it is empty for an expression.
+	Name string `json:"name,omitempty"`
+	Root *Node  `json:"tree"`
+}
+
+// String returns the canonical form of the statement.
+func (s Statement) String() string {
+	if s.Name == "" {
+		return s.Root.String()
+	}
+	return s.Name + "=" + s.Root.String()
+}
+
+// Script is a sequence of statements separated with semicolons, like "a = 3*4; b = a + 1; a*b".
+// An assigned variable can be used in any other statement, and the statements are evaluated in the order of their dependencies,
+// so independent statements are computed in parallel. The value of the script is the value of its last statement.
+// A single expression is a script of one statement.
+type Script struct {
+	// Statements are in the written order.
+	Statements []Statement
+}
+
+// ParseScript parses the script with the grammar enabled in the options.
+// A variable can be assigned only once, its name must not be a constant or a function,
+// and the assignments must not depend on each other in a cycle. A trailing semicolon is allowed.
+func (o Options) ParseScript(text string) (*Script, error) {
+	tokens, err := Tokenize(text)
+	if err != nil {
+		return nil, err
+	}
+	if o.ImplicitMultiplication {
+		tokens = insertMultiplication(tokens)
+	}
+	script := &Script{}
+	assigned := make(map[string]bool)
+	start := 0
+	// Semicolons in parentheses are reported by the parser of the statement
+	parenthesis := 0
+	for i := 0; i <= len(tokens); i++ {
+		if i < len(tokens) {
+			switch tokens[i].Kind {
+			case LeftParenToken:
+				parenthesis++
+			case RightParenToken:
+				parenthesis--
+			}
+			if tokens[i].Kind != SemicolonToken || parenthesis > 0 {
+				continue
+			}
+		}
+		statementTokens := tokens[start:i]
+		pos := 0
+		if start > 0 {
+			pos = tokens[start-1].Pos + 1
+		}
+		start = i + 1
+		if len(statementTokens) == 0 && i == len(tokens) && i > 0 {
+			// The trailing semicolon
+			break
+		}
+		var statement Statement
+		if len(statementTokens) >= 2 && statementTokens[0].Kind == IdentToken && statementTokens[1].Kind == AssignToken {
+			name := statementTokens[0]
+			if !ValidVariableName(name.Text) {
+				return nil, &SyntaxError{Pos: name.Pos, Msg: "cannot assign to " + name.Text}
+			}
+			if assigned[name.Text] {
+				return nil, &SyntaxError{Pos: name.Pos, Msg: name.Text + " is assigned twice"}
+			}
+			assigned[name.Text] = true
+			statement.Name = name.Text
+			pos = statementTokens[1].Pos + 1
+			statementTokens = statementTokens[2:]
+		}
+		statement.Root, err = parseTokens(statementTokens, pos)
+		if err != nil {
+			return nil, err
+		}
+		script.Statements = append(script.Statements, statement)
+	}
+	if err := script.checkCycles(); err != nil {
+		return nil, err
+	}
+	return script, nil
+}
+
+// BuildScript parses the script with the grammar of the options and applies the optimisation passes enabled in the options
+// to every statement.
+func BuildScript(text string, options Options) (*Script, error) {
+	script, err := options.ParseScript(text)
+	if err != nil {
+		return nil, err
+	}
+	for i := range script.Statements {
+		statement := &script.Statements[i]
+		if options.Simplify {
+			statement.Root, err = Simplify(statement.Root, options.Arithmetic())
+			if err != nil {
+				return nil, err
+			}
+		}
+		if options.Rebalance {
+			statement.Root = Rebalance(statement.Root)
+		}
+	}
+	return script, nil
+}
+
+// Operations returns the number of operations the script places on the computers.
+// An operation of an assigned variable is counted once.
+func (s *Script) Operations() int {
+	return uniqueOperations(s.Roots())
+}
+
+// assignments returns the statements of the assigned variables by name.
+func (s *Script) assignments() map[string]Statement {
+	statements := make(map[string]Statement)
+	for _, statement := range s.Statements {
+		if statement.Name != "" {
+			statements[statement.Name] = statement
+		}
+	}
+	return statements
+}
+
+// checkCycles returns an error if an assigned variable depends on itself, like in "a = b + 1; b = a * 2".
+func (s *Script) checkCycles() error {
+	const (
+		visiting = 1
+		visited  = 2
+	)
+	assignments := s.assignments()
+	state := make(map[string]int)
+	var visit func(name string, path []string) error
+	visit = func(name string, path []string) error {
+		switch state[name] {
+		case visited:
+			return nil
+		case visiting:
+			return fmt.Errorf("cyclic assignment %s", strings.Join(append(path, name), " -> "))
+		}
+		state[name] = visiting
+		for _, dependency := range assignments[name].Root.Variables() {
+			if _, ok := assignments[dependency]; ok {
+				if err := visit(dependency, append(path, name)); err != nil {
+					return err
+				}
+			}
+		}
+		state[name] = visited
+		return nil
+	}
+	for _, statement := range s.Statements {
+		if statement.Name != "" {
+			if err := visit(statement.Name, nil); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// String returns the canonical form of the script, the statements are separated with "; ".
+func (s *Script) String() string {
+	statements := make([]string, len(s.Statements))
+	for i, statement := range s.Statements {
+		statements[i] = statement.String()
+	}
+	return strings.Join(statements, "; ")
+}
+
+// Variables returns the names of the variables the script uses without assigning them, in alphabetical order.
+// Their values are taken from the constants and the user variables.
+func (s *Script) Variables() []string {
+	assignments := s.assignments()
+	seen := make(map[string]bool)
+	for _, statement := range s.Statements {
+		for _, name := range statement.Root.Variables() {
+			if _, ok := assignments[name]; !ok {
+				seen[name] = true
+			}
+		}
+	}
+	names := make([]string, 0, len(seen))
+	for name := range seen {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// References returns the IDs of the expressions referenced in the script in ascending order.
+func (s *Script) References() []int {
+	seen := make(map[int]bool)
+	for _, statement := range s.Statements {
+		for _, id := range statement.Root.References() {
+			seen[id] = true
+		}
+	}
+	ids := make([]int, 0, len(seen))
+	for id := range seen {
+		ids = append(ids, id)
+	}
+	sort.Ints(ids)
+	return ids
+}
+
+// Roots returns the trees of the statements with the assigned variables replaced by the trees of their statements.
+// The trees share these nodes, so the evaluator computes every statement once,
+// and a statement waits only for the statements it depends on.
+func (s *Script) Roots() []*Node {
+	roots, _ := s.link(nil, nil)
+	return roots
+}
+
+// Link returns the trees of the statements like Roots, with the other variables and the references
+// replaced by their values from the snapshot and the results, like in Substitute.
+func (s *Script) Link(snapshot Snapshot, results Results) ([]*Node, error) {
+	if snapshot == nil {
+		snapshot = Snapshot{}
+	}
+	return s.link(snapshot, results)
+}
+
+// link replaces the assigned variables in the trees of the statements.
+// The other variables and the references are substituted from the snapshot and the results unless the snapshot is nil.
+func (s *Script) link(snapshot Snapshot, results Results) ([]*Node, error) {
+	assignments := s.assignments()
+	memo := make(map[*Node]*Node)
+	var link func(n *Node) (*Node, error)
+	link = func(n *Node) (*Node, error) {
+		if linked, ok := memo[n]; ok {
+			return linked, nil
+		}
+		var linked *Node
+		var err error
+		switch {
+		case n.Kind == VariableNode && assignments[n.Value].Root != nil:
+			// The cycles are rejected by ParseScript
+			linked, err = link(assignments[n.Value].Root)
+		case n.IsLeaf():
+			linked = n
+			if snapshot != nil {
+				linked, err = Substitute(n, snapshot, results)
+			}
+		default:
+			linked = &Node{Kind: n.Kind, Op: n.Op, Args: make([]*Node, len(n.Args))}
+			for i, arg := range n.Args {
+				if linked.Args[i], err = link(arg); err != nil {
+					break
+				}
+			}
+		}
+		if err != nil {
+			return nil, err
+		}
+		memo[n] = linked
+		return linked, nil
+	}
+	roots := make([]*Node, len(s.Statements))
+	for i, statement := range s.Statements {
+		var err error
+		if roots[i], err = link(statement.Root); err != nil {
+			return nil, err
+		}
+	}
+	return roots, nil
+}
+
+// Bindings holds the values of the variables assigned in a script, as the text of their results.
+type Bindings map[string]string
+
+// ParseBindings decodes the bindings stored with an expression.
+// Empty or invalid bindings have no variables.
+func ParseBindings(data string) Bindings {
+	bindings := Bindings{}
+	if data != "" {
+		_ = json.Unmarshal([]byte(data), &bindings)
+	}
+	return bindings
+}
+
+// String encodes the bindings as JSON for the database.
+func (b Bindings) String() string {
+	if len(b) == 0 {
+		return ""
+	}
+	data, _ := json.Marshal(map[string]string(b))
+	return string(data)
+}
+
+// uniqueOperations returns the number of operations in the trees, counting the shared nodes once.
+func uniqueOperations(roots []*Node) int {
+	seen := make(map[*Node]bool)
+	var walk func(n *Node)
+	walk = func(n *Node) {
+		if n.IsLeaf() || seen[n] {
+			return
+		}
+		seen[n] = true
+		for _, arg := range n.Args {
+			walk(arg)
+		}
+	}
+	for _, root := range roots {
+		walk(root)
+	}
+	return len(seen)
+}
@@ -0,0 +1,122 @@
+package agent
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestParseScript(t *testing.T) {
+	testCases := []struct {
+		text string
+		want string
+	}{
+		{"1+2", "1+2"},
+		{"a = 3*4; b = a + 1; a*b", "a=3*4; b=a+1; a*b"},
+		{"a = 1;", "a=1"},
+		// Variables can be used before they are assigned
+		{"b = a + 1; a = 2; b", "b=a+1; a=2; b"},
+		{"x == 1; y = x >= 2", "x==1; y=x>=2"},
+	}
+
+	for _, tc := range testCases {
+		script, err := Options{}.ParseScript(tc.text)
+		if err != nil {
+			t.Errorf("ParseScript(%q) returned error %v", tc.text, err)
+			continue
+		}
+		if got := script.String(); got != tc.want {
+			t.Errorf("ParseScript(%q).String() = %q; want %q", tc.text, got, tc.want)
+		}
+	}
+
+	errorCases := []struct {
+		text string
+		err  string
+	}{
+		{"", "expected a number at position 0"},
+		{";", "expected a number at position 0"},
+		{"a = 1;; a", "expected a number at position 6"},
+		{"a = ", "expected a number at position 3"},
+		{"1 = 2", "unexpected = at position 2"},
+		{"(a = 1)", "unexpected = at position 3"},
+		{"max(1; 2)", "unexpected ; at position 5"},
+		{"pi = 3", "cannot assign to pi at position 0"},
+		{"sqrt = 3", "cannot assign to sqrt at position 0"},
+		{"a = 1; a = 2", "a is assigned twice at position 7"},
+		{"a = b + 1; b = a * 2; a", "cyclic assignment a -> b -> a"},
+		{"a = a + 1", "cyclic assignment a -> a"},
+	}
+	for _, tc := range errorCases {
+		if _, err := (Options{}).ParseScript(tc.text); err == nil || err.Error() != tc.err {
+			t.Errorf("ParseScript(%q) returned error %v; want %s", tc.text, err, tc.err)
+		}
+	}
+}
+
+func TestScriptVariables(t *testing.T) {
+	script, err := Options{}.ParseScript("total = price * n; tax = total * vat; total + tax + #2")
+	if err != nil {
+		t.Fatalf("ParseScript returned error %v", err)
+	}
+	if got := fmt.Sprint(script.Variables()); got != "[n price vat]" {
+		t.Errorf("Variables() = %s; want [n price vat]", got)
+	}
+	if got := fmt.Sprint(script.References()); got != "[2]" {
+		t.Errorf("References() = %s; want [2]", got)
+	}
+}
+
+func TestScriptEvaluation(t *testing.T) {
+	script, err := Options{}.ParseScript("a = 1+2; b = 3*4; c = a*b; c+a")
+	if err != nil {
+		t.Fatalf("ParseScript returned error %v", err)
+	}
+	roots, err := script.Link(Snapshot{}, nil)
+	if err != nil {
+		t.Fatalf("Link returned error %v", err)
+	}
+	if roots[2].Args[0] != roots[0] || roots[3].Args[1] != roots[0] {
+		t.Errorf("Link does not share the tree of a")
+	}
+
+	// The independent statements are computed in parallel, every statement is computed once
+	evaluator, tasks := newTestEvaluator(2, map[string]int{"+": 10, "*": 20})
+	results, err := evaluator.Run(roots, []int{1, 1, 1, 1})
+	if err != nil {
+		t.Fatalf("Run returned error %v", err)
+	}
+	var values []float64
+	for _, result := range results {
+		values = append(values, result.Float64())
+	}
+	if got := fmt.Sprint(values); got != "[3 12 36 39]" {
+		t.Errorf("Run = %s; want [3 12 36 39]", got)
+	}
+	want := []string{"1+2@1:0-10", "3*4@2:0-20", "(1+2)*(3*4)@1:20-40", "(1+2)*(3*4)+(1+2)@1:40-50"}
+	if got := scheduleOf(*tasks); fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("Run schedule = %v; want %v", got, want)
+	}
+
+	// The variables are taken from the snapshot
+	script, _ = Options{}.ParseScript("a = x*2; a+#1")
+	roots, err = script.Link(Snapshot{"x": 5, "#1": 1}, nil)
+	if err != nil {
+		t.Fatalf("Link returned error %v", err)
+	}
+	if got := roots[1].String(); got != "5*2+1" {
+		t.Errorf("Link = %s; want 5*2+1", got)
+	}
+	if _, err := script.Link(Snapshot{}, nil); err == nil || err.Error() != "unknown variable x" {
+		t.Errorf("Link returned error %v; want unknown variable x", err)
+	}
+}
+
+func TestBindings(t *testing.T) {
+	bindings := Bindings{"a": "12", "b": "1/3"}
+	if got := ParseBindings(bindings.String()); fmt.Sprint(got) != fmt.Sprint(bindings) {
+		t.Errorf("ParseBindings(%q) = %v; want %v", bindings.String(), got, bindings)
+	}
+	if got := (Bindings{}).String(); got != "" {
+		t.Errorf("Bindings{}.String() = %q; want empty", got)
+	}
+}
@@ -0,0 +1,224 @@
+package agent
+
+import (
+	"math"
+	"math/big"
+	"strconv"
+)
+
+// maxFoldedDecimals limits the digits after the decimal point of a folded exact result.
+// Fractions like 1/3 have no finite decimal form and are left to the computers.
+const maxFoldedDecimals = 64
+
+// Simplify rewrites the tree into an equivalent one with fewer operations.
+// It works on the tree before the variables are substituted:
+//   - operations on numbers only are computed at once in the numeric mode of the arithmetic, so they need no computers;
+//     if(c, a, b) with a known condition becomes the chosen branch
+//   - x+0, x-0, x*1, x/1, x^1 and +x become x, -(-x) becomes x, x^0 becomes 1
+//   - x*0 and x-x, like (a+b)-(a+b), become 0
+//
+// An operand is only dropped if it cannot fail, so 0*(1/0) and 0*sqrt(x) are not rewritten.
+// An operation on numbers that fails returns its error, so an expression that would fail on the computers fails at once,
+// unless it is in a branch of if(c, a, b) with an unknown condition, which is kept as it is.
+func Simplify(n *Node, arithmetic Arithmetic) (*Node, error) {
+	if n.IsLeaf() {
+		return n, nil
+	}
+	args := make([]*Node, len(n.Args))
+	for i, arg := range n.Args {
+		var err error
+		if n.conditional() && i > 0 && isNumber(args[0]) {
+			// The branch that is not chosen is never computed, so its errors do not count
+			args[i] = arg
+			continue
+		}
+		if n.conditional() && i > 0 {
+			// The condition is unknown until the expression is computed, so a branch that fails
+			// is left to the computers and fails only if it is chosen
+			if args[i], err = Simplify(arg, arithmetic); err != nil {
+				args[i] = arg
+			}
+			continue
+		}
+		if args[i], err = Simplify(arg, arithmetic); err != nil {
+			return nil, err
+		}
+	}
+	n = &Node{Kind: n.Kind, Op: n.Op, Args: args}
+
+	if n.conditional() && isNumber(args[0]) {
+		condition, err := arithmetic.Parse(args[0].Value)
+		if err != nil {
+			return nil, err
+		}
+		if condition.IsZero() {
+			return Simplify(args[2], arithmetic)
+		}
+		return Simplify(args[1], arithmetic)
+	}
+	if allNumbers(args) {
+		return fold(n, arithmetic)
+	}
+	return identity(n), nil
+}
+
+// isNumber reports whether the node is a number leaf.
+func isNumber(n *Node) bool {
+	return n.Kind == NumberNode
+}
+
+// allNumbers reports whether all of the nodes are number leaves.
+func allNumbers(nodes []*Node) bool {
+	for _, n := range nodes {
+		if !isNumber(n) {
+			return false
+		}
+	}
+	return true
+}
+
+// fold computes the operation on numbers and returns the leaf of its result.
+// The operation is kept if its result has no exact decimal form, like 1/3 in the rational mode or an infinity.
+func fold(n *Node, arithmetic Arithmetic) (*Node, error) {
+	args := make([]Value, len(n.Args))
+	for i, arg := range n.Args {
+		var err error
+		if args[i], err = arithmetic.Parse(arg.Value); err != nil {
+			return nil, err
+		}
+	}
+	if err := arithmetic.check(n, args); err != nil {
+		return nil, err
+	}
+	result, err := arithmetic.apply(n, args)
+	if err != nil {
+		return nil, err
+	}
+	var text string
+	if result.rat == nil {
+		if math.IsInf(result.float, 0) || math.IsNaN(result.float) {
+			return n, nil
+		}
+		text = strconv.FormatFloat(result.float, 'g', -1, 64)
+	} else {
+		var ok bool
+		if text, ok = decimalText(result.rat); !ok {
+			return n, nil
+		}
+	}
+	return &Node{Value: text}, nil
+}
+
+// decimalText returns the shortest decimal form of the fraction, or false if it has none.
+func decimalText(r *big.Rat) (string, bool) {
+	for decimals := 0; decimals <= maxFoldedDecimals; decimals++ {
+		text := r.FloatString(decimals)
+		if exact, _ := new(big.Rat).SetString(text); exact.Cmp(r) == 0 {
+			return text, true
+		}
+	}
+	return "", false
+}
+
+// identity applies the algebraic identities to the operation whose operands are already simplified.
+func identity(n *Node) *Node {
+	zero := &Node{Value: "0"}
+	if n.Kind == UnaryNode {
+		operand := n.Args[0]
+		switch {
+		case n.Op == "+":
+			return operand
+		case n.Op == "-" && operand.Kind == UnaryNode && operand.Op == "-":
+			return operand.Args[0]
+		}
+		return n
+	}
+	if n.Kind != BinaryNode {
+		return n
+	}
+	left, right := n.Args[0], n.Args[1]
+	switch n.Op {
+	case "+":
+		if isValue(left, 0) {
+			return right
+		}
+		if isValue(right, 0) {
+			return left
+		}
+	case "-":
+		if isValue(right, 0) {
+			return left
+		}
+		if left.String() == right.String() && safe(left) {
+			return zero
+		}
+	case "*":
+		if isValue(left, 1) {
+			return right
+		}
+		if isValue(right, 1) {
+			return left
+		}
+		if (isValue(left, 0) && safe(right)) || (isValue(right, 0) && safe(left)) {
+			return zero
+		}
+	case "/":
+		if isValue(right, 1) {
+			return left
+		}
+	case "^":
+		if isValue(right, 1) {
+			return left
+		}
+		if isValue(right, 0) && safe(left) {
+			return &Node{Value: "1"}
+		}
+	}
+	return n
+}
+
+// isValue reports whether the node is a number leaf equal to the value.
+func isValue(n *Node, value float64) bool {
+	if !isNumber(n) {
+		return false
+	}
+	number, err := strconv.ParseFloat(n.Value, 64)
+	return err == nil && number == value
+}
+
+// safe reports whether the tree cannot fail, so that it can be dropped without hiding an error.
+// The variables are numbers, operations that fail on some numbers, like / and sqrt, are not safe.
+// The references are not safe, as the referenced expression may fail.
+// The operations on numbers only that remain after folding are not safe either, as they could not be folded.
+func safe(n *Node) bool {
+	if n.IsLeaf() {
+		return n.Kind != ReferenceNode
+	}
+	if allNumbers(n.Args) {
+		return false
+	}
+	switch n.Kind {
+	case UnaryNode:
+	case BinaryNode:
+		switch n.Op {
+		case "/", "//", "%", "^":
+			return false
+		}
+	case CallNode:
+		switch n.Op {
+		case "abs", "min", "max", "if":
+		case "round":
+			if len(n.Args) != 1 {
+				return false
+			}
+		default:
+			return false
+		}
+	}
+	for _, arg := range n.Args {
+		if !safe(arg) {
+			return false
+		}
+	}
+	return true
+}
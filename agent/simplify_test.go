@@ -0,0 +1,117 @@
+package agent
+
+import "testing"
+
+func TestSimplify(t *testing.T) {
+	testCases := []struct {
+		equation   string
+		arithmetic Arithmetic
+		want       string
+	}{
+		{"1+2*3", Arithmetic{}, "7"},
+		{"x*1 + (2+3)*y - 0", Arithmetic{}, "x+5*y"},
+		{"0*(x+y)", Arithmetic{}, "0"},
+		{"(a+b)-(a+b)", Arithmetic{}, "0"},
+		{"-(-x)^1", Arithmetic{}, "x"},
+		{"+x/1", Arithmetic{}, "x"},
+		{"(x*y)^0", Arithmetic{}, "1"},
+		{"max(2^10, x) + sqrt(16)", Arithmetic{}, "max(1024,x)+4"},
+		{"if(1 > 2, 1/0, x)", Arithmetic{}, "x"},
+		{"if(x, 1+1, 2*2)", Arithmetic{}, "if(x,2,4)"},
+		{"0.1+0.2", Arithmetic{}, "0.30000000000000004"},
+		{"0.1+0.2", Arithmetic{Mode: RationalMode}, "0.3"},
+		// Results without a finite decimal form are left to the computers
+		{"1/3 + x", Arithmetic{Mode: RationalMode}, "1/3+x"},
+		{"1/3 + x", Arithmetic{Mode: DecimalMode, Precision: 4}, "0.3333+x"},
+		{"10^400 * x", Arithmetic{}, "10^400*x"},
+		// Operands that may fail are kept
+		{"0*(1/x)", Arithmetic{}, "0*(1/x)"},
+		{"0*sqrt(x)", Arithmetic{}, "0*sqrt(x)"},
+		{"0*#1", Arithmetic{}, "0*#1"},
+		{"sqrt(x) - sqrt(x)", Arithmetic{}, "sqrt(x)-sqrt(x)"},
+		{"0*10^400", Arithmetic{}, "0*10^400"},
+		// A failing branch of an if with an unknown condition may never be chosen
+		{"if(x, 1, 1/0)", Arithmetic{}, "if(x,1,1/0)"},
+		{"if(x > 1, 2*3, sqrt(-1) + 1)", Arithmetic{Mode: RationalMode}, "if(x>1,6,sqrt(-1)+1)"},
+	}
+
+	for _, tc := range testCases {
+		root, err := Parse(tc.equation)
+		if err != nil {
+			t.Fatalf("Parse(%q) returned error %v", tc.equation, err)
+		}
+		simplified, err := Simplify(root, tc.arithmetic)
+		if err != nil {
+			t.Errorf("Simplify(%q) returned error %v", tc.equation, err)
+			continue
+		}
+		if got := simplified.String(); got != tc.want {
+			t.Errorf("Simplify(%q) = %q; want %q", tc.equation, got, tc.want)
+		}
+	}
+
+	// Division by zero is not masked
+	for _, equation := range []string{"0*(1/0)", "x*0 + 1//(2-2)", "if(1, sqrt(-1), 0)"} {
+		root, _ := Parse(equation)
+		if _, err := Simplify(root, Arithmetic{}); err == nil {
+			t.Errorf("Simplify(%q) returned no error", equation)
+		}
+	}
+}
+
+func TestBuildScriptSimplify(t *testing.T) {
+	options := Options{Simplify: true}
+	script, err := options.ParseScript("a = 2*3*x; b = a*1; b + 0*a")
+	if err != nil {
+		t.Fatalf("ParseScript returned error %v", err)
+	}
+	simplified, err := BuildScript("a = 2*3*x; b = a*1; b + 0*a", options)
+	if err != nil {
+		t.Fatalf("BuildScript returned error %v", err)
+	}
+	if got := simplified.String(); got != "a=6*x; b=a; b" {
+		t.Errorf("BuildScript = %q; want %q", got, "a=6*x; b=a; b")
+	}
+	if saved := script.Operations() - simplified.Operations(); saved != 4 {
+		t.Errorf("saved %d operations; want 4", saved)
+	}
+}
+
+func TestSimplifyLazyIf(t *testing.T) {
+	// The failing branch is not chosen for x = 2, so the simplified expression still computes
+	options := Options{Simplify: true}
+	script, err := BuildScript("if(x, 1, 1/0)", options)
+	if err != nil {
+		t.Fatalf("BuildScript returned error %v", err)
+	}
+	testCases := []struct {
+		x    float64
+		want string
+		err  string
+	}{
+		{2, "1", ""},
+		{0, "", "division by zero"},
+	}
+
+	for _, tc := range testCases {
+		roots, err := script.Link(Snapshot{"x": tc.x}, nil)
+		if err != nil {
+			t.Fatalf("Link returned error %v", err)
+		}
+		evaluator, _ := newTestEvaluator(1, map[string]int{})
+		results, err := evaluator.Run(roots, []int{1})
+		if tc.err != "" {
+			if err == nil || err.Error() != tc.err {
+				t.Errorf("Run with x = %v returned error %v; want %s", tc.x, err, tc.err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("Run with x = %v returned error %v", tc.x, err)
+			continue
+		}
+		if got := evaluator.Arithmetic.Format(results[len(results)-1]); got != tc.want {
+			t.Errorf("Run with x = %v = %s; want %s", tc.x, got, tc.want)
+		}
+	}
+}
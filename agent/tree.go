@@ -0,0 +1,430 @@
+package agent
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// NodeKind is the kind of a node of the expression tree.
+type NodeKind int
+
+const (
+	NumberNode NodeKind = iota
+	UnaryNode
+	BinaryNode
+	CallNode
+	VariableNode
+	ReferenceNode
+)
+
+// Node is a node of the expression tree.
+// A leaf holds a number, the name of a variable or a reference like #42 in Value, an inner node holds an operator or a function name in Op
+// and its operands in Args: one for a unary operator, two for a binary one and any number for a function.
+// Comparisons and logical operators give 1 for true and 0 for false, any non-zero operand is true.
+type Node struct {
+	Kind  NodeKind
+	Op    string
+	Value string
+	Args  []*Node
+}
+
+// nodeKinds are the names of the node kinds in JSON.
+var nodeKinds = map[NodeKind]string{
+	NumberNode:    "number",
+	UnaryNode:     "unary",
+	BinaryNode:    "binary",
+	CallNode:      "call",
+	VariableNode:  "variable",
+	ReferenceNode: "reference",
+}
+
+// MarshalJSON encodes the tree like {"kind":"binary","op":"+","args":[{"kind":"number","value":"1"},{"kind":"number","value":"2"}]}.
+func (n *Node) MarshalJSON() ([]byte, error) {
+	return json.Marshal(struct {
+		Kind  string  `json:"kind"`
+		Op    string  `json:"op,omitempty"`
+		Value string  `json:"value,omitempty"`
+		Args  []*Node `json:"args,omitempty"`
+	}{nodeKinds[n.Kind], n.Op, n.Value, n.Args})
+}
+
+// IsLeaf reports whether the node is a number, a variable or a reference.
+func (n *Node) IsLeaf() bool {
+	return n.Kind == NumberNode || n.Kind == VariableNode || n.Kind == ReferenceNode
+}
+
+// OperationType returns the type of the operation in the Operations table.
+// Unary operators have their own types "neg", "pos" and "not", binary operators and functions are named by themselves.
+func (n *Node) OperationType() string {
+	if n.Kind == UnaryNode {
+		switch n.Op {
+		case "-":
+			return "neg"
+		case "!":
+			return "not"
+		}
+		return "pos"
+	}
+	return n.Op
+}
+
+// conditional reports whether the node is a call of if, whose branches are evaluated lazily.
+func (n *Node) conditional() bool {
+	return n.Kind == CallNode && n.Op == "if"
+}
+
+// binaryNode creates the node of a binary operation.
+func binaryNode(op string, left, right *Node) *Node {
+	return &Node{Kind: BinaryNode, Op: op, Args: []*Node{left, right}}
+}
+
+// Parse builds the expression tree of the equation.
+// It splits the equation at the operation returned by LastOperation and parses both parts recursively,
+// so the tree is evaluated in the same order as the equation itself.
+// For example, "1+2+3" becomes ((1+2)+3).
+// An invalid equation is reported with a *SyntaxError.
+func Parse(equation string) (*Node, error) {
+	tokens, err := Tokenize(equation)
+	if err != nil {
+		return nil, err
+	}
+	return parseTokens(tokens, 0)
+}
+
+// ParseImplicit builds the expression tree like Parse, but also accepts implicit multiplication:
+// 2(3+4), (1+2)(3+4), 2pi and 2sqrt(2) are read as 2*(3+4), (1+2)*(3+4), 2*pi and 2*sqrt(2).
+// The inserted * has the same priority as the written one, so 1/2(3) is 1/2*3.
+func ParseImplicit(equation string) (*Node, error) {
+	tokens, err := Tokenize(equation)
+	if err != nil {
+		return nil, err
+	}
+	return parseTokens(insertMultiplication(tokens), 0)
+}
+
+// insertMultiplication inserts * between an operand and the operand following it.
+// Two numbers in a row are not multiplied, as they are more likely a typo.
+func insertMultiplication(tokens []Token) []Token {
+	result := make([]Token, 0, len(tokens))
+	for i, token := range tokens {
+		if i > 0 && operandEnd(tokens[i-1].Kind) && operandStart(token.Kind) {
+			call := tokens[i-1].Kind == IdentToken && token.Kind == LeftParenToken
+			numbers := tokens[i-1].Kind == NumberToken && token.Kind == NumberToken
+			if !call && !numbers {
+				result = append(result, Token{Kind: OperatorToken, Text: "*", Pos: token.Pos})
+			}
+		}
+		result = append(result, token)
+	}
+	return result
+}
+
+// operandStart reports whether a token of the kind can start an operand.
+func operandStart(kind TokenKind) bool {
+	return kind == NumberToken || kind == LeftParenToken || kind == IdentToken || kind == ReferenceToken
+}
+
+// parseTokens builds the tree of the tokens.
+// pos is the position of the tokens in the equation, it is used for errors when there are no tokens.
+func parseTokens(tokens []Token, pos int) (*Node, error) {
+	// Remove unnecessary outer parentheses
+	for len(tokens) >= 2 && tokens[0].Kind == LeftParenToken && closingParen(tokens) == len(tokens)-1 {
+		pos = tokens[0].Pos + 1
+		tokens = tokens[1 : len(tokens)-1]
+	}
+	if len(tokens) == 0 {
+		return nil, &SyntaxError{Pos: pos, Msg: "expected a number"}
+	}
+	lastOperator, err := lastOperatorToken(tokens)
+	if err != nil {
+		return nil, err
+	}
+	if lastOperator == -1 {
+		return parseOperand(tokens)
+	}
+	operator := tokens[lastOperator]
+	left, err := parseTokens(tokens[:lastOperator], tokens[0].Pos)
+	if err != nil {
+		return nil, err
+	}
+	right, err := parseTokens(tokens[lastOperator+1:], operator.Pos+len(operator.Text))
+	if err != nil {
+		return nil, err
+	}
+	return binaryNode(operator.Text, left, right), nil
+}
+
+// parseOperand builds the tree of tokens without binary operators: a number or a unary operation.
+// A sign directly before a number is a part of the number, so "-1" and "-(1)" are leaves,
+// while "-(1+2)", "-2^2", "--1" and "!1" are unary operations computed like any other operation.
+func parseOperand(tokens []Token) (*Node, error) {
+	if tokens[0].Kind == OperatorToken && (tokens[0].Text == "-" || tokens[0].Text == "+" || tokens[0].Text == "!") {
+		sign := tokens[0]
+		operand, err := parseTokens(tokens[1:], sign.Pos+1)
+		if err != nil {
+			return nil, err
+		}
+		if sign.Text != "!" && operand.Kind == NumberNode && !operand.signed() {
+			if sign.Text == "-" {
+				operand.Value = "-" + operand.Value
+			}
+			return operand, nil
+		}
+		return &Node{Kind: UnaryNode, Op: sign.Text, Args: []*Node{operand}}, nil
+	}
+	return parseNumber(tokens)
+}
+
+// parseNumber builds the leaf of a number, a variable or a reference, or the node of a function call.
+func parseNumber(tokens []Token) (*Node, error) {
+	switch tokens[0].Kind {
+	case ReferenceToken:
+		if len(tokens) > 1 {
+			return nil, &SyntaxError{Pos: tokens[1].Pos, Msg: "expected an operator"}
+		}
+		return &Node{Kind: ReferenceNode, Value: tokens[0].Text}, nil
+	case IdentToken:
+		if len(tokens) > 1 && tokens[1].Kind == LeftParenToken {
+			return parseCall(tokens)
+		}
+		name := tokens[0]
+		if _, ok := Functions[name.Text]; ok {
+			return nil, &SyntaxError{Pos: name.Pos + len(name.Text), Msg: "expected ( after " + name.Text}
+		}
+		if len(tokens) > 1 {
+			return nil, &SyntaxError{Pos: tokens[1].Pos, Msg: "expected an operator"}
+		}
+		return &Node{Kind: VariableNode, Value: name.Text}, nil
+	case OperatorToken:
+		return nil, &SyntaxError{Pos: tokens[0].Pos, Msg: "unexpected operator " + tokens[0].Text}
+	case NumberToken:
+		if len(tokens) > 1 {
+			return nil, &SyntaxError{Pos: tokens[1].Pos, Msg: "expected an operator"}
+		}
+		if _, err := strconv.ParseFloat(tokens[0].Text, 64); err != nil {
+			return nil, &SyntaxError{Pos: tokens[0].Pos, Msg: "invalid number " + tokens[0].Text}
+		}
+		return &Node{Value: tokens[0].Text}, nil
+	case LeftParenToken:
+		if end := closingParen(tokens); end != len(tokens)-1 {
+			return nil, &SyntaxError{Pos: tokens[end+1].Pos, Msg: "expected an operator"}
+		}
+		return nil, &SyntaxError{Pos: tokens[0].Pos, Msg: "expected a number"}
+	}
+	return nil, &SyntaxError{Pos: tokens[0].Pos, Msg: "unexpected )"}
+}
+
+// parseCall builds the node of a function call like max(1,2+3).
+func parseCall(tokens []Token) (*Node, error) {
+	name := tokens[0]
+	function, ok := Functions[name.Text]
+	if !ok {
+		return nil, &SyntaxError{Pos: name.Pos, Msg: "unknown function " + name.Text}
+	}
+	end := closingParen(tokens[1:]) + 1
+	if end == 0 {
+		return nil, &SyntaxError{Pos: tokens[1].Pos, Msg: "unclosed ("}
+	}
+	if end != len(tokens)-1 {
+		return nil, &SyntaxError{Pos: tokens[end+1].Pos, Msg: "expected an operator"}
+	}
+	// Split the arguments at the commas outside of nested parentheses
+	var args []*Node
+	parenthesis := 0
+	start := 2
+	for i := 2; i <= end; i++ {
+		switch tokens[i].Kind {
+		case LeftParenToken:
+			parenthesis++
+			continue
+		case RightParenToken:
+			parenthesis--
+			if i != end {
+				continue
+			}
+		case CommaToken:
+			if parenthesis != 0 {
+				continue
+			}
+		default:
+			continue
+		}
+		if i == 2 && i == end {
+			// No arguments
+			break
+		}
+		arg, err := parseTokens(tokens[start:i], tokens[i-1].Pos+len(tokens[i-1].Text))
+		if err != nil {
+			return nil, err
+		}
+		args = append(args, arg)
+		start = i + 1
+	}
+	if len(args) < function.MinArgs || (function.MaxArgs >= 0 && len(args) > function.MaxArgs) {
+		return nil, &SyntaxError{Pos: name.Pos, Msg: fmt.Sprintf("wrong number of arguments of %s: %d", name.Text, len(args))}
+	}
+	return &Node{Kind: CallNode, Op: name.Text, Args: args}, nil
+}
+
+// closingParen returns the index of the parenthesis closing the one the tokens start with, or -1.
+func closingParen(tokens []Token) int {
+	parenthesis := 0
+	for i, token := range tokens {
+		if token.Kind == LeftParenToken {
+			parenthesis++
+		} else if token.Kind == RightParenToken {
+			parenthesis--
+			if parenthesis == 0 {
+				return i
+			}
+		}
+	}
+	return -1
+}
+
+// String returns the canonical form of the expression with only the necessary parentheses.
+func (n *Node) String() string {
+	switch n.Kind {
+	case NumberNode, VariableNode, ReferenceNode:
+		return n.Value
+	case CallNode:
+		args := make([]string, len(n.Args))
+		for i, arg := range n.Args {
+			args[i] = arg.String()
+		}
+		return n.Op + "(" + strings.Join(args, ",") + ")"
+	case UnaryNode:
+		// A sign applies to the operand only, so operations and other signs are put in parentheses
+		operand := n.Args[0].String()
+		if n.Args[0].Kind == BinaryNode || n.Args[0].signed() {
+			operand = "(" + operand + ")"
+		}
+		return n.Op + operand
+	}
+	left, right := n.Args[0], n.Args[1]
+	leftStr := left.String()
+	if left.Kind == BinaryNode {
+		// The left operand of a right associative operation keeps its parentheses with the same priority
+		leftPriority := priority(left.Op)
+		if leftPriority < priority(n.Op) || (leftPriority == priority(n.Op) && rightAssociative(n.Op)) {
+			leftStr = "(" + leftStr + ")"
+		}
+	} else if rightAssociative(n.Op) && (left.signed() || left.Kind == UnaryNode) {
+		leftStr = "(" + leftStr + ")"
+	}
+	rightStr := right.String()
+	if right.Kind == BinaryNode {
+		// Other operations are evaluated from left to right,
+		// so the right operand keeps its parentheses even with the same priority
+		rightPriority := priority(right.Op)
+		if rightPriority < priority(n.Op) || (rightPriority == priority(n.Op) && !rightAssociative(n.Op)) {
+			rightStr = "(" + rightStr + ")"
+		}
+	} else if right.signed() {
+		rightStr = "(" + rightStr + ")"
+	}
+	return leftStr + n.Op + rightStr
+}
+
+// signed reports whether the node is written with a leading sign.
+// The ! is not a sign, as it cannot be confused with a binary operator.
+func (n *Node) signed() bool {
+	return (n.Kind == UnaryNode && n.Op != "!") || (n.Kind == NumberNode && (n.Value[0] == '-' || n.Value[0] == '+'))
+}
+
+// Operations returns the number of operations in the tree.
+func (n *Node) Operations() int {
+	if n.IsLeaf() {
+		return 0
+	}
+	operations := 1
+	for _, arg := range n.Args {
+		operations += arg.Operations()
+	}
+	return operations
+}
+
+// Depth returns the number of operations on the longest path from the root to a leaf.
+// It is the number of sequential steps needed to evaluate the tree with unlimited computers.
+func (n *Node) Depth() int {
+	if n.IsLeaf() {
+		return 0
+	}
+	if n.conditional() {
+		// Only one of the branches is computed, after the condition
+		return 1 + n.Args[0].Depth() + max(n.Args[1].Depth(), n.Args[2].Depth())
+	}
+	depth := 0
+	for _, arg := range n.Args {
+		depth = max(depth, arg.Depth())
+	}
+	return 1 + depth
+}
+
+// CriticalPath returns the duration of the longest chain of dependent operations in milliseconds,
+// using the given duration of every operation type.
+func (n *Node) CriticalPath(durations map[string]int) int {
+	if n.IsLeaf() {
+		return 0
+	}
+	if n.conditional() {
+		branch := max(n.Args[1].CriticalPath(durations), n.Args[2].CriticalPath(durations))
+		return durations[n.OperationType()] + n.Args[0].CriticalPath(durations) + branch
+	}
+	path := 0
+	for _, arg := range n.Args {
+		path = max(path, arg.CriticalPath(durations))
+	}
+	return durations[n.OperationType()] + path
+}
+
+// Rebalance rebuilds chains of + and * into balanced trees.
+// The chain 1+2+3+4 is parsed as (((1+2)+3)+4) and needs 3 sequential steps,
+// while the balanced (1+2)+(3+4) needs only 2 when there are enough computers.
+// The order of the operands is kept, so the result is the same up to floating-point reassociation.
+func Rebalance(n *Node) *Node {
+	if n.IsLeaf() {
+		return n
+	}
+	if n.Kind != BinaryNode || (n.Op != "+" && n.Op != "*") {
+		args := make([]*Node, len(n.Args))
+		for i, arg := range n.Args {
+			args[i] = Rebalance(arg)
+		}
+		return &Node{Kind: n.Kind, Op: n.Op, Args: args}
+	}
+	operands := chainOperands(n, n.Op, nil)
+	for i := range operands {
+		operands[i] = Rebalance(operands[i])
+	}
+	return balancedChain(n.Op, operands)
+}
+
+// chainOperands collects the operands of the chain of op operations starting at n.
+func chainOperands(n *Node, op string, operands []*Node) []*Node {
+	if n.Kind != BinaryNode || n.Op != op {
+		return append(operands, n)
+	}
+	operands = chainOperands(n.Args[0], op, operands)
+	return chainOperands(n.Args[1], op, operands)
+}
+
+// balancedChain joins the operands with op.
+// It repeatedly joins the two neighbouring operands with the smallest depth,
+// so that deep operands are computed in parallel with the rest of the chain.
+func balancedChain(op string, operands []*Node) *Node {
+	for len(operands) > 1 {
+		best := 0
+		for i := 1; i < len(operands)-1; i++ {
+			if max(operands[i].Depth(), operands[i+1].Depth()) < max(operands[best].Depth(), operands[best+1].Depth()) {
+				best = i
+			}
+		}
+		joined := binaryNode(op, operands[best], operands[best+1])
+		operands = append(operands[:best+1], operands[best+2:]...)
+		operands[best] = joined
+	}
+	return operands[0]
+}
@@ -0,0 +1,173 @@
+package agent
+
+import "testing"
+
+func TestParse(t *testing.T) {
+	testCases := []struct {
+		equation string
+		want     string
+		depth    int
+	}{
+		{"1", "1", 0},
+		{"-1", "-1", 0},
+		{"((1 + 2))", "1+2", 1},
+		{"1+2+3", "1+2+3", 2},
+		{"1-(2-3)", "1-(2-3)", 2},
+		{"1+(2+3)", "1+(2+3)", 2},
+		{"(1-2)-3", "1-2-3", 2},
+		{"2*(-1)", "2*(-1)", 1},
+		{"(1+2)*(3+4)", "(1+2)*(3+4)", 2},
+		{"1,5/(2*3)", "1.5/(2*3)", 2},
+		{"2^3^2", "2^3^2", 2},
+		{"(2^3)^2", "(2^3)^2", 2},
+		{"2*3^2+1", "2*3^2+1", 3},
+		{"(-2)^2", "(-2)^2", 1},
+		{"7 // 2 % 3", "7//2%3", 2},
+		{"7 // (2 % 3)", "7//(2%3)", 2},
+		// A sign before a number is a part of the number, other signs are unary operations
+		{"1+-2", "1+(-2)", 1},
+		{"2--3", "2-(-3)", 1},
+		{"-(1+2)", "-(1+2)", 2},
+		{"--1", "-(-1)", 1},
+		{"-(-(1+2))", "-(-(1+2))", 3},
+		{"+-+1", "+(-1)", 1},
+		{"2*-(3)", "2*(-3)", 1},
+		{"2^-(1+1)", "2^(-(1+1))", 3},
+		// A leading sign binds looser than ^
+		{"-(2)^2", "-(2^2)", 2},
+		{"-(1+2)^2", "-((1+2)^2)", 3},
+		{"-2^2", "-(2^2)", 2},
+		{"-x^2", "-(x^2)", 2},
+		{"(-2)^2", "(-2)^2", 1},
+		{"(!x)^2", "(!x)^2", 2},
+		{"2^-3^2", "2^(-(3^2))", 3},
+		// Function calls are operations with any number of arguments
+		{"sqrt(2)*max(3,4,5)", "sqrt(2)*max(3,4,5)", 2},
+		{"max(1+2, (3), -4)", "max(1+2,3,-4)", 2},
+		{"-abs(round(1,5))", "-abs(round(1,5))", 3},
+		{"log(8, 2)^2", "log(8,2)^2", 2},
+		// Names that are not functions are variables
+		{"price * (1 + vat)", "price*(1+vat)", 2},
+		{"-pi", "-pi", 1},
+		{"2*pi^x1", "2*pi^x1", 2},
+		// References to other expressions are leaves
+		{"#42 * 2", "#42*2", 1},
+		{"-#1", "-#1", 1},
+		// Comparisons bind weaker than arithmetic, && binds tighter than ||
+		{"1+2 < 3*4", "1+2<3*4", 2},
+		{"a < b == (c < d)", "a<b==(c<d)", 2},
+		{"x > 0 && y > 0 || z", "x>0&&y>0||z", 3},
+		{"x || y && z", "x||y&&z", 2},
+		{"(x || y) && z", "(x||y)&&z", 2},
+		{"!x && !(y < 1)", "!x&&!(y<1)", 3},
+		{"!!1", "!!1", 2},
+		{"-!1", "-!1", 2},
+		{"!-1", "!(-1)", 1},
+		// The condition is computed before the chosen branch
+		{"if(x >= 10, x*0.1, 0)", "if(x>=10,x*0.1,0)", 3},
+		{"if(a, 1, if(b, 2, 3))", "if(a,1,if(b,2,3))", 2},
+		// Numbers keep their exponents, other forms become decimal
+		{"1e-9+2.5E3", "1e-9+2.5E3", 1},
+		{"0xFF*0b11", "255*3", 1},
+		{"1_000-(-1e+3)", "1000-(-1e+3)", 1},
+	}
+
+	for _, tc := range testCases {
+		root, err := Parse(tc.equation)
+		if err != nil {
+			t.Errorf("Parse(%q) returned error %v", tc.equation, err)
+			continue
+		}
+		if got := root.String(); got != tc.want {
+			t.Errorf("Parse(%q).String() = %q; want %q", tc.equation, got, tc.want)
+		}
+		if got := root.Depth(); got != tc.depth {
+			t.Errorf("Parse(%q).Depth() = %d; want %d", tc.equation, got, tc.depth)
+		}
+	}
+
+	for _, equation := range []string{"", "()", "1+$", "1..2", "1+*2", "-", "2*-", "foo(1)", "sqrt", "sqrt 2", "sqrt()", "sqrt(1,2)", "max(1,)", "max(1)(2)", "x y", "x(1)", "#", "#x", "#1 2", "(1+2", "1+2)", "2(3)", "1 ! 2", "1 <", "< 1", "1 = 2", "1 & 2", "if(1,2)", "if"} {
+		if _, err := Parse(equation); err == nil {
+			t.Errorf("Parse(%q) returned no error", equation)
+		}
+	}
+}
+
+func TestRebalance(t *testing.T) {
+	durations := map[string]int{"+": 10, "-": 10, "*": 20, "/": 20}
+	testCases := []struct {
+		equation     string
+		want         string
+		depth        int
+		criticalPath int
+	}{
+		{"1+2+3+4+5+6+7+8", "1+2+(3+4)+(5+6+(7+8))", 3, 30},
+		{"1*2*3*4", "1*2*(3*4)", 2, 40},
+		// Chains are only built from the same operator
+		{"1+2*3*4*5+6", "1+2*3*(4*5)+6", 4, 60},
+		{"1-2-3-4", "1-2-3-4", 3, 30},
+		{"(1+2+3+4)-(5+6+7+8)", "1+2+(3+4)-(5+6+(7+8))", 3, 30},
+		// Deep operands are computed in parallel with the rest of the chain
+		{"(1-2-3-4)+5+6+7+8", "1-2-3-4+(5+6+(7+8))", 4, 40},
+	}
+
+	for _, tc := range testCases {
+		root, err := Parse(tc.equation)
+		if err != nil {
+			t.Fatalf("Parse(%q) returned error %v", tc.equation, err)
+		}
+		balanced := Rebalance(root)
+		if got := balanced.String(); got != tc.want {
+			t.Errorf("Rebalance(%q) = %q; want %q", tc.equation, got, tc.want)
+		}
+		if got := balanced.Depth(); got != tc.depth {
+			t.Errorf("Rebalance(%q).Depth() = %d; want %d", tc.equation, got, tc.depth)
+		}
+		if got := balanced.CriticalPath(durations); got != tc.criticalPath {
+			t.Errorf("Rebalance(%q).CriticalPath() = %d; want %d", tc.equation, got, tc.criticalPath)
+		}
+		if balanced.Operations() != root.Operations() {
+			t.Errorf("Rebalance(%q) changed the number of operations", tc.equation)
+		}
+	}
+}
+
+func TestParseImplicit(t *testing.T) {
+	testCases := []struct {
+		equation string
+		want     string
+	}{
+		{"1+2", "1+2"},
+		{"2(3+4)", "2*(3+4)"},
+		{"(1+2)(3+4)", "(1+2)*(3+4)"},
+		{"(1+2) 3", "(1+2)*3"},
+		{"2pi", "2*pi"},
+		{"2 x y", "2*x*y"},
+		{"2sqrt(2)", "2*sqrt(2)"},
+		{"max(1,5)(2)", "max(1,5)*2"},
+		{"3#1", "3*#1"},
+		{"2(1,5)", "2*1.5"},
+		// The inserted * has the same priority as the written one
+		{"1/2(3)", "1/2*3"},
+		{"2^3(4)", "2^3*4"},
+		{"-2(3)", "-2*3"},
+		{"2(-3)", "2*(-3)"},
+	}
+
+	for _, tc := range testCases {
+		root, err := ParseImplicit(tc.equation)
+		if err != nil {
+			t.Errorf("ParseImplicit(%q) returned error %v", tc.equation, err)
+			continue
+		}
+		if got := root.String(); got != tc.want {
+			t.Errorf("ParseImplicit(%q).String() = %q; want %q", tc.equation, got, tc.want)
+		}
+	}
+
+	for _, equation := range []string{"", "2 3", "x(1)", "2()", "(1+2)(", "2*"} {
+		if _, err := ParseImplicit(equation); err == nil {
+			t.Errorf("ParseImplicit(%q) returned no error", equation)
+		}
+	}
+}
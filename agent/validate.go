@@ -0,0 +1,58 @@
+package agent
+
+// Validation describes a valid expression without evaluating it.
+type Validation struct {
+	// Canonical is the expression as it was read, with only the necessary parentheses and without spaces.
+	Canonical string `json:"canonical"`
+	// Statements hold the parse trees, a single expression has one statement.
+	Statements []Statement `json:"statements"`
+	// Operations is the number of operations placed on the computers.
+	Operations int `json:"operations"`
+	// Depth is the number of sequential steps with unlimited computers.
+	Depth int `json:"depth"`
+	// CriticalPath is the evaluation time with unlimited computers, in milliseconds.
+	CriticalPath int `json:"critical_path_ms"`
+	// Duration is the evaluation time on Computers idle computers, in milliseconds.
+	Duration  int `json:"estimated_ms"`
+	Computers int `json:"computers"`
+	// Simplified is the expression after the simplification, if it is enabled in the options.
+	Simplified string `json:"simplified,omitempty"`
+	// OperationsSaved is the number of operations removed by the simplification.
+	OperationsSaved int `json:"operations_saved,omitempty"`
+}
+
+// Validate parses the expression with the options and describes it without evaluating it.
+// The duration is simulated on the given number of computers, at least one, with the given durations of the operations.
+// An invalid expression is reported with the error of the parser.
+func Validate(text string, options Options, computers int, durations map[string]int) (Validation, error) {
+	script, err := options.ParseScript(text)
+	if err != nil {
+		return Validation{}, err
+	}
+	validation := Validation{
+		Canonical:  script.String(),
+		Statements: script.Statements,
+		Computers:  max(computers, 1),
+	}
+	// The estimates are made for the trees that are evaluated
+	built, err := BuildScript(text, options)
+	if err != nil {
+		return Validation{}, err
+	}
+	roots := built.Roots()
+	validation.Operations = uniqueOperations(roots)
+	if options.Simplify {
+		validation.Simplified = built.String()
+		validation.OperationsSaved = script.Operations() - validation.Operations
+	}
+	for _, root := range roots {
+		validation.Depth = max(validation.Depth, root.Depth())
+		validation.CriticalPath = max(validation.CriticalPath, root.CriticalPath(durations))
+	}
+	schedule, err := Simulate(roots, Computers(validation.Computers), durations)
+	if err != nil {
+		return Validation{}, err
+	}
+	validation.Duration = schedule.Makespan
+	return validation, nil
+}
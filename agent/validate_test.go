@@ -0,0 +1,59 @@
+package agent
+
+import (
+	"encoding/json"
+	"fmt"
+	"testing"
+)
+
+func TestValidate(t *testing.T) {
+	durations := map[string]int{"+": 10, "*": 20}
+	validation, err := Validate("a = (1+2)*(3+4); a + a", Options{}, 2, durations)
+	if err != nil {
+		t.Fatalf("Validate returned error %v", err)
+	}
+	want := Validation{
+		Canonical:    "a=(1+2)*(3+4); a+a",
+		Operations:   4,
+		Depth:        3,
+		CriticalPath: 40,
+		Duration:     40,
+		Computers:    2,
+	}
+	if len(validation.Statements) != 2 || validation.Statements[0].Name != "a" {
+		t.Errorf("Validate statements = %v; want a and the expression", validation.Statements)
+	}
+	validation.Statements = nil
+	if fmt.Sprint(validation) != fmt.Sprint(want) {
+		t.Errorf("Validate = %+v; want %+v", validation, want)
+	}
+
+	// Without computers the duration is estimated for one computer
+	validation, err = Validate("(1+2)*(3+4)", Options{}, 0, durations)
+	if err != nil {
+		t.Fatalf("Validate returned error %v", err)
+	}
+	if validation.Duration != 40 || validation.Computers != 1 {
+		t.Errorf("Validate on no computers = %d ms on %d computers; want 40 ms on 1 computer", validation.Duration, validation.Computers)
+	}
+
+	_, err = Validate("1+(2", Options{}, 1, durations)
+	if syntaxError, ok := err.(*SyntaxError); !ok || syntaxError.Pos != 2 || syntaxError.Msg != "unclosed (" {
+		t.Errorf("Validate returned error %v; want unclosed ( at position 2", err)
+	}
+}
+
+func TestNodeJSON(t *testing.T) {
+	root, err := Parse("-max(x, #1) * 2")
+	if err != nil {
+		t.Fatalf("Parse returned error %v", err)
+	}
+	data, err := json.Marshal(root)
+	if err != nil {
+		t.Fatalf("Marshal returned error %v", err)
+	}
+	want := `{"kind":"binary","op":"*","args":[{"kind":"unary","op":"-","args":[{"kind":"call","op":"max","args":[{"kind":"variable","value":"x"},{"kind":"reference","value":"#1"}]}]},{"kind":"number","value":"2"}]}`
+	if string(data) != want {
+		t.Errorf("Marshal = %s; want %s", data, want)
+	}
+}
@@ -0,0 +1,124 @@
+package agent
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+)
+
+// Constants are the built-in named constants.
+var Constants = map[string]float64{
+	"pi": math.Pi,
+	"e":  math.E,
+}
+
+// Snapshot holds the values of the variables of an expression at the time it was submitted,
+// so that the expression gives the same result even if the variables change later.
+type Snapshot map[string]float64
+
+// ParseSnapshot decodes a snapshot stored with an expression.
+// An empty or invalid snapshot has no variables.
+func ParseSnapshot(data string) Snapshot {
+	snapshot := Snapshot{}
+	if data != "" {
+		_ = json.Unmarshal([]byte(data), &snapshot)
+	}
+	return snapshot
+}
+
+// String encodes the snapshot as JSON for the database.
+func (s Snapshot) String() string {
+	if len(s) == 0 {
+		return ""
+	}
+	data, _ := json.Marshal(map[string]float64(s))
+	return string(data)
+}
+
+// ValidVariableName reports whether the name can be used for a user variable.
+// Names of constants and functions are reserved.
+func ValidVariableName(name string) bool {
+	if name == "" || !isLetter(name[0]) {
+		return false
+	}
+	for i := 1; i < len(name); i++ {
+		if !isLetter(name[i]) && !isDigit(name[i]) {
+			return false
+		}
+	}
+	_, isConstant := Constants[name]
+	_, isFunction := Functions[name]
+	return !isConstant && !isFunction
+}
+
+// Variables returns the names of the variables in the tree in alphabetical order.
+func (n *Node) Variables() []string {
+	seen := make(map[string]bool)
+	var walk func(n *Node)
+	walk = func(n *Node) {
+		if n.Kind == VariableNode {
+			seen[n.Value] = true
+		}
+		for _, arg := range n.Args {
+			walk(arg)
+		}
+	}
+	walk(n)
+	names := make([]string, 0, len(seen))
+	for name := range seen {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Bind takes the values of the variables the script uses without assigning them from the constants and the user variables.
+// User variables are looked up first. It returns an error if a variable is not defined.
+func Bind(script *Script, variables map[string]float64) (Snapshot, error) {
+	snapshot := Snapshot{}
+	for _, name := range script.Variables() {
+		if value, ok := variables[name]; ok {
+			snapshot[name] = value
+		} else if value, ok := Constants[name]; ok {
+			snapshot[name] = value
+		} else {
+			return nil, fmt.Errorf("unknown variable %s", name)
+		}
+	}
+	return snapshot, nil
+}
+
+// Substitute returns the tree with the variables replaced by their values from the snapshot.
+// References are replaced by the numbers from the results, see Results, or by the values from the snapshot
+// by keys like "#42" if the results miss them.
+func Substitute(n *Node, snapshot Snapshot, results Results) (*Node, error) {
+	if n.Kind == ReferenceNode {
+		if value, ok := results[n.Value]; ok {
+			return &Node{Value: value}, nil
+		}
+	}
+	if n.Kind == VariableNode || n.Kind == ReferenceNode {
+		value, ok := snapshot[n.Value]
+		if !ok {
+			if n.Kind == ReferenceNode {
+				return nil, fmt.Errorf("unknown expression %s", n.Value)
+			}
+			return nil, fmt.Errorf("unknown variable %s", n.Value)
+		}
+		return &Node{Value: strconv.FormatFloat(value, 'g', -1, 64)}, nil
+	}
+	if n.Kind == NumberNode {
+		return n, nil
+	}
+	args := make([]*Node, len(n.Args))
+	for i, arg := range n.Args {
+		var err error
+		args[i], err = Substitute(arg, snapshot, results)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return &Node{Kind: n.Kind, Op: n.Op, Args: args}, nil
+}
@@ -0,0 +1,98 @@
+package agent
+
+import (
+	"math"
+	"testing"
+)
+
+func TestBind(t *testing.T) {
+	variables := map[string]float64{"price": 100, "vat": 0.2, "e": 3}
+	testCases := []struct {
+		equation string
+		want     Snapshot
+		err      string
+	}{
+		{"1+2", Snapshot{}, ""},
+		{"price * (1 + vat)", Snapshot{"price": 100, "vat": 0.2}, ""},
+		{"2*pi", Snapshot{"pi": math.Pi}, ""},
+		// User variables are looked up before the constants
+		{"e", Snapshot{"e": 3}, ""},
+		{"price*discount", nil, "unknown variable discount"},
+		// Variables assigned in the script are not taken from the user variables
+		{"price = 5; price * (1 + vat)", Snapshot{"vat": 0.2}, ""},
+	}
+
+	for _, tc := range testCases {
+		script, err := Options{}.ParseScript(tc.equation)
+		if err != nil {
+			t.Fatalf("ParseScript(%q) returned error %v", tc.equation, err)
+		}
+		got, err := Bind(script, variables)
+		if tc.err != "" {
+			if err == nil || err.Error() != tc.err {
+				t.Errorf("Bind(%q) returned error %v; want %s", tc.equation, err, tc.err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("Bind(%q) returned error %v", tc.equation, err)
+			continue
+		}
+		if got.String() != tc.want.String() {
+			t.Errorf("Bind(%q) = %v; want %v", tc.equation, got, tc.want)
+		}
+	}
+}
+
+func TestSubstitute(t *testing.T) {
+	snapshot := ParseSnapshot(`{"price":100,"vat":0.2,"debt":-5}`)
+	testCases := []struct {
+		equation string
+		want     string
+	}{
+		{"price*(1+vat)", "100*(1+0.2)"},
+		{"max(price, debt)", "max(100,-5)"},
+		{"2-debt", "2-(-5)"},
+	}
+
+	for _, tc := range testCases {
+		root, err := Parse(tc.equation)
+		if err != nil {
+			t.Fatalf("Parse(%q) returned error %v", tc.equation, err)
+		}
+		bound, err := Substitute(root, snapshot, nil)
+		if err != nil {
+			t.Errorf("Substitute(%q) returned error %v", tc.equation, err)
+			continue
+		}
+		if got := bound.String(); got != tc.want {
+			t.Errorf("Substitute(%q) = %q; want %q", tc.equation, got, tc.want)
+		}
+	}
+
+	root, _ := Parse("price*count")
+	if _, err := Substitute(root, snapshot, nil); err == nil {
+		t.Errorf("Substitute with an unknown variable returned no error")
+	}
+}
+
+func TestValidVariableName(t *testing.T) {
+	testCases := []struct {
+		name string
+		want bool
+	}{
+		{"price", true},
+		{"_tmp1", true},
+		{"1x", false},
+		{"", false},
+		{"a-b", false},
+		{"pi", false},
+		{"sqrt", false},
+	}
+
+	for _, tc := range testCases {
+		if got := ValidVariableName(tc.name); got != tc.want {
+			t.Errorf("ValidVariableName(%q) = %v; want %v", tc.name, got, tc.want)
+		}
+	}
+}
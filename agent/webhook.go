@@ -0,0 +1,144 @@
+package agent
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// The headers of the webhook requests.
+const (
+	// WebhookSignatureHeader holds the time of the request and the signature, see SignWebhook.
+	WebhookSignatureHeader = "X-Calculator-Signature"
+	// WebhookDeliveryHeader holds the ID of the delivery, it is the same for the retries of a delivery.
+	WebhookDeliveryHeader = "X-Calculator-Delivery"
+	// WebhookEventHeader holds the event of the payload.
+	WebhookEventHeader = "X-Calculator-Event"
+)
+
+// maxWebhookBackoff limits the delay between the retries of a delivery.
+const maxWebhookBackoff = time.Hour
+
+// WebhookEvent returns the webhook event of the final event of an expression: "computed", "error" or "cancelled".
+// It returns "" for the other events.
+func WebhookEvent(e Event) string {
+	switch {
+	case e.Type == ResultEvent:
+		return "computed"
+	case e.Type == StatusEvent && strings.HasPrefix(e.Status, "Error"):
+		return "error"
+	case e.Type == StatusEvent && e.Status == CancelledStatus:
+		return "cancelled"
+	}
+	return ""
+}
+
+// WebhookPayload returns the JSON body of the webhook of the final event of an expression with the text, like
+//
+//	{"event":"computed","id":5,"text":"2+2*2","status":"Computed","result":6,"result_text":"6","finished_at":1700000000}
+//
+// The results are only present for the computed expressions.
+func WebhookPayload(e Event, text string, finishedAt time.Time) []byte {
+	payload := map[string]interface{}{
+		"event":       WebhookEvent(e),
+		"id":          e.EquationID,
+		"text":        text,
+		"status":      e.Status,
+		"finished_at": finishedAt.Unix(),
+	}
+	if e.Type == ResultEvent {
+		payload["result"] = e.Result
+		payload["result_text"] = e.ResultText
+	}
+	data, _ := json.Marshal(payload)
+	return data
+}
+
+// SignWebhook returns the value of WebhookSignatureHeader for the body sent at the Unix time, like "t=1700000000,v1=5257a8...".
+// v1 is the hex HMAC-SHA256 of the time, a dot and the body with the secret of the user,
+// the receiver recomputes it and rejects old times to protect against replayed requests.
+func SignWebhook(secret string, timestamp int64, body []byte) string {
+	t := strconv.FormatInt(timestamp, 10)
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(t + "."))
+	mac.Write(body)
+	return "t=" + t + ",v1=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// VerifyWebhook checks the signature of the body made by SignWebhook at most tolerance before now.
+func VerifyWebhook(secret, signature string, body []byte, now time.Time, tolerance time.Duration) error {
+	var timestamp int64
+	var mac string
+	for _, part := range strings.Split(signature, ",") {
+		key, value, _ := strings.Cut(part, "=")
+		switch key {
+		case "t":
+			timestamp, _ = strconv.ParseInt(value, 10, 64)
+		case "v1":
+			mac = value
+		}
+	}
+	if timestamp == 0 || mac == "" {
+		return errors.New("malformed signature")
+	}
+	if now.Sub(time.Unix(timestamp, 0)) > tolerance {
+		return errors.New("the signature is too old")
+	}
+	if !hmac.Equal([]byte(SignWebhook(secret, timestamp, body)), []byte(signature)) {
+		return errors.New("invalid signature")
+	}
+	return nil
+}
+
+// WebhookBackoff returns the delay after the failed attempt of a delivery, starting with 1:
+// base, 2*base, 4*base and so on, up to an hour.
+func WebhookBackoff(base time.Duration, attempt int) time.Duration {
+	delay := base
+	for i := 1; i < attempt && delay < maxWebhookBackoff; i++ {
+		delay *= 2
+	}
+	return min(delay, maxWebhookBackoff)
+}
+
+// WebhookRequest is an attempt of a delivery of a webhook.
+type WebhookRequest struct {
+	URL        string
+	Secret     string
+	DeliveryID int
+	Event      string
+	Payload    []byte
+}
+
+// DeliverWebhook posts the signed payload of the request and returns the status code of the response.
+// A response other than 2xx is an error, the caller retries the delivery later.
+func DeliverWebhook(client *http.Client, request WebhookRequest, now time.Time) (int, error) {
+	httpRequest, err := http.NewRequest("POST", request.URL, bytes.NewReader(request.Payload))
+	if err != nil {
+		return 0, err
+	}
+	httpRequest.Header.Set("Content-Type", "application/json")
+	httpRequest.Header.Set("User-Agent", "DistributedCalculator-Webhook")
+	httpRequest.Header.Set(WebhookSignatureHeader, SignWebhook(request.Secret, now.Unix(), request.Payload))
+	httpRequest.Header.Set(WebhookDeliveryHeader, strconv.Itoa(request.DeliveryID))
+	httpRequest.Header.Set(WebhookEventHeader, request.Event)
+	response, err := client.Do(httpRequest)
+	if err != nil {
+		return 0, err
+	}
+	defer response.Body.Close()
+	// Read a little of the body, so that the connection can be reused
+	_, _ = io.Copy(io.Discard, io.LimitReader(response.Body, 4096))
+	if response.StatusCode < 200 || response.StatusCode > 299 {
+		return response.StatusCode, fmt.Errorf("unexpected status %s", response.Status)
+	}
+	return response.StatusCode, nil
+}
@@ -0,0 +1,122 @@
+package agent
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestWebhookPayload(t *testing.T) {
+	finishedAt := time.Unix(1700000000, 0)
+	testCases := []struct {
+		event Event
+		want  string
+	}{
+		{Event{Type: ResultEvent, EquationID: 5, Status: "Computed", Result: 6, ResultText: "6"},
+			`{"event":"computed","finished_at":1700000000,"id":5,"result":6,"result_text":"6","status":"Computed","text":"2+2*2"}`},
+		{Event{Type: StatusEvent, EquationID: 5, Status: "Error division by zero"},
+			`{"event":"error","finished_at":1700000000,"id":5,"status":"Error division by zero","text":"2+2*2"}`},
+		{Event{Type: StatusEvent, EquationID: 5, Status: CancelledStatus},
+			`{"event":"cancelled","finished_at":1700000000,"id":5,"status":"Cancelled","text":"2+2*2"}`},
+	}
+
+	for _, tc := range testCases {
+		got := string(WebhookPayload(tc.event, "2+2*2", finishedAt))
+		if got != tc.want {
+			t.Errorf("WebhookPayload(%v) = %s; want %s", tc.event, got, tc.want)
+		}
+	}
+	if got := WebhookEvent(Event{Type: StatusEvent, Status: "Computing"}); got != "" {
+		t.Errorf("WebhookEvent of an unfinished expression = %q; want \"\"", got)
+	}
+}
+
+func TestWebhookBackoff(t *testing.T) {
+	testCases := []struct {
+		attempt int
+		want    time.Duration
+	}{
+		{1, 10 * time.Second},
+		{2, 20 * time.Second},
+		{5, 160 * time.Second},
+		// The delay stops growing at an hour
+		{20, time.Hour},
+	}
+
+	for _, tc := range testCases {
+		got := WebhookBackoff(10*time.Second, tc.attempt)
+		if got != tc.want {
+			t.Errorf("WebhookBackoff(10s, %d) = %v; want %v", tc.attempt, got, tc.want)
+		}
+	}
+}
+
+func TestVerifyWebhook(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	body := []byte(`{"id":1}`)
+	signature := SignWebhook("secret", now.Unix(), body)
+	testCases := []struct {
+		name      string
+		secret    string
+		signature string
+		body      string
+		now       time.Time
+		valid     bool
+	}{
+		{"valid", "secret", signature, `{"id":1}`, now, true},
+		{"other secret", "other", signature, `{"id":1}`, now, false},
+		{"changed body", "secret", signature, `{"id":2}`, now, false},
+		{"replayed later", "secret", signature, `{"id":1}`, now.Add(10 * time.Minute), false},
+		{"malformed", "secret", "v1=abc", `{"id":1}`, now, false},
+	}
+
+	for _, tc := range testCases {
+		err := VerifyWebhook(tc.secret, tc.signature, []byte(tc.body), tc.now, 5*time.Minute)
+		if (err == nil) != tc.valid {
+			t.Errorf("%s: VerifyWebhook() = %v; want valid %v", tc.name, err, tc.valid)
+		}
+	}
+}
+
+func TestDeliverWebhook(t *testing.T) {
+	now := time.Now()
+	var received *http.Request
+	var receivedBody []byte
+	status := http.StatusOK
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		received = r
+		receivedBody, _ = io.ReadAll(r.Body)
+		w.WriteHeader(status)
+	}))
+	defer receiver.Close()
+
+	request := WebhookRequest{URL: receiver.URL, Secret: "secret", DeliveryID: 7, Event: "computed", Payload: []byte(`{"id":1}`)}
+	code, err := DeliverWebhook(receiver.Client(), request, now)
+	if err != nil || code != http.StatusOK {
+		t.Fatalf("DeliverWebhook() = %d, %v; want 200, nil", code, err)
+	}
+	if received.Method != "POST" || string(receivedBody) != `{"id":1}` {
+		t.Errorf("the receiver got %s %s; want POST {\"id\":1}", received.Method, receivedBody)
+	}
+	if got := received.Header.Get(WebhookDeliveryHeader); got != "7" {
+		t.Errorf("%s = %q; want \"7\"", WebhookDeliveryHeader, got)
+	}
+	if got := received.Header.Get(WebhookEventHeader); got != "computed" {
+		t.Errorf("%s = %q; want \"computed\"", WebhookEventHeader, got)
+	}
+	if err := VerifyWebhook("secret", received.Header.Get(WebhookSignatureHeader), receivedBody, now, time.Minute); err != nil {
+		t.Errorf("the receiver cannot verify the signature: %v", err)
+	}
+
+	// The responses other than 2xx and the unreachable receivers are failed attempts
+	status = http.StatusInternalServerError
+	if code, err := DeliverWebhook(receiver.Client(), request, now); err == nil || code != http.StatusInternalServerError {
+		t.Errorf("DeliverWebhook() to a failing receiver = %d, %v; want 500 and an error", code, err)
+	}
+	receiver.Close()
+	if _, err := DeliverWebhook(receiver.Client(), request, now); err == nil {
+		t.Errorf("DeliverWebhook() to a closed receiver succeeded")
+	}
+}
@@ -0,0 +1,393 @@
+package main
+
+import (
+	"DistributedCalculator/agent"
+	"DistributedCalculator/db"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// writeJSON writes the value as a JSON response with the given status code.
+func writeJSON(w http.ResponseWriter, status int, value interface{}) {
+	jsonStr, err := json.Marshal(value)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_, err = w.Write(jsonStr)
+	if err != nil {
+		log.Println(err)
+	}
+}
+
+// estimateResponse builds the JSON description of an estimate.
+// The estimated completion time is counted from now.
+func estimateResponse(estimate agent.Estimate) map[string]interface{} {
+	return map[string]interface{}{
+		"remaining_ms":         estimate.Remaining,
+		"critical_path_ms":     estimate.CriticalPath,
+		"operations":           estimate.Operations,
+		"computers":            estimate.Computers,
+		"estimated_completion": time.Now().Add(time.Duration(estimate.Remaining) * time.Millisecond).Format(time.RFC3339Nano),
+	}
+}
+
+// expressionRequest is the JSON body of the requests that submit or check an expression.
+type expressionRequest struct {
+	Expression string `json:"expression"`
+	Rebalance  bool   `json:"rebalance"`
+	Mode       string `json:"mode"`
+	Precision  int    `json:"precision"`
+	// ImplicitMultiplication accepts expressions like 2(3+4)
+	ImplicitMultiplication bool `json:"implicit_multiplication"`
+	// Simplify folds the operations on numbers before the expression is evaluated
+	Simplify bool `json:"simplify"`
+	// CallbackURL is notified when the expression is finished, see webhooks.go
+	CallbackURL string `json:"callback_url"`
+}
+
+// options returns the evaluation options of the request, starting with the default ones.
+func (request expressionRequest) options() (agent.Options, error) {
+	options := agent.DefaultOptions
+	if request.Rebalance {
+		options.Rebalance = true
+	}
+	if request.ImplicitMultiplication {
+		options.ImplicitMultiplication = true
+	}
+	if request.Simplify {
+		options.Simplify = true
+	}
+	err := setNumericMode(&options, request.Mode, request.Precision)
+	return options, err
+}
+
+// CalculateAPIHandler handles "POST /api/v1/calculate".
+// It adds the expression from the JSON body to the queue of the authorized user
+// and returns its id together with the estimated completion time.
+func CalculateAPIHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "Invalid request method", http.StatusMethodNotAllowed)
+		return
+	}
+
+	userLogin, isAuth := getUserLogin(r)
+	if !isAuth {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	var request expressionRequest
+	err := json.NewDecoder(r.Body).Decode(&request)
+	if err != nil {
+		http.Error(w, "Bad request", http.StatusBadRequest)
+		return
+	}
+
+	options, err := request.options()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	script, err := options.ParseScript(request.Expression)
+	if err != nil {
+		http.Error(w, "Invalid equation", http.StatusBadRequest)
+		return
+	}
+	if err := checkCallbackURL(request.CallbackURL); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	database, err := db.Connect("data.db")
+	if err != nil {
+		http.Error(w, "Failed to connect to database", http.StatusInternalServerError)
+		return
+	}
+	defer database.Close()
+
+	userId, err := database.GetUserID(userLogin)
+	if err != nil {
+		http.Error(w, "User not found", http.StatusNotFound)
+		return
+	}
+
+	snapshot, err := bindVariables(database, script, userId)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	id, err := queueEquation(database, request.Expression, userId, options, snapshot, request.CallbackURL, nil)
+	if err != nil {
+		http.Error(w, "Failed to add equation to database", http.StatusInternalServerError)
+		return
+	}
+
+	response := map[string]interface{}{
+		"id":        id,
+		"status":    "In queue",
+		"canonical": script.String(),
+	}
+	addSimplification(response, request.Expression, script, options)
+	estimates, err := agent.EstimateQueue(database)
+	if err == nil {
+		if estimate, ok := estimates[id]; ok {
+			response["estimate"] = estimateResponse(estimate)
+		}
+	}
+	writeJSON(w, http.StatusCreated, response)
+}
+
+// addSimplification adds the simplified expression and the number of the saved operations to the response,
+// if the simplification is enabled in the options. An expression that fails to simplify fails when it is evaluated.
+func addSimplification(response map[string]interface{}, text string, script *agent.Script, options agent.Options) {
+	if !options.Simplify {
+		return
+	}
+	simplified, err := agent.BuildScript(text, options)
+	if err != nil {
+		return
+	}
+	response["simplified"] = simplified.String()
+	response["operations_saved"] = script.Operations() - simplified.Operations()
+}
+
+// ExpressionsAPIHandler handles the "/api/v1/expressions/{id}/..." routes of the authorized user.
+// Supported routes:
+//   - GET /api/v1/expressions/{id}/estimate — the estimated completion time recomputed from the current queue
+//   - GET /api/v1/expressions/{id}/events — the status, progress and result of the expression as Server-Sent Events
+//   - POST /api/v1/expressions/{id}/cancel — cancels the evaluation of an unfinished expression
+func ExpressionsAPIHandler(w http.ResponseWriter, r *http.Request) {
+	path := strings.Split(strings.Trim(strings.TrimPrefix(r.URL.Path, "/api/v1/expressions/"), "/"), "/")
+	id, err := strconv.Atoi(path[0])
+	if err != nil {
+		http.Error(w, "Invalid ID", http.StatusBadRequest)
+		return
+	}
+
+	userLogin, isAuth := getUserLogin(r)
+	if !isAuth {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	database, err := db.Connect("data.db")
+	if err != nil {
+		http.Error(w, "Failed to connect to database", http.StatusInternalServerError)
+		return
+	}
+	defer database.Close()
+
+	// Only the owner of the expression can access it
+	userId, _ := database.GetUserID(userLogin)
+	equationUserId, err := database.GetEquationUserId(id)
+	if err != nil || equationUserId == 0 {
+		http.Error(w, "Equation not found", http.StatusNotFound)
+		return
+	}
+	if userId != equationUserId {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	action := ""
+	if len(path) > 1 {
+		action = path[1]
+	}
+	switch {
+	case action == "estimate" && r.Method == "GET":
+		estimateAPIHandler(w, database, id)
+	case action == "events" && r.Method == "GET":
+		expressionEventsAPIHandler(w, r, database, id)
+	case action == "cancel" && r.Method == "POST":
+		if !cancelExpression(database, id) {
+			http.Error(w, "The expression is already finished", http.StatusConflict)
+			return
+		}
+		writeJSON(w, http.StatusAccepted, map[string]interface{}{"id": id, "status": "Cancelling"})
+	default:
+		http.Error(w, "Not found", http.StatusNotFound)
+	}
+}
+
+// cancelExpression cancels the evaluation of the expression unless it is finished, and reports whether it was not.
+// The expression gets the status "Cancelled" when its evaluation stops.
+func cancelExpression(database *db.DB, id int) bool {
+	_, status, _, _ := database.GetEquationInfo(id)
+	if agent.Finished(status) {
+		return false
+	}
+	agent.Cancel(id)
+	return true
+}
+
+// estimateAPIHandler returns the estimated completion time of the expression.
+// Finished expressions have nothing left to compute.
+func estimateAPIHandler(w http.ResponseWriter, database *db.DB, id int) {
+	_, status, _, _ := database.GetEquationInfo(id)
+	estimates, err := agent.EstimateQueue(database)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	response := map[string]interface{}{
+		"id":     id,
+		"status": status,
+	}
+	if estimate, ok := estimates[id]; ok {
+		response["estimate"] = estimateResponse(estimate)
+	} else {
+		response["estimate"] = nil
+	}
+	writeJSON(w, http.StatusOK, response)
+}
+
+// VariablesAPIHandler handles the variables of the authorized user.
+// Supported routes:
+//   - GET /api/v1/variables — all variables as {"name": value}
+//   - PUT /api/v1/variables/{name} with {"value": 1.5} — creates or updates the variable
+//   - DELETE /api/v1/variables/{name} — deletes the variable
+//
+// Changing a variable does not affect the expressions that are already submitted.
+func VariablesAPIHandler(w http.ResponseWriter, r *http.Request) {
+	name := strings.Trim(strings.TrimPrefix(r.URL.Path, "/api/v1/variables"), "/")
+
+	userLogin, isAuth := getUserLogin(r)
+	if !isAuth {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	database, err := db.Connect("data.db")
+	if err != nil {
+		http.Error(w, "Failed to connect to database", http.StatusInternalServerError)
+		return
+	}
+	defer database.Close()
+
+	userId, err := database.GetUserID(userLogin)
+	if err != nil {
+		http.Error(w, "User not found", http.StatusNotFound)
+		return
+	}
+
+	switch {
+	case name == "" && r.Method == "GET":
+		variables, err := database.GetVariables(userId)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		writeJSON(w, http.StatusOK, variables)
+	case name != "" && r.Method == "PUT":
+		if !agent.ValidVariableName(name) {
+			http.Error(w, "Invalid variable name", http.StatusBadRequest)
+			return
+		}
+		var request struct {
+			Value *float64 `json:"value"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&request); err != nil || request.Value == nil {
+			http.Error(w, "Bad request", http.StatusBadRequest)
+			return
+		}
+		if err := database.SetVariable(userId, name, *request.Value); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		writeJSON(w, http.StatusOK, map[string]interface{}{"name": name, "value": *request.Value})
+	case name != "" && r.Method == "DELETE":
+		deleted, err := database.DeleteVariable(userId, name)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if !deleted {
+			http.Error(w, "Variable not found", http.StatusNotFound)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		http.Error(w, "Invalid request method", http.StatusMethodNotAllowed)
+	}
+}
+
+// ValidateAPIHandler handles "POST /api/v1/validate".
+// It checks the expression from the JSON body of the calculate request without adding it to the queue.
+// A valid expression is described with its canonical form, parse trees, number of operations, depth and estimated duration.
+// An invalid one is answered with 422 and the errors with their positions, like
+// {"valid":false,"errors":[{"message":"unexpected )","position":4}]}.
+// If the user is authorized, the variables and the references of the expression are checked too.
+func ValidateAPIHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "Invalid request method", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var request expressionRequest
+	err := json.NewDecoder(r.Body).Decode(&request)
+	if err != nil {
+		http.Error(w, "Bad request", http.StatusBadRequest)
+		return
+	}
+	options, err := request.options()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	database, err := db.Connect("data.db")
+	if err != nil {
+		http.Error(w, "Failed to connect to database", http.StatusInternalServerError)
+		return
+	}
+	defer database.Close()
+
+	computers, err := database.CountComputers()
+	if err != nil {
+		http.Error(w, "Failed to count computers", http.StatusInternalServerError)
+		return
+	}
+	durations, err := database.GetOperationTimes()
+	if err != nil {
+		http.Error(w, "Failed to get operation times", http.StatusInternalServerError)
+		return
+	}
+	validation, err := agent.Validate(request.Expression, options, computers, durations)
+	if err == nil {
+		if userLogin, isAuth := getUserLogin(r); isAuth {
+			if userId, userErr := database.GetUserID(userLogin); userErr == nil {
+				script, _ := options.ParseScript(request.Expression)
+				_, err = bindVariables(database, script, userId)
+			}
+		}
+	}
+	if err != nil {
+		writeJSON(w, http.StatusUnprocessableEntity, map[string]interface{}{
+			"valid":  false,
+			"errors": []map[string]interface{}{validationError(err)},
+		})
+		return
+	}
+	writeJSON(w, http.StatusOK, struct {
+		Valid bool `json:"valid"`
+		agent.Validation
+	}{true, validation})
+}
+
+// validationError describes the error of an invalid expression, syntax errors have the position in the expression.
+func validationError(err error) map[string]interface{} {
+	var syntaxError *agent.SyntaxError
+	if errors.As(err, &syntaxError) {
+		return map[string]interface{}{"message": syntaxError.Msg, "position": syntaxError.Pos}
+	}
+	return map[string]interface{}{"message": err.Error()}
+}
@@ -0,0 +1,350 @@
+package main
+
+import (
+	"DistributedCalculator/agent"
+	"DistributedCalculator/db"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// maxBatchSize limits the number of expressions in a batch.
+const maxBatchSize = 10000
+
+// maxBatchBodySize limits the size of the body of a batch in bytes.
+const maxBatchBodySize = 10 << 20
+
+// batchWorkers limits the expressions of a batch that are evaluated at the same time,
+// so that a large batch does not lock the database with thousands of writers.
+const batchWorkers = 16
+
+// batchRequest is an expression of a batch, the calculate request with the optional id and tags given by the client.
+type batchRequest struct {
+	expressionRequest
+	ClientID string   `json:"client_id"`
+	Tags     []string `json:"tags"`
+	// line is the line of an imported file the expression is read from.
+	line int
+}
+
+// batchItem is the outcome of an expression of a batch: the id of the queued expression or the error.
+type batchItem struct {
+	// Index is the position of the expression in the batch, starting with 0.
+	Index int `json:"index"`
+	// Line is the line of an imported file.
+	Line      int                    `json:"line,omitempty"`
+	ClientID  string                 `json:"client_id,omitempty"`
+	ID        int                    `json:"id,omitempty"`
+	Canonical string                 `json:"canonical,omitempty"`
+	Error     map[string]interface{} `json:"error,omitempty"`
+}
+
+// decodeBatch reads the expressions of a batch.
+// The body is either a JSON array of calculate requests or a stream of them, one per line (NDJSON).
+func decodeBatch(body io.Reader) ([]batchRequest, error) {
+	decoder := json.NewDecoder(body)
+	var first json.RawMessage
+	if err := decoder.Decode(&first); err != nil {
+		return nil, err
+	}
+	var requests []batchRequest
+	if bytes.HasPrefix(first, []byte("[")) {
+		if err := json.Unmarshal(first, &requests); err != nil {
+			return nil, err
+		}
+		if decoder.More() {
+			return nil, errors.New("unexpected data after the array")
+		}
+		return requests, nil
+	}
+	for raw := first; ; {
+		var request batchRequest
+		if err := json.Unmarshal(raw, &request); err != nil {
+			return nil, fmt.Errorf("expression %d: %w", len(requests), err)
+		}
+		requests = append(requests, request)
+		if len(requests) > maxBatchSize {
+			return requests, nil
+		}
+		raw = nil
+		if err := decoder.Decode(&raw); err == io.EOF {
+			return requests, nil
+		} else if err != nil {
+			return nil, err
+		}
+	}
+}
+
+// BatchCalculateAPIHandler handles "POST /api/v1/calculate/batch".
+// It checks every expression of the batch like the calculate request and adds the valid ones to the queue
+// of the authorized user in a single transaction. The response has the id of the batch and, for every expression
+// in its order, either its id or its error, like
+// {"batch_id":1,"accepted":1,"rejected":1,"items":[{"index":0,"id":5,"canonical":"1+2"},{"index":1,"error":{"message":"unexpected )","position":2}}]}.
+// If no expression is valid, no batch is created and the response is 422.
+// The expressions may have the client_id and the tags of the client, they are returned in the items and the export.
+func BatchCalculateAPIHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "Invalid request method", http.StatusMethodNotAllowed)
+		return
+	}
+
+	userLogin, isAuth := getUserLogin(r)
+	if !isAuth {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	r.Body = http.MaxBytesReader(w, r.Body, maxBatchBodySize)
+	requests, err := decodeBatch(r.Body)
+	var tooLarge *http.MaxBytesError
+	if errors.As(err, &tooLarge) {
+		http.Error(w, fmt.Sprintf("A batch has at most %d bytes", maxBatchBodySize), http.StatusRequestEntityTooLarge)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Bad request: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	if len(requests) == 0 {
+		http.Error(w, "Empty batch", http.StatusBadRequest)
+		return
+	}
+	if len(requests) > maxBatchSize {
+		http.Error(w, fmt.Sprintf("A batch has at most %d expressions", maxBatchSize), http.StatusRequestEntityTooLarge)
+		return
+	}
+
+	database, err := db.Connect("data.db")
+	if err != nil {
+		http.Error(w, "Failed to connect to database", http.StatusInternalServerError)
+		return
+	}
+	defer database.Close()
+
+	userId, err := database.GetUserID(userLogin)
+	if err != nil {
+		http.Error(w, "User not found", http.StatusNotFound)
+		return
+	}
+
+	batchId, items, err := queueBatch(database, userId, requests)
+	if err != nil {
+		http.Error(w, "Failed to add equations to database", http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, batchStatusCode(batchId), batchResponse(batchId, items))
+}
+
+// queueBatch checks every expression of the batch and adds the valid ones to the queue of the user in a single transaction.
+// It returns the id of the batch, which is 0 if no expression is valid, and the outcome of every expression.
+func queueBatch(database *db.DB, userId int, requests []batchRequest) (int, []batchItem, error) {
+	// Every expression is checked on its own, the valid ones are queued together
+	items := make([]batchItem, len(requests))
+	var equations []db.NewEquation
+	var accepted []int
+	for i, request := range requests {
+		items[i].Index = i
+		items[i].Line = request.line
+		items[i].ClientID = request.ClientID
+		options, err := request.options()
+		if err != nil {
+			items[i].Error = validationError(err)
+			continue
+		}
+		script, err := options.ParseScript(request.Expression)
+		if err != nil {
+			items[i].Error = validationError(err)
+			continue
+		}
+		snapshot, err := bindVariables(database, script, userId)
+		if err != nil {
+			items[i].Error = validationError(err)
+			continue
+		}
+		if _, err := parseCallbackURL(request.CallbackURL); err != nil {
+			items[i].Error = validationError(err)
+			continue
+		}
+		items[i].Canonical = script.String()
+		equations = append(equations, db.NewEquation{
+			Text:        request.Expression,
+			Options:     options.String(),
+			Variables:   snapshot.String(),
+			ClientID:    request.ClientID,
+			Tags:        request.Tags,
+			CallbackURL: request.CallbackURL,
+		})
+		accepted = append(accepted, i)
+	}
+	if len(accepted) == 0 {
+		return 0, items, nil
+	}
+
+	batchId, ids, err := database.AddBatch(userId, equations, time.Now().Unix())
+	if err != nil {
+		return 0, nil, err
+	}
+	for j, i := range accepted {
+		items[i].ID = ids[j]
+	}
+	publishQueued(userId, ids...)
+	evaluateBatchInBackground(ids)
+	return batchId, items, nil
+}
+
+// batchResponse describes the outcome of a batch, batches without valid expressions have no id.
+func batchResponse(batchId int, items []batchItem) map[string]interface{} {
+	accepted := 0
+	for _, item := range items {
+		if item.Error == nil {
+			accepted++
+		}
+	}
+	response := map[string]interface{}{
+		"accepted": accepted,
+		"rejected": len(items) - accepted,
+		"items":    items,
+	}
+	if batchId != 0 {
+		response["batch_id"] = batchId
+	}
+	return response
+}
+
+// batchStatusCode returns 201 for a created batch and 422 if no expression of the batch is valid.
+func batchStatusCode(batchId int) int {
+	if batchId == 0 {
+		return http.StatusUnprocessableEntity
+	}
+	return http.StatusCreated
+}
+
+// evaluateBatchInBackground evaluates the queued equations of a batch in their order with batchWorkers goroutines.
+func evaluateBatchInBackground(ids []int) {
+	queue := make(chan int)
+	for i := 0; i < min(batchWorkers, len(ids)); i++ {
+		go func() {
+			for id := range queue {
+				if err := agent.Evaluate(id); err != nil {
+					log.Fatal(err)
+				}
+			}
+		}()
+	}
+	go func() {
+		for _, id := range ids {
+			queue <- id
+		}
+		close(queue)
+	}()
+}
+
+// BatchesAPIHandler handles "GET /api/v1/batches/{id}" of the authorized user.
+// It returns the progress of the batch, the number of its expressions in every status,
+// and all of its expressions with their statuses and results.
+// The estimate is the one of the expression that finishes last, it is null when the batch is done.
+func BatchesAPIHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "Invalid request method", http.StatusMethodNotAllowed)
+		return
+	}
+	batchId, err := strconv.Atoi(strings.Trim(strings.TrimPrefix(r.URL.Path, "/api/v1/batches/"), "/"))
+	if err != nil {
+		http.Error(w, "Invalid ID", http.StatusBadRequest)
+		return
+	}
+
+	userLogin, isAuth := getUserLogin(r)
+	if !isAuth {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	database, err := db.Connect("data.db")
+	if err != nil {
+		http.Error(w, "Failed to connect to database", http.StatusInternalServerError)
+		return
+	}
+	defer database.Close()
+
+	// Only the owner of the batch can access it
+	userId, _ := database.GetUserID(userLogin)
+	batchUserId, err := database.GetBatchUserId(batchId)
+	if err != nil || batchUserId == 0 {
+		http.Error(w, "Batch not found", http.StatusNotFound)
+		return
+	}
+	if userId != batchUserId {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	equations, err := database.GetBatchEquations(batchId)
+	if err != nil {
+		http.Error(w, "Failed to get the batch", http.StatusInternalServerError)
+		return
+	}
+	counts := map[string]int{"in_queue": 0, "waiting": 0, "computing": 0, "computed": 0, "failed": 0, "cancelled": 0}
+	expressions := make([]map[string]interface{}, len(equations))
+	for i, equation := range equations {
+		counts[batchStatus(equation.Status)]++
+		expression := map[string]interface{}{
+			"id":     equation.ID,
+			"text":   equation.Text,
+			"status": equation.Status,
+			"result": equation.Result,
+		}
+		if equation.ResultText != "" {
+			expression["result_text"] = equation.ResultText
+		}
+		expressions[i] = expression
+	}
+	finished := counts["computed"] + counts["failed"] + counts["cancelled"]
+	response := map[string]interface{}{
+		"batch_id":    batchId,
+		"total":       len(equations),
+		"counts":      counts,
+		"done":        finished == len(equations),
+		"progress":    float64(finished) / float64(max(len(equations), 1)),
+		"expressions": expressions,
+		"estimate":    nil,
+	}
+	if finished < len(equations) {
+		if estimates, err := agent.EstimateQueue(database); err == nil {
+			var last *agent.Estimate
+			for _, equation := range equations {
+				if estimate, ok := estimates[equation.ID]; ok && (last == nil || estimate.Remaining > last.Remaining) {
+					last = &estimate
+				}
+			}
+			if last != nil {
+				response["estimate"] = estimateResponse(*last)
+			}
+		}
+	}
+	writeJSON(w, http.StatusOK, response)
+}
+
+// batchStatus returns the key of the counts of the batch for the status of an expression.
+func batchStatus(status string) string {
+	switch {
+	case status == "Computed":
+		return "computed"
+	case status == "Waiting":
+		return "waiting"
+	case status == "Computing":
+		return "computing"
+	case strings.HasPrefix(status, "Error"):
+		return "failed"
+	case status == agent.CancelledStatus:
+		return "cancelled"
+	}
+	return "in_queue"
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestDecodeBatch(t *testing.T) {
+	testCases := []struct {
+		name string
+		body string
+		want []string
+		err  string
+	}{
+		{"array", `[{"expression": "1+2", "client_id": "a"}, {"expression": "3*4", "tags": ["x"]}]`, []string{"1+2 a", "3*4 [x]"}, ""},
+		{"empty array", `[]`, []string{}, ""},
+		{"NDJSON", "{\"expression\": \"1+2\", \"client_id\": \"a\"}\n{\"expression\": \"3*4\", \"tags\": [\"x\"]}\n", []string{"1+2 a", "3*4 [x]"}, ""},
+		{"NDJSON without the last newline and with blank lines", "{\"expression\": \"1\"}\n\n{\"expression\": \"2\"}", []string{"1", "2"}, ""},
+		{"options", `[{"expression": "1/3", "mode": "rational", "simplify": true}]`, []string{"1/3 rational simplify"}, ""},
+		// Malformed input
+		{"empty body", ``, nil, "EOF"},
+		{"malformed line", "{\"expression\": \"1\"}\n{oops}\n", nil, "invalid character 'o' looking for beginning of object key string"},
+		{"line of another type", "{\"expression\": \"1\"}\n[\"2\"]\n", nil, "expression 1: json: cannot unmarshal array into Go value of type main.batchRequest"},
+		{"field of another type", "{\"expression\": 1}\n", nil, "expression 0: json: cannot unmarshal number into Go struct field batchRequest.expression of type string"},
+		{"data after the array", `[{"expression": "1"}] {"expression": "2"}`, nil, "unexpected data after the array"},
+		{"malformed array", `[{"expression": "1"},]`, nil, "invalid character ']' looking for beginning of value"},
+	}
+
+	for _, tc := range testCases {
+		requests, err := decodeBatch(strings.NewReader(tc.body))
+		if tc.err != "" {
+			if err == nil || err.Error() != tc.err {
+				t.Errorf("%s: decodeBatch() returned error %v; want %s", tc.name, err, tc.err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: decodeBatch() returned error %v", tc.name, err)
+			continue
+		}
+		got := make([]string, len(requests))
+		for i, request := range requests {
+			got[i] = describeBatchRequest(request)
+		}
+		if fmt.Sprint(got) != fmt.Sprint(tc.want) {
+			t.Errorf("%s: decodeBatch() = %q; want %q", tc.name, got, tc.want)
+		}
+	}
+}
+
+// describeBatchRequest describes the request like "1/3 rational simplify", with the set fields only.
+func describeBatchRequest(request batchRequest) string {
+	parts := []string{request.Expression}
+	if request.ClientID != "" {
+		parts = append(parts, request.ClientID)
+	}
+	if request.Tags != nil {
+		parts = append(parts, fmt.Sprint(request.Tags))
+	}
+	if request.Mode != "" {
+		parts = append(parts, request.Mode)
+	}
+	if request.Simplify {
+		parts = append(parts, "simplify")
+	}
+	return strings.Join(parts, " ")
+}
+
+func TestDecodeBatchLimits(t *testing.T) {
+	// A stream longer than maxBatchSize is read up to one expression more, so that the handler can reject it
+	body := strings.Repeat("{\"expression\": \"1\"}\n", maxBatchSize+10)
+	requests, err := decodeBatch(strings.NewReader(body))
+	if err != nil || len(requests) != maxBatchSize+1 {
+		t.Errorf("decodeBatch() of %d expressions = %d expressions, %v; want %d", maxBatchSize+10, len(requests), err, maxBatchSize+1)
+	}
+
+	// The body is cut by the size limit of the handler
+	body = "[" + strings.Repeat(`{"expression": "1"},`, maxBatchBodySize/20) + `{"expression": "1"}]`
+	recorder := httptest.NewRecorder()
+	_, err = decodeBatch(http.MaxBytesReader(recorder, io.NopCloser(strings.NewReader(body)), maxBatchBodySize))
+	var tooLarge *http.MaxBytesError
+	if !errors.As(err, &tooLarge) {
+		t.Errorf("decodeBatch() of %d bytes returned error %v; want *http.MaxBytesError", len(body), err)
+	}
+}
@@ -0,0 +1,350 @@
+package main
+
+import (
+	"DistributedCalculator/agent"
+	"DistributedCalculator/db"
+	"bytes"
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// maxImportSize limits the size of an imported file in bytes.
+const maxImportSize = 10 << 20
+
+// csvDelimiters are the delimiters of the imported and exported files by name.
+var csvDelimiters = map[string]rune{
+	"comma":     ',',
+	"semicolon": ';',
+	"tab":       '\t',
+}
+
+// spreadsheetBooleans are the values of the flags written by the spreadsheets in addition to the ones of strconv.ParseBool.
+var spreadsheetBooleans = map[string]bool{
+	"":       false,
+	"yes":    true,
+	"no":     false,
+	"да":     true,
+	"нет":    false,
+	"истина": true,
+	"ложь":   false,
+}
+
+// readExpressionsCSV reads the expressions of an imported CSV file.
+// The first row is the header, the columns are matched by their names and only the expression column is required:
+//   - expression — the expression or the script
+//   - id — the id given by the client, client_id is the same
+//   - tags — the tags separated with commas, semicolons or spaces
+//   - callback_url — the URL notified when the expression is finished
+//   - mode, precision, rebalance, implicit_multiplication and simplify — the options of the calculate request
+//
+// The delimiter is a comma, a semicolon or a tab, the one that gives the expression column in the header.
+// Empty rows are skipped, a row with more cells than the header is an error: the cells with the delimiter must be quoted.
+func readExpressionsCSV(r io.Reader) ([]batchRequest, error) {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	// Spreadsheets start the UTF-8 files with the byte order mark
+	data = bytes.TrimPrefix(data, []byte("\xef\xbb\xbf"))
+	reader, columns, width, err := csvHeader(data)
+	if err != nil {
+		return nil, err
+	}
+
+	var requests []batchRequest
+	for {
+		record, err := reader.Read()
+		if err == io.EOF {
+			return requests, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		line, _ := reader.FieldPos(0)
+		cell := func(name string) string {
+			i, ok := columns[name]
+			if !ok || i >= len(record) {
+				return ""
+			}
+			return strings.TrimSpace(record[i])
+		}
+		if strings.TrimSpace(strings.Join(record, "")) == "" {
+			continue
+		}
+		// An unquoted "1,5+2" or "max(1,2)" would otherwise be cut at the delimiter
+		if len(record) > width {
+			return nil, fmt.Errorf("line %d: %d cells, the header has %d; quote the cells with %q", line, len(record), width, reader.Comma)
+		}
+
+		request := batchRequest{line: line}
+		request.Expression = cell("expression")
+		request.ClientID = cell("id")
+		if request.ClientID == "" {
+			request.ClientID = cell("client_id")
+		}
+		request.Tags = strings.FieldsFunc(cell("tags"), func(r rune) bool {
+			return r == ',' || r == ';' || r == ' ' || r == '\t'
+		})
+		request.CallbackURL = cell("callback_url")
+		request.Mode = cell("mode")
+		if precision := cell("precision"); precision != "" {
+			if request.Precision, err = strconv.Atoi(precision); err != nil {
+				return nil, fmt.Errorf("line %d: invalid precision %q", line, precision)
+			}
+		}
+		for name, flag := range map[string]*bool{
+			"rebalance":               &request.Rebalance,
+			"implicit_multiplication": &request.ImplicitMultiplication,
+			"simplify":                &request.Simplify,
+		} {
+			if *flag, err = parseSpreadsheetBool(cell(name)); err != nil {
+				return nil, fmt.Errorf("line %d: invalid %s %q", line, name, cell(name))
+			}
+		}
+		requests = append(requests, request)
+		if len(requests) > maxBatchSize {
+			return nil, fmt.Errorf("a file has at most %d expressions", maxBatchSize)
+		}
+	}
+}
+
+// csvHeader detects the delimiter of the file by its header and reads the header.
+// It returns the reader positioned after the header, the indices of the columns by their lowercase names
+// and the number of the columns.
+func csvHeader(data []byte) (*csv.Reader, map[string]int, int, error) {
+	for _, delimiter := range []rune{',', ';', '\t'} {
+		reader := csv.NewReader(bytes.NewReader(data))
+		reader.Comma = delimiter
+		reader.FieldsPerRecord = -1
+		reader.TrimLeadingSpace = true
+		header, err := reader.Read()
+		if err != nil {
+			continue
+		}
+		columns := make(map[string]int)
+		for i, name := range header {
+			columns[strings.ToLower(strings.TrimSpace(name))] = i
+		}
+		if _, ok := columns["expression"]; ok {
+			return reader, columns, len(header), nil
+		}
+	}
+	return nil, nil, 0, errors.New("the first row must be the header with the expression column")
+}
+
+// parseSpreadsheetBool parses a flag, an empty cell is false.
+func parseSpreadsheetBool(value string) (bool, error) {
+	if b, ok := spreadsheetBooleans[strings.ToLower(value)]; ok {
+		return b, nil
+	}
+	return strconv.ParseBool(value)
+}
+
+// importedFile returns the uploaded CSV file: the "file" field of a multipart form or the whole body.
+func importedFile(w http.ResponseWriter, r *http.Request) (io.Reader, error) {
+	r.Body = http.MaxBytesReader(w, r.Body, maxImportSize)
+	if !strings.HasPrefix(r.Header.Get("Content-Type"), "multipart/form-data") {
+		return r.Body, nil
+	}
+	file, _, err := r.FormFile("file")
+	if err != nil {
+		return nil, err
+	}
+	return file, nil
+}
+
+// importCSV queues the expressions of the uploaded CSV file of the user as a batch.
+// It returns the id of the batch, which is 0 if no expression is valid, and the outcome of every row.
+// A malformed file is an error with the status 400.
+func importCSV(w http.ResponseWriter, r *http.Request, database *db.DB, userId int) (int, []batchItem, int, error) {
+	file, err := importedFile(w, r)
+	if err != nil {
+		return 0, nil, http.StatusBadRequest, err
+	}
+	requests, err := readExpressionsCSV(file)
+	if err != nil {
+		return 0, nil, http.StatusBadRequest, err
+	}
+	if len(requests) == 0 {
+		return 0, nil, http.StatusBadRequest, errors.New("the file has no expressions")
+	}
+	batchId, items, err := queueBatch(database, userId, requests)
+	if err != nil {
+		return 0, nil, http.StatusInternalServerError, errors.New("failed to add equations to database")
+	}
+	return batchId, items, batchStatusCode(batchId), nil
+}
+
+// ImportAPIHandler handles "POST /api/v1/import".
+// The body is a CSV file, see readExpressionsCSV, either as it is or as the "file" field of a multipart form.
+// The expressions are queued as a batch, the response is the one of "POST /api/v1/calculate/batch"
+// with the items in the order of the rows.
+func ImportAPIHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "Invalid request method", http.StatusMethodNotAllowed)
+		return
+	}
+
+	userLogin, isAuth := getUserLogin(r)
+	if !isAuth {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	database, err := db.Connect("data.db")
+	if err != nil {
+		http.Error(w, "Failed to connect to database", http.StatusInternalServerError)
+		return
+	}
+	defer database.Close()
+
+	userId, err := database.GetUserID(userLogin)
+	if err != nil {
+		http.Error(w, "User not found", http.StatusNotFound)
+		return
+	}
+
+	batchId, items, status, err := importCSV(w, r, database, userId)
+	if err != nil {
+		http.Error(w, err.Error(), status)
+		return
+	}
+	writeJSON(w, status, batchResponse(batchId, items))
+}
+
+// exportedEquation is an equation of the export.
+type exportedEquation struct {
+	ID         int      `json:"id"`
+	ClientID   string   `json:"client_id,omitempty"`
+	Tags       []string `json:"tags,omitempty"`
+	Expression string   `json:"expression"`
+	// Status is "In queue", "Waiting", "Computing", "Computed" or "Error", the message of the error is in Error.
+	Status     string `json:"status"`
+	Result     string `json:"result,omitempty"`
+	Error      string `json:"error,omitempty"`
+	CreatedAt  string `json:"created_at,omitempty"`
+	FinishedAt string `json:"finished_at,omitempty"`
+}
+
+// exportColumns are the header of the exported CSV file.
+var exportColumns = []string{"id", "client_id", "tags", "expression", "status", "result", "error", "created_at", "finished_at"}
+
+// record returns the row of the exported CSV file.
+func (e exportedEquation) record() []string {
+	return []string{strconv.Itoa(e.ID), e.ClientID, strings.Join(e.Tags, ","), e.Expression, e.Status, e.Result, e.Error, e.CreatedAt, e.FinishedAt}
+}
+
+// exportEquation describes the equation for the export, the result is formatted with the format.
+func exportEquation(equation db.Equation, format agent.NumberFormat) exportedEquation {
+	exported := exportedEquation{
+		ID:         equation.ID,
+		ClientID:   equation.ClientID,
+		Tags:       equation.Tags,
+		Expression: equation.Text,
+		Status:     equation.Status,
+		CreatedAt:  exportTime(equation.CreatedAt),
+		FinishedAt: exportTime(equation.FinishedAt),
+	}
+	switch {
+	case equation.Status == "Computed":
+		exported.Result = format.Format(resultText(equation.ResultText, equation.Result))
+	case strings.HasPrefix(equation.Status, "Error"):
+		exported.Status = "Error"
+		exported.Error = strings.TrimSpace(strings.TrimPrefix(equation.Status, "Error"))
+	case equation.Status == "in queue":
+		exported.Status = "In queue"
+	}
+	return exported
+}
+
+// exportTime formats the Unix time in seconds as RFC 3339 in UTC, the zero time is empty.
+func exportTime(seconds int64) string {
+	if seconds == 0 {
+		return ""
+	}
+	return time.Unix(seconds, 0).UTC().Format(time.RFC3339)
+}
+
+// ExportAPIHandler handles "GET /api/v1/export".
+// It downloads all expressions of the authorized user with their statuses, results, errors and timestamps.
+// Query parameters:
+//   - format — csv (the default) or json
+//   - delimiter — the delimiter of the CSV file: comma (the default), semicolon or tab
+//   - the number format of the results, like in "/get/{id}", for example decimal=comma
+func ExportAPIHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "Invalid request method", http.StatusMethodNotAllowed)
+		return
+	}
+
+	userLogin, isAuth := getUserLogin(r)
+	if !isAuth {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	query := r.URL.Query()
+	format, err := agent.ParseNumberFormat(query, agent.DefaultNumberFormat)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	delimiter := ','
+	if name := query.Get("delimiter"); name != "" {
+		var ok bool
+		if delimiter, ok = csvDelimiters[name]; !ok {
+			http.Error(w, fmt.Sprintf("unknown delimiter %q", name), http.StatusBadRequest)
+			return
+		}
+	}
+	fileFormat := query.Get("format")
+	if fileFormat == "" {
+		fileFormat = "csv"
+	}
+	if fileFormat != "csv" && fileFormat != "json" {
+		http.Error(w, fmt.Sprintf("unknown format %q", fileFormat), http.StatusBadRequest)
+		return
+	}
+
+	database, err := db.Connect("data.db")
+	if err != nil {
+		http.Error(w, "Failed to connect to database", http.StatusInternalServerError)
+		return
+	}
+	defer database.Close()
+
+	userId, err := database.GetUserID(userLogin)
+	if err != nil {
+		http.Error(w, "User not found", http.StatusNotFound)
+		return
+	}
+	equations, err := database.GetUserEquations(userId)
+	if err != nil {
+		http.Error(w, "Failed to get equations", http.StatusInternalServerError)
+		return
+	}
+	exported := make([]exportedEquation, len(equations))
+	for i, equation := range equations {
+		exported[i] = exportEquation(equation, format)
+	}
+
+	w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="expressions.%s"`, fileFormat))
+	if fileFormat == "json" {
+		writeJSON(w, http.StatusOK, exported)
+		return
+	}
+	w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+	writer := csv.NewWriter(w)
+	writer.Comma = delimiter
+	_ = writer.Write(exportColumns)
+	for _, equation := range exported {
+		_ = writer.Write(equation.record())
+	}
+	writer.Flush()
+}
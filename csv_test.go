@@ -0,0 +1,178 @@
+package main
+
+import (
+	"DistributedCalculator/agent"
+	"DistributedCalculator/db"
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func TestCSVHeader(t *testing.T) {
+	testCases := []struct {
+		name    string
+		data    string
+		columns string
+		width   int
+		err     bool
+	}{
+		{"comma", "expression,id,tags\n1+2,a,x\n", "map[expression:0 id:1 tags:2]", 3, false},
+		{"semicolon", "id;Expression;mode\na;1+2;float\n", "map[expression:1 id:0 mode:2]", 3, false},
+		{"tab", "expression\tprecision\n1+2\t3\n", "map[expression:0 precision:1]", 2, false},
+		// The names are trimmed and lowercased, the quoted names are read too
+		{"spaces and case", " ID , EXPRESSION \n", "map[expression:1 id:0]", 2, false},
+		{"quoted", "\"expression\",\"tags\"\n", "map[expression:0 tags:1]", 2, false},
+		// The comma is tried first, the other delimiters only if it gives no expression column
+		{"comma before semicolon", "expression,a;b\n", "map[a;b:1 expression:0]", 2, false},
+		{"only the expression column", "expression\n", "map[expression:0]", 1, false},
+		{"repeated column", "expression,tags,tags\n", "map[expression:0 tags:2]", 3, false},
+		{"no expression column", "id,tags\n", "", 0, true},
+		{"empty", "", "", 0, true},
+	}
+
+	for _, tc := range testCases {
+		reader, columns, width, err := csvHeader([]byte(tc.data))
+		if tc.err {
+			if err == nil {
+				t.Errorf("%s: csvHeader() = %v; want an error", tc.name, columns)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: csvHeader() returned error %v", tc.name, err)
+			continue
+		}
+		if got := fmt.Sprint(columns); got != tc.columns {
+			t.Errorf("%s: csvHeader() columns = %s; want %s", tc.name, got, tc.columns)
+		}
+		if width != tc.width {
+			t.Errorf("%s: csvHeader() width = %d; want %d", tc.name, width, tc.width)
+		}
+		if reader == nil {
+			t.Errorf("%s: csvHeader() returned no reader", tc.name)
+		}
+	}
+}
+
+func TestReadExpressionsCSV(t *testing.T) {
+	testCases := []struct {
+		name string
+		data string
+		want []string
+		err  string
+	}{
+		{"comma", "expression,id,tags\n1+2,a,\"x,y\"\n3*4,b,z\n",
+			[]string{"2: 1+2 id=a tags=[x y]", "3: 3*4 id=b tags=[z]"}, ""},
+		{"semicolon with decimal commas", "id;expression\na;1,5+2\n",
+			[]string{"2: 1,5+2 id=a"}, ""},
+		{"tab", "expression\ttags\n1+2\tx y;z\n",
+			[]string{"2: 1+2 tags=[x y z]"}, ""},
+		{"byte order mark", "\xef\xbb\xbfexpression,client_id\n1+2,a\n",
+			[]string{"2: 1+2 id=a"}, ""},
+		// The empty rows are skipped, the lines are the lines of the file
+		{"empty rows", "expression,id\n\n1+2,a\n,\n3,b\n",
+			[]string{"3: 1+2 id=a", "5: 3 id=b"}, ""},
+		{"options", "expression,mode,precision,callback_url\n1/3,decimal,5,https://example.com/hook\n",
+			[]string{"2: 1/3 mode=decimal precision=5 callback_url=https://example.com/hook"}, ""},
+		// The flags take the values of strconv.ParseBool and of the spreadsheets, in English and Russian
+		{"booleans", "expression,rebalance,implicit_multiplication,simplify\n" +
+			"1,true,1,TRUE\n2,yes,Yes,да\n3,Да,ИСТИНА,истина\n4,no,нет,ложь\n5,false,0,\n",
+			[]string{"2: 1 rebalance implicit_multiplication simplify", "3: 2 rebalance implicit_multiplication simplify",
+				"4: 3 rebalance implicit_multiplication simplify", "5: 4", "6: 5"}, ""},
+		{"invalid boolean", "expression,simplify\n1+2,maybe\n", nil, `line 2: invalid simplify "maybe"`},
+		{"invalid precision", "expression,precision\n1+2,many\n", nil, `line 2: invalid precision "many"`},
+		{"no header", "1+2\n", nil, "the first row must be the header with the expression column"},
+		// The delimiter in an unquoted cell makes more cells than the header has
+		{"unquoted decimal comma", "expression\n1,5+2\n", nil, `line 2: 2 cells, the header has 1; quote the cells with ','`},
+		{"unquoted arguments", "expression,id\n\"1,5+2\",a\nmax(1,2),b\n", nil, `line 3: 3 cells, the header has 2; quote the cells with ','`},
+		{"quoted commas", "expression\n\"1,5+2\"\n\"max(1,2)\"\n", []string{"2: 1,5+2", "3: max(1,2)"}, ""},
+		{"fewer cells", "expression,id,tags\n1+2\n", []string{"2: 1+2"}, ""},
+		{"unclosed quote", "expression\n\"1+2\n", nil, `parse error on line 2, column 6: extraneous or missing " in quoted-field`},
+	}
+
+	for _, tc := range testCases {
+		requests, err := readExpressionsCSV(strings.NewReader(tc.data))
+		if tc.err != "" {
+			if err == nil || err.Error() != tc.err {
+				t.Errorf("%s: readExpressionsCSV() returned error %v; want %s", tc.name, err, tc.err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: readExpressionsCSV() returned error %v", tc.name, err)
+			continue
+		}
+		got := make([]string, len(requests))
+		for i, request := range requests {
+			got[i] = describeImportedRequest(request)
+		}
+		if fmt.Sprint(got) != fmt.Sprint(tc.want) {
+			t.Errorf("%s: readExpressionsCSV() = %q; want %q", tc.name, got, tc.want)
+		}
+	}
+}
+
+// describeImportedRequest describes the request read from a file like "2: 1+2 id=a tags=[x]", with the set fields only.
+func describeImportedRequest(request batchRequest) string {
+	parts := []string{fmt.Sprintf("%d: %s", request.line, request.Expression)}
+	if request.ClientID != "" {
+		parts = append(parts, "id="+request.ClientID)
+	}
+	if len(request.Tags) > 0 {
+		parts = append(parts, fmt.Sprintf("tags=%v", request.Tags))
+	}
+	if request.Mode != "" {
+		parts = append(parts, "mode="+request.Mode)
+	}
+	if request.Precision != 0 {
+		parts = append(parts, fmt.Sprintf("precision=%d", request.Precision))
+	}
+	if request.CallbackURL != "" {
+		parts = append(parts, "callback_url="+request.CallbackURL)
+	}
+	for _, flag := range []struct {
+		name string
+		set  bool
+	}{
+		{"rebalance", request.Rebalance},
+		{"implicit_multiplication", request.ImplicitMultiplication},
+		{"simplify", request.Simplify},
+	} {
+		if flag.set {
+			parts = append(parts, flag.name)
+		}
+	}
+	return strings.Join(parts, " ")
+}
+
+func TestExportEquation(t *testing.T) {
+	// The columns are separated with "|"
+	testCases := []struct {
+		equation db.Equation
+		format   agent.NumberFormat
+		want     string
+	}{
+		{db.Equation{ID: 1, Text: "2+2*2", Status: "Computed", Result: 6, ResultText: "6", ClientID: "a", Tags: []string{"x", "y"},
+			CreatedAt: 1700000000, FinishedAt: 1700000001}, agent.DefaultNumberFormat,
+			"1|a|x,y|2+2*2|Computed|6||2023-11-14T22:13:20Z|2023-11-14T22:13:21Z"},
+		// The result is formatted from its exact text, the older results only have the float
+		{db.Equation{ID: 2, Text: "1/3", Status: "Computed", Result: 0.3333333333333333, ResultText: "1/3"}, agent.DefaultNumberFormat,
+			"2|||1/3|Computed|1/3|||"},
+		{db.Equation{ID: 3, Text: "1234.5*1", Status: "Computed", Result: 1234.5}, pageNumberFormat,
+			"3|||1234.5*1|Computed|1\u00a0234,5|||"},
+		// The message of an error is in its own column
+		{db.Equation{ID: 4, Text: "1/0", Status: "Error division by zero", CreatedAt: 1700000000}, agent.DefaultNumberFormat,
+			"4|||1/0|Error||division by zero|2023-11-14T22:13:20Z|"},
+		{db.Equation{ID: 5, Text: "1+2", Status: "in queue"}, agent.DefaultNumberFormat,
+			"5|||1+2|In queue||||"},
+		{db.Equation{ID: 6, Text: "#5*2", Status: "Cancelled"}, agent.DefaultNumberFormat,
+			"6|||#5*2|Cancelled||||"},
+	}
+
+	for _, tc := range testCases {
+		got := strings.Join(exportEquation(tc.equation, tc.format).record(), "|")
+		if got != tc.want {
+			t.Errorf("exportEquation(%d).record() = %q; want %q", tc.equation.ID, got, tc.want)
+		}
+	}
+}
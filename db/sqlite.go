@@ -5,12 +5,80 @@ import (
 	"errors"
 	_ "github.com/mattn/go-sqlite3"
 	"strconv"
+	"strings"
+	"time"
 )
 
 type DB struct {
 	*sql.DB
 }
 
+// Equation is a row of the Equations table.
+type Equation struct {
+	ID      int
+	Text    string
+	Status  string
+	Result  float64
+	UserID  int
+	Options string
+	// The other fields are only read by GetBatchEquations and GetUserEquations.
+	// ResultText is the exact result.
+	ResultText string
+	// ClientID and Tags are given by the client that imported the equation.
+	ClientID string
+	Tags     []string
+	// CreatedAt and FinishedAt are Unix times in seconds, FinishedAt is 0 until the equation is computed, has failed or is cancelled.
+	CreatedAt  int64
+	FinishedAt int64
+}
+
+// NewEquation is an equation inserted by AddBatch, with its evaluation options and values of variables.
+type NewEquation struct {
+	Text      string
+	Options   string
+	Variables string
+	// ClientID, Tags and CallbackURL are optional.
+	ClientID    string
+	Tags        []string
+	CallbackURL string
+}
+
+// Webhook is a row of the Webhooks table, a URL notified about every finished equation of the user.
+type Webhook struct {
+	ID        int
+	UserID    int
+	URL       string
+	CreatedAt int64
+}
+
+// The statuses of the webhook deliveries.
+const (
+	DeliveryPending   = "pending"
+	DeliveryDelivered = "delivered"
+	DeliveryFailed    = "failed"
+)
+
+// WebhookDelivery is a row of the WebhookDeliveries table, the notification of a URL about a finished equation.
+type WebhookDelivery struct {
+	ID         int
+	UserID     int
+	EquationID int
+	// WebhookID is the webhook of the user, or 0 for the callback URL of the equation.
+	WebhookID int
+	URL       string
+	Event     string
+	Payload   string
+	// Status is DeliveryPending until the delivery succeeds or runs out of attempts.
+	Status       string
+	Attempts     int
+	ResponseCode int
+	Error        string
+	// CreatedAt, UpdatedAt and NextAttemptAt are Unix times in seconds.
+	CreatedAt     int64
+	UpdatedAt     int64
+	NextAttemptAt int64
+}
+
 func (db *DB) Init() error {
 	_, err := db.Exec("CREATE TABLE IF NOT EXISTS Operations (type TEXT PRIMARY KEY, duration INTEGER)")
 	if err != nil {
@@ -20,37 +88,146 @@ func (db *DB) Init() error {
 	if err != nil {
 		return err
 	}
-	_, err = db.Exec("INSERT OR IGNORE INTO Operations (type, duration) VALUES ('+', 1)")
+	// Every operation takes 1 ms until it is changed; comparisons, logical operators and built-in functions are operations too
+	for _, operation := range []string{"+", "-", "*", "/", "^", "%", "//", "neg", "pos",
+		"<", "<=", "==", "!=", ">", ">=", "&&", "||", "not", "sqrt", "abs", "min", "max", "round", "log", "if"} {
+		_, err = db.Exec("INSERT OR IGNORE INTO Operations (type, duration) VALUES (?, 1)", operation)
+		if err != nil {
+			return err
+		}
+	}
+	_, err = db.Exec("CREATE TABLE IF NOT EXISTS ResultCache (key TEXT PRIMARY KEY, result REAL, created_at INTEGER)")
 	if err != nil {
 		return err
 	}
-	_, err = db.Exec("INSERT OR IGNORE INTO Operations (type, duration) VALUES ('-', 1)")
+	err = db.AddUsersTable()
+	_, err = db.Exec(`CREATE TABLE IF NOT EXISTS Equations (
+		ID INTEGER PRIMARY KEY AUTOINCREMENT, 
+		text TEXT, 
+		status TEXT, 
+		result REAL,
+		user_id INTEGER,
+		options TEXT,
+		variables TEXT,
+		result_text TEXT,
+		bindings TEXT,
+		FOREIGN KEY(user_id) REFERENCES Users(id)
+	)`)
 	if err != nil {
 		return err
 	}
-	_, err = db.Exec("INSERT OR IGNORE INTO Operations (type, duration) VALUES ('*', 1)")
+	// Databases created by older versions miss the newer columns
+	err = db.addColumn("Equations", "options", "TEXT")
 	if err != nil {
 		return err
 	}
-	_, err = db.Exec("INSERT OR IGNORE INTO Operations (type, duration) VALUES ('/', 1)")
+	err = db.addColumn("Equations", "variables", "TEXT")
 	if err != nil {
 		return err
 	}
-	err = db.AddUsersTable()
-	_, err = db.Exec(`CREATE TABLE IF NOT EXISTS Equations (
-		ID INTEGER PRIMARY KEY AUTOINCREMENT, 
-		text TEXT, 
-		status TEXT, 
-		result REAL,
+	err = db.addColumn("Equations", "result_text", "TEXT")
+	if err != nil {
+		return err
+	}
+	err = db.addColumn("Equations", "bindings", "TEXT")
+	if err != nil {
+		return err
+	}
+	err = db.addColumn("Equations", "batch_id", "INTEGER")
+	if err != nil {
+		return err
+	}
+	err = db.addColumn("Equations", "client_id", "TEXT")
+	if err != nil {
+		return err
+	}
+	err = db.addColumn("Equations", "tags", "TEXT")
+	if err != nil {
+		return err
+	}
+	err = db.addColumn("Equations", "created_at", "INTEGER")
+	if err != nil {
+		return err
+	}
+	err = db.addColumn("Equations", "finished_at", "INTEGER")
+	if err != nil {
+		return err
+	}
+	_, err = db.Exec(`CREATE TABLE IF NOT EXISTS Batches (
+		ID INTEGER PRIMARY KEY AUTOINCREMENT,
+		user_id INTEGER,
+		created_at INTEGER,
+		FOREIGN KEY(user_id) REFERENCES Users(id)
+	)`)
+	if err != nil {
+		return err
+	}
+	_, err = db.Exec(`CREATE TABLE IF NOT EXISTS Variables (
+		user_id INTEGER,
+		name TEXT,
+		value REAL,
+		PRIMARY KEY(user_id, name),
+		FOREIGN KEY(user_id) REFERENCES Users(id)
+	)`)
+	if err != nil {
+		return err
+	}
+	err = db.addColumn("Equations", "callback_url", "TEXT")
+	if err != nil {
+		return err
+	}
+	err = db.addColumn("Users", "webhook_secret", "TEXT")
+	if err != nil {
+		return err
+	}
+	_, err = db.Exec(`CREATE TABLE IF NOT EXISTS Webhooks (
+		ID INTEGER PRIMARY KEY AUTOINCREMENT,
 		user_id INTEGER,
+		url TEXT,
+		created_at INTEGER,
 		FOREIGN KEY(user_id) REFERENCES Users(id)
 	)`)
 	if err != nil {
 		return err
 	}
+	_, err = db.Exec(`CREATE TABLE IF NOT EXISTS WebhookDeliveries (
+		ID INTEGER PRIMARY KEY AUTOINCREMENT,
+		user_id INTEGER,
+		equation_id INTEGER,
+		webhook_id INTEGER,
+		url TEXT,
+		event TEXT,
+		payload TEXT,
+		status TEXT,
+		attempts INTEGER,
+		response_code INTEGER,
+		error TEXT,
+		created_at INTEGER,
+		updated_at INTEGER,
+		next_attempt_at INTEGER,
+		FOREIGN KEY(user_id) REFERENCES Users(id),
+		FOREIGN KEY(equation_id) REFERENCES Equations(ID)
+	)`)
+	if err != nil {
+		return err
+	}
+	// The deliveries of an equation are looked up for every finished equation, see GetUnrecordedWebhookEquations
+	_, err = db.Exec("CREATE INDEX IF NOT EXISTS WebhookDeliveriesEquation ON WebhookDeliveries (equation_id, webhook_id)")
+	if err != nil {
+		return err
+	}
 	return nil
 }
 
+// addColumn adds a column to an existing table, doing nothing if the column already exists.
+func (db *DB) addColumn(tableName, column, definition string) error {
+	_, err := db.Exec("ALTER TABLE " + tableName + " ADD COLUMN " + column + " " + definition)
+	if err != nil && strings.HasPrefix(err.Error(), "duplicate column name") {
+		return nil
+	}
+	return err
+}
+
 func (db *DB) AddUsersTable() error {
 	_, err := db.Exec(`CREATE TABLE IF NOT EXISTS Users (
 		id INTEGER PRIMARY KEY AUTOINCREMENT,
@@ -181,14 +358,14 @@ func (db *DB) GetAllValues(tableName string) ([]map[string]interface{}, error) {
 	return result, nil
 }
 
-// AddEquation adds a new row with the given text to the specified table.
+// AddEquation adds a new row with the given text, evaluation options and values of variables to the specified table.
 // If the id is 0, it auto-increments the id.
 // If the id is not 0, it inserts the equation with the given id, or ignores it if the id already exists in the table.
-func (db *DB) AddEquation(id int, text string, tableName string, user_id int) (int, error) {
+func (db *DB) AddEquation(id int, text string, tableName string, user_id int, options string, variables string) (int, error) {
 	// Prepare the SQL statement
 	if id == 0 {
 		// If id is 0, prepare an SQL statement to insert the equation text with an auto-incremented id
-		stmt, err := db.Prepare("INSERT INTO " + tableName + " (text, status, result, user_id) VALUES (?, ?, ?, ?)")
+		stmt, err := db.Prepare("INSERT INTO " + tableName + " (text, status, result, user_id, options, variables, created_at) VALUES (?, ?, ?, ?, ?, ?, ?)")
 		if err != nil {
 			return 0, err
 		}
@@ -200,7 +377,7 @@ func (db *DB) AddEquation(id int, text string, tableName string, user_id int) (i
 		}(stmt)
 
 		// Execute the SQL statement
-		_, err = stmt.Exec(text, "In queue", 0, user_id)
+		_, err = stmt.Exec(text, "In queue", 0, user_id, options, variables, time.Now().Unix())
 		if err != nil {
 			return 0, err
 		}
@@ -222,7 +399,7 @@ func (db *DB) AddEquation(id int, text string, tableName string, user_id int) (i
 		return 0, nil
 	} else {
 		// If id is not 0, prepare an SQL statement to insert the equation with the given id, or ignore it if the id already exists
-		stmt, err := db.Prepare("INSERT OR IGNORE INTO " + tableName + " (ID, text, status, result, user_id) VALUES (?, ?, ?, ?, ?)")
+		stmt, err := db.Prepare("INSERT OR IGNORE INTO " + tableName + " (ID, text, status, result, user_id, options, variables, created_at) VALUES (?, ?, ?, ?, ?, ?, ?, ?)")
 		if err != nil {
 			return 0, err
 		}
@@ -234,7 +411,7 @@ func (db *DB) AddEquation(id int, text string, tableName string, user_id int) (i
 		}(stmt)
 
 		// Execute the SQL statement
-		_, err = stmt.Exec(id, text, "in queue", 0, user_id)
+		_, err = stmt.Exec(id, text, "in queue", 0, user_id, options, variables, time.Now().Unix())
 		if err != nil {
 			return 0, err
 		}
@@ -398,7 +575,12 @@ func (db *DB) UpdateComputer(id int, equationID int) error {
 }
 
 func (db *DB) UpdateEquation(id int, status string, result float64) error {
-	stmt, err := db.Prepare("UPDATE Equations SET status = ?, result = ? WHERE ID = ?")
+	// A failed or cancelled equation is finished
+	var finishedAt interface{}
+	if strings.HasPrefix(status, "Error") || status == "Cancelled" {
+		finishedAt = time.Now().Unix()
+	}
+	stmt, err := db.Prepare("UPDATE Equations SET status = ?, result = ?, finished_at = ? WHERE ID = ?")
 	if err != nil {
 		return err
 	}
@@ -408,13 +590,47 @@ func (db *DB) UpdateEquation(id int, status string, result float64) error {
 			return
 		}
 	}(stmt)
-	_, err = stmt.Exec(status, result, id)
+	_, err = stmt.Exec(status, result, finishedAt, id)
 	if err != nil {
 		return err
 	}
 	return nil
 }
 
+// SetEquationResult marks the equation as computed and stores its result.
+// The text keeps the exact result, the number is its nearest float64.
+func (db *DB) SetEquationResult(id int, result float64, text string) error {
+	_, err := db.Exec("UPDATE Equations SET status = 'Computed', result = ?, result_text = ?, finished_at = ? WHERE ID = ?", result, text, time.Now().Unix(), id)
+	return err
+}
+
+// SetEquationBindings stores the values of the variables assigned in the script of the equation as JSON.
+func (db *DB) SetEquationBindings(id int, bindings string) error {
+	_, err := db.Exec("UPDATE Equations SET bindings = ? WHERE ID = ?", bindings, id)
+	return err
+}
+
+// GetEquationBindings returns the values of the variables assigned in the script of the equation as JSON,
+// or an empty string if there are none.
+func (db *DB) GetEquationBindings(id int) string {
+	var bindings sql.NullString
+	err := db.QueryRow("SELECT bindings FROM Equations WHERE ID = ?", id).Scan(&bindings)
+	if err != nil {
+		return ""
+	}
+	return bindings.String
+}
+
+// GetEquationResultText returns the exact result of the equation as text, or an empty string if it is not computed.
+func (db *DB) GetEquationResultText(id int) string {
+	var text sql.NullString
+	err := db.QueryRow("SELECT result_text FROM Equations WHERE ID = ?", id).Scan(&text)
+	if err != nil {
+		return ""
+	}
+	return text.String
+}
+
 func (db *DB) GetOperationTime(operation string) (int, error) {
 	rows, err := db.Query("SELECT duration FROM Operations WHERE type = ?", operation)
 	if err != nil {
@@ -437,6 +653,57 @@ func (db *DB) GetOperationTime(operation string) (int, error) {
 	return duration, nil
 }
 
+// GetOperationTimes returns the duration of every operation keyed by its type.
+func (db *DB) GetOperationTimes() (map[string]int, error) {
+	rows, err := db.Query("SELECT type, duration FROM Operations")
+	if err != nil {
+		return nil, err
+	}
+	defer func(rows *sql.Rows) {
+		err = rows.Close()
+		if err != nil {
+			return
+		}
+	}(rows)
+
+	durations := make(map[string]int)
+	for rows.Next() {
+		var opType string
+		var duration int
+		if err = rows.Scan(&opType, &duration); err != nil {
+			return nil, err
+		}
+		durations[opType] = duration
+	}
+	return durations, rows.Err()
+}
+
+// GetCachedResult looks up a cached result by its key.
+// Entries created before notBefore (unix seconds) are treated as missing.
+func (db *DB) GetCachedResult(key string, notBefore int64) (float64, bool, error) {
+	var result float64
+	err := db.QueryRow("SELECT result FROM ResultCache WHERE key = ? AND created_at >= ?", key, notBefore).Scan(&result)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return 0, false, nil
+		}
+		return 0, false, err
+	}
+	return result, true, nil
+}
+
+// AddCachedResult stores a result in the cache, replacing any previous entry with the same key.
+func (db *DB) AddCachedResult(key string, result float64, createdAt int64) error {
+	_, err := db.Exec("INSERT OR REPLACE INTO ResultCache (key, result, created_at) VALUES (?, ?, ?)", key, result, createdAt)
+	return err
+}
+
+// TrimResultCache removes the oldest entries so that at most size entries are left.
+func (db *DB) TrimResultCache(size int) error {
+	_, err := db.Exec("DELETE FROM ResultCache WHERE key NOT IN (SELECT key FROM ResultCache ORDER BY created_at DESC LIMIT ?)", size)
+	return err
+}
+
 func (db *DB) GetEquationText(id int) string {
 	rows, err := db.Query("SELECT text FROM Equations WHERE ID = ?", id)
 	if err != nil {
@@ -459,8 +726,71 @@ func (db *DB) GetEquationText(id int) string {
 	return ""
 }
 
+// GetEquationOptions returns the evaluation options stored with the equation as JSON.
+func (db *DB) GetEquationOptions(id int) string {
+	var options sql.NullString
+	err := db.QueryRow("SELECT options FROM Equations WHERE ID = ?", id).Scan(&options)
+	if err != nil {
+		return ""
+	}
+	return options.String
+}
+
+// GetEquationVariables returns the values of the variables stored with the equation as JSON.
+func (db *DB) GetEquationVariables(id int) string {
+	var variables sql.NullString
+	err := db.QueryRow("SELECT variables FROM Equations WHERE ID = ?", id).Scan(&variables)
+	if err != nil {
+		return ""
+	}
+	return variables.String
+}
+
+// GetVariables returns the variables of the user by name.
+func (db *DB) GetVariables(userId int) (map[string]float64, error) {
+	rows, err := db.Query("SELECT name, value FROM Variables WHERE user_id = ?", userId)
+	if err != nil {
+		return nil, err
+	}
+	defer func(rows *sql.Rows) {
+		err = rows.Close()
+		if err != nil {
+			return
+		}
+	}(rows)
+
+	variables := make(map[string]float64)
+	for rows.Next() {
+		var name string
+		var value float64
+		err = rows.Scan(&name, &value)
+		if err != nil {
+			return nil, err
+		}
+		variables[name] = value
+	}
+	return variables, rows.Err()
+}
+
+// SetVariable creates or updates the variable of the user.
+func (db *DB) SetVariable(userId int, name string, value float64) error {
+	_, err := db.Exec("INSERT OR REPLACE INTO Variables (user_id, name, value) VALUES (?, ?, ?)", userId, name, value)
+	return err
+}
+
+// DeleteVariable deletes the variable of the user.
+// It returns false if the user has no such variable.
+func (db *DB) DeleteVariable(userId int, name string) (bool, error) {
+	result, err := db.Exec("DELETE FROM Variables WHERE user_id = ? AND name = ?", userId, name)
+	if err != nil {
+		return false, err
+	}
+	deleted, err := result.RowsAffected()
+	return deleted > 0, err
+}
+
 func (db *DB) GetEquationInfo(id int) (string, string, float64, int) {
-	rows, err := db.Query("SELECT * FROM Equations WHERE ID = ?", id)
+	rows, err := db.Query("SELECT ID, text, status, result, user_id FROM Equations WHERE ID = ?", id)
 	if err != nil {
 		return "", "", 0, 0
 	}
@@ -484,6 +814,156 @@ func (db *DB) GetEquationInfo(id int) (string, string, float64, int) {
 	return "", "", 0, 0
 }
 
+// CountComputers returns the number of computers.
+func (db *DB) CountComputers() (int, error) {
+	var count int
+	err := db.QueryRow("SELECT COUNT(*) FROM Computers").Scan(&count)
+	if err != nil {
+		return 0, err
+	}
+	return count, nil
+}
+
+// GetUnfinishedEquations returns the equations that are waiting in the queue, waiting for other equations
+// or being computed, ordered by ID.
+func (db *DB) GetUnfinishedEquations() ([]Equation, error) {
+	rows, err := db.Query(`SELECT ID, text, status, result, user_id, options FROM Equations
+		WHERE status IN ('In queue', 'in queue', 'Waiting', 'Computing') ORDER BY ID`)
+	if err != nil {
+		return nil, err
+	}
+	defer func(rows *sql.Rows) {
+		err = rows.Close()
+		if err != nil {
+			return
+		}
+	}(rows)
+
+	var equations []Equation
+	for rows.Next() {
+		var equation Equation
+		var options sql.NullString
+		err = rows.Scan(&equation.ID, &equation.Text, &equation.Status, &equation.Result, &equation.UserID, &options)
+		if err != nil {
+			return nil, err
+		}
+		equation.Options = options.String
+		equations = append(equations, equation)
+	}
+	return equations, rows.Err()
+}
+
+// AddBatch inserts the equations of a batch of the user in a single transaction, so either all of them are added or none.
+// It returns the ID of the batch and the IDs of the equations in their order.
+func (db *DB) AddBatch(userId int, equations []NewEquation, createdAt int64) (int, []int, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return 0, nil, err
+	}
+	// Rolling back a committed transaction does nothing
+	defer func(tx *sql.Tx) {
+		_ = tx.Rollback()
+	}(tx)
+
+	result, err := tx.Exec("INSERT INTO Batches (user_id, created_at) VALUES (?, ?)", userId, createdAt)
+	if err != nil {
+		return 0, nil, err
+	}
+	batchId, err := result.LastInsertId()
+	if err != nil {
+		return 0, nil, err
+	}
+	stmt, err := tx.Prepare(`INSERT INTO Equations (text, status, result, user_id, options, variables, batch_id, client_id, tags, callback_url, created_at)
+		VALUES (?, 'In queue', 0, ?, ?, ?, ?, ?, ?, ?, ?)`)
+	if err != nil {
+		return 0, nil, err
+	}
+	defer func(stmt *sql.Stmt) {
+		_ = stmt.Close()
+	}(stmt)
+
+	ids := make([]int, len(equations))
+	for i, equation := range equations {
+		result, err := stmt.Exec(equation.Text, userId, equation.Options, equation.Variables, batchId,
+			equation.ClientID, strings.Join(equation.Tags, ","), equation.CallbackURL, createdAt)
+		if err != nil {
+			return 0, nil, err
+		}
+		id, err := result.LastInsertId()
+		if err != nil {
+			return 0, nil, err
+		}
+		ids[i] = int(id)
+	}
+	if err = tx.Commit(); err != nil {
+		return 0, nil, err
+	}
+	return int(batchId), ids, nil
+}
+
+// GetBatchUserId returns the ID of the owner of the batch, or 0 if there is no such batch.
+func (db *DB) GetBatchUserId(batchId int) (int, error) {
+	var userId int
+	err := db.QueryRow("SELECT user_id FROM Batches WHERE ID = ?", batchId).Scan(&userId)
+	if errors.Is(err, sql.ErrNoRows) {
+		return 0, nil
+	}
+	return userId, err
+}
+
+// equationColumns are the columns read by scanEquations.
+const equationColumns = "ID, text, status, result, user_id, options, result_text, client_id, tags, created_at, finished_at"
+
+// scanEquations reads the equations selected with equationColumns.
+func scanEquations(rows *sql.Rows) ([]Equation, error) {
+	defer func(rows *sql.Rows) {
+		err := rows.Close()
+		if err != nil {
+			return
+		}
+	}(rows)
+
+	var equations []Equation
+	for rows.Next() {
+		var equation Equation
+		var options, resultText, clientId, tags sql.NullString
+		var createdAt, finishedAt sql.NullInt64
+		err := rows.Scan(&equation.ID, &equation.Text, &equation.Status, &equation.Result, &equation.UserID,
+			&options, &resultText, &clientId, &tags, &createdAt, &finishedAt)
+		if err != nil {
+			return nil, err
+		}
+		equation.Options = options.String
+		equation.ResultText = resultText.String
+		equation.ClientID = clientId.String
+		if tags.String != "" {
+			equation.Tags = strings.Split(tags.String, ",")
+		}
+		equation.CreatedAt = createdAt.Int64
+		equation.FinishedAt = finishedAt.Int64
+		equations = append(equations, equation)
+	}
+	return equations, rows.Err()
+}
+
+// GetBatchEquations returns the equations of the batch ordered by ID.
+func (db *DB) GetBatchEquations(batchId int) ([]Equation, error) {
+	rows, err := db.Query("SELECT "+equationColumns+" FROM Equations WHERE batch_id = ? ORDER BY ID", batchId)
+	if err != nil {
+		return nil, err
+	}
+	return scanEquations(rows)
+}
+
+// GetUserEquations returns all equations of the user ordered by ID.
+func (db *DB) GetUserEquations(userId int) ([]Equation, error) {
+	rows, err := db.Query("SELECT "+equationColumns+" FROM Equations WHERE user_id = ? ORDER BY ID", userId)
+	if err != nil {
+		return nil, err
+	}
+	return scanEquations(rows)
+}
+
 func (db *DB) AddComputer() error {
 	// Prepare the SQL statement
 	stmt, err := db.Prepare("INSERT INTO Computers (EquationID) Values (NULL)")
@@ -499,3 +979,247 @@ func (db *DB) AddComputer() error {
 	stmt.Exec()
 	return nil
 }
+
+// SetEquationCallbackURL sets the URL notified when the equation is finished.
+func (db *DB) SetEquationCallbackURL(id int, callbackURL string) error {
+	_, err := db.Exec("UPDATE Equations SET callback_url = ? WHERE ID = ?", callbackURL, id)
+	return err
+}
+
+// GetEquationCallbackURL returns the URL notified when the equation is finished, or "" if there is none.
+func (db *DB) GetEquationCallbackURL(id int) string {
+	var callbackURL sql.NullString
+	err := db.QueryRow("SELECT callback_url FROM Equations WHERE ID = ?", id).Scan(&callbackURL)
+	if err != nil {
+		return ""
+	}
+	return callbackURL.String
+}
+
+// GetEquationFinishedAt returns the Unix time the equation was finished at, or 0 if it is not finished.
+func (db *DB) GetEquationFinishedAt(id int) int64 {
+	var finishedAt sql.NullInt64
+	err := db.QueryRow("SELECT finished_at FROM Equations WHERE ID = ?", id).Scan(&finishedAt)
+	if err != nil {
+		return 0
+	}
+	return finishedAt.Int64
+}
+
+// GetWebhookSecret returns the secret the webhooks of the user are signed with, or "" if it is not set yet.
+func (db *DB) GetWebhookSecret(userId int) (string, error) {
+	var secret sql.NullString
+	err := db.QueryRow("SELECT webhook_secret FROM Users WHERE id = ?", userId).Scan(&secret)
+	return secret.String, err
+}
+
+// AddWebhookSecret sets the secret the webhooks of the user are signed with, unless the user already has one.
+func (db *DB) AddWebhookSecret(userId int, secret string) error {
+	_, err := db.Exec("UPDATE Users SET webhook_secret = ? WHERE id = ? AND (webhook_secret IS NULL OR webhook_secret = '')", secret, userId)
+	return err
+}
+
+// SetWebhookSecret sets the secret the webhooks of the user are signed with.
+func (db *DB) SetWebhookSecret(userId int, secret string) error {
+	_, err := db.Exec("UPDATE Users SET webhook_secret = ? WHERE id = ?", secret, userId)
+	return err
+}
+
+// AddWebhook adds a webhook of the user and returns its ID.
+func (db *DB) AddWebhook(userId int, url string, createdAt int64) (int, error) {
+	result, err := db.Exec("INSERT INTO Webhooks (user_id, url, created_at) VALUES (?, ?, ?)", userId, url, createdAt)
+	if err != nil {
+		return 0, err
+	}
+	id, err := result.LastInsertId()
+	return int(id), err
+}
+
+// GetWebhooks returns the webhooks of the user ordered by ID.
+func (db *DB) GetWebhooks(userId int) ([]Webhook, error) {
+	rows, err := db.Query("SELECT ID, user_id, url, created_at FROM Webhooks WHERE user_id = ? ORDER BY ID", userId)
+	if err != nil {
+		return nil, err
+	}
+	defer func(rows *sql.Rows) {
+		err = rows.Close()
+		if err != nil {
+			return
+		}
+	}(rows)
+
+	var webhooks []Webhook
+	for rows.Next() {
+		var webhook Webhook
+		err = rows.Scan(&webhook.ID, &webhook.UserID, &webhook.URL, &webhook.CreatedAt)
+		if err != nil {
+			return nil, err
+		}
+		webhooks = append(webhooks, webhook)
+	}
+	return webhooks, rows.Err()
+}
+
+// DeleteWebhook deletes the webhook of the user, its deliveries are kept.
+// It returns false if the user has no such webhook.
+func (db *DB) DeleteWebhook(userId, id int) (bool, error) {
+	result, err := db.Exec("DELETE FROM Webhooks WHERE user_id = ? AND ID = ?", userId, id)
+	if err != nil {
+		return false, err
+	}
+	deleted, err := result.RowsAffected()
+	return deleted > 0, err
+}
+
+// AddWebhookDelivery inserts the delivery and returns its ID.
+func (db *DB) AddWebhookDelivery(delivery WebhookDelivery) (int, error) {
+	result, err := db.Exec(`INSERT INTO WebhookDeliveries (user_id, equation_id, webhook_id, url, event, payload, status,
+		attempts, response_code, error, created_at, updated_at, next_attempt_at) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		delivery.UserID, delivery.EquationID, delivery.WebhookID, delivery.URL, delivery.Event, delivery.Payload, delivery.Status,
+		delivery.Attempts, delivery.ResponseCode, delivery.Error, delivery.CreatedAt, delivery.UpdatedAt, delivery.NextAttemptAt)
+	if err != nil {
+		return 0, err
+	}
+	id, err := result.LastInsertId()
+	return int(id), err
+}
+
+// UpdateWebhookDelivery stores the outcome of an attempt of the delivery.
+func (db *DB) UpdateWebhookDelivery(delivery WebhookDelivery) error {
+	_, err := db.Exec(`UPDATE WebhookDeliveries SET status = ?, attempts = ?, response_code = ?, error = ?, updated_at = ?,
+		next_attempt_at = ? WHERE ID = ?`, delivery.Status, delivery.Attempts, delivery.ResponseCode, delivery.Error,
+		delivery.UpdatedAt, delivery.NextAttemptAt, delivery.ID)
+	return err
+}
+
+// webhookDeliveryColumns are the columns read by scanWebhookDeliveries.
+const webhookDeliveryColumns = `ID, user_id, equation_id, webhook_id, url, event, payload, status, attempts, response_code, error,
+	created_at, updated_at, next_attempt_at`
+
+// scanWebhookDeliveries reads the deliveries selected with webhookDeliveryColumns.
+func scanWebhookDeliveries(rows *sql.Rows) ([]WebhookDelivery, error) {
+	defer func(rows *sql.Rows) {
+		err := rows.Close()
+		if err != nil {
+			return
+		}
+	}(rows)
+
+	var deliveries []WebhookDelivery
+	for rows.Next() {
+		var delivery WebhookDelivery
+		err := rows.Scan(&delivery.ID, &delivery.UserID, &delivery.EquationID, &delivery.WebhookID, &delivery.URL,
+			&delivery.Event, &delivery.Payload, &delivery.Status, &delivery.Attempts, &delivery.ResponseCode, &delivery.Error,
+			&delivery.CreatedAt, &delivery.UpdatedAt, &delivery.NextAttemptAt)
+		if err != nil {
+			return nil, err
+		}
+		deliveries = append(deliveries, delivery)
+	}
+	return deliveries, rows.Err()
+}
+
+// GetWebhookDelivery returns the delivery by its ID, ok is false if there is no such delivery.
+func (db *DB) GetWebhookDelivery(id int) (delivery WebhookDelivery, ok bool, err error) {
+	rows, err := db.Query("SELECT "+webhookDeliveryColumns+" FROM WebhookDeliveries WHERE ID = ?", id)
+	if err != nil {
+		return WebhookDelivery{}, false, err
+	}
+	deliveries, err := scanWebhookDeliveries(rows)
+	if err != nil || len(deliveries) == 0 {
+		return WebhookDelivery{}, false, err
+	}
+	return deliveries[0], true, nil
+}
+
+// GetWebhookDeliveries returns the newest deliveries of the user, at most limit of them.
+// The status and the equation ID filter the deliveries unless they are "" and 0.
+func (db *DB) GetWebhookDeliveries(userId int, status string, equationId int, limit int) ([]WebhookDelivery, error) {
+	rows, err := db.Query("SELECT "+webhookDeliveryColumns+` FROM WebhookDeliveries
+		WHERE user_id = ? AND (? = '' OR status = ?) AND (? = 0 OR equation_id = ?) ORDER BY ID DESC LIMIT ?`,
+		userId, status, status, equationId, equationId, limit)
+	if err != nil {
+		return nil, err
+	}
+	return scanWebhookDeliveries(rows)
+}
+
+// GetDueWebhookDeliveries returns the IDs of the pending deliveries whose next attempt is due at the Unix time, oldest first.
+func (db *DB) GetDueWebhookDeliveries(now int64, limit int) ([]int, error) {
+	rows, err := db.Query("SELECT ID FROM WebhookDeliveries WHERE status = ? AND next_attempt_at <= ? ORDER BY ID LIMIT ?",
+		DeliveryPending, now, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer func(rows *sql.Rows) {
+		err = rows.Close()
+		if err != nil {
+			return
+		}
+	}(rows)
+
+	var ids []int
+	for rows.Next() {
+		var id int
+		if err = rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	return ids, rows.Err()
+}
+
+// GetRecordedWebhookIDs returns the IDs of the webhooks that already have a delivery of the equation,
+// the ID 0 stands for the callback URL of the equation.
+func (db *DB) GetRecordedWebhookIDs(equationId int) (map[int]bool, error) {
+	rows, err := db.Query("SELECT DISTINCT webhook_id FROM WebhookDeliveries WHERE equation_id = ?", equationId)
+	if err != nil {
+		return nil, err
+	}
+	defer func(rows *sql.Rows) {
+		err = rows.Close()
+		if err != nil {
+			return
+		}
+	}(rows)
+
+	recorded := make(map[int]bool)
+	for rows.Next() {
+		var id int
+		if err = rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		recorded[id] = true
+	}
+	return recorded, rows.Err()
+}
+
+// GetUnrecordedWebhookEquations returns the IDs of the finished equations, oldest first, that miss a delivery
+// for their callback URL or for a webhook of their user added before they were finished.
+func (db *DB) GetUnrecordedWebhookEquations(limit int) ([]int, error) {
+	rows, err := db.Query(`SELECT e.ID FROM Equations e WHERE e.finished_at IS NOT NULL AND (
+		(e.callback_url IS NOT NULL AND e.callback_url != '' AND NOT EXISTS (
+			SELECT 1 FROM WebhookDeliveries d WHERE d.equation_id = e.ID AND d.webhook_id = 0))
+		OR EXISTS (SELECT 1 FROM Webhooks w WHERE w.user_id = e.user_id AND w.created_at <= e.finished_at AND NOT EXISTS (
+			SELECT 1 FROM WebhookDeliveries d WHERE d.equation_id = e.ID AND d.webhook_id = w.ID))
+	) ORDER BY e.ID LIMIT ?`, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer func(rows *sql.Rows) {
+		err = rows.Close()
+		if err != nil {
+			return
+		}
+	}(rows)
+
+	var ids []int
+	for rows.Next() {
+		var id int
+		if err = rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	return ids, rows.Err()
+}
@@ -4,6 +4,8 @@ import (
 	"DistributedCalculator/agent"
 	"DistributedCalculator/db"
 	"encoding/json"
+	"errors"
+	"flag"
 	"fmt"
 	"github.com/golang-jwt/jwt/v5"
 	"golang.org/x/crypto/bcrypt"
@@ -226,6 +228,16 @@ func LoginHandler(w http.ResponseWriter, r *http.Request) {
 
 func AuthMiddleware(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// API clients authorize with the Authorization header instead of the cookie
+		if strings.HasPrefix(r.Header.Get("Authorization"), "Bearer ") {
+			if _, ok := getUserLogin(r); !ok {
+				http.Error(w, "Invalid token", http.StatusUnauthorized)
+				return
+			}
+			next.ServeHTTP(w, r)
+			return
+		}
+
 		c, err := r.Cookie("token")
 		if err != nil {
 			if err == http.ErrNoCookie {
@@ -350,36 +362,131 @@ func addEquationHandler(w http.ResponseWriter, r *http.Request) {
 			// Redirect to the get route with the id
 			http.Redirect(w, r, fmt.Sprintf("/get/%d", id), http.StatusSeeOther)
 		} else {
-			// Check if the equation is valid
-			if !agent.ValidEquation(text, 0, len(text)) {
+			// Collect the evaluation options of the equation
+			options := agent.DefaultOptions
+			if r.FormValue("rebalance") == "on" {
+				options.Rebalance = true
+			}
+			if r.FormValue("implicit_multiplication") == "on" {
+				options.ImplicitMultiplication = true
+			}
+			if r.FormValue("simplify") == "on" {
+				options.Simplify = true
+			}
+			// Check if the equation is valid in the grammar of the options
+			script, err := options.ParseScript(text)
+			if err != nil {
 				// Send an HTTP 400 error and log the error
 				http.Error(w, "Invalid equation", http.StatusBadRequest)
 				log.Println("Invalid equation")
 				return
 			}
+			precision := 0
+			if r.FormValue("precision") != "" {
+				precision, err = strconv.Atoi(r.FormValue("precision"))
+				if err != nil {
+					http.Error(w, "Invalid precision", http.StatusBadRequest)
+					return
+				}
+			}
+			if err = setNumericMode(&options, r.FormValue("mode"), precision); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
 
-			// Add the equation to the database
+			// Add the equation to the database and evaluate it
 			userLogin, _ := getUserLogin(r)
 			userId, _ := database.GetUserID(userLogin)
-			id, err = database.AddEquation(id, text, "Equations", userId)
+			snapshot, err := bindVariables(database, script, userId)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				log.Println(err)
+				return
+			}
+			_, err = queueEquation(database, text, userId, options, snapshot, "", nil)
 			if err != nil {
 				log.Fatal(err)
 			}
 
-			// Evaluate the equation in a goroutine
-			go func() {
-				err = agent.Evaluate(id)
-				if err != nil {
-					log.Fatal(err)
-				}
-			}()
-
 			// Redirect to the root route
 			http.Redirect(w, r, "/equations", http.StatusSeeOther)
 		}
 	}
 }
 
+// setNumericMode sets the numeric mode of the expression and the precision of the decimal mode.
+// The empty mode keeps the default one.
+func setNumericMode(options *agent.Options, mode string, precision int) error {
+	if mode != "" {
+		parsed, err := agent.ParseMode(mode)
+		if err != nil {
+			return err
+		}
+		options.Mode = parsed
+	}
+	if precision < 0 {
+		return errors.New("the precision must not be negative")
+	}
+	if precision > agent.MaxDigits {
+		return fmt.Errorf("the precision must be at most %d", agent.MaxDigits)
+	}
+	if precision > 0 {
+		options.Precision = precision
+	}
+	return nil
+}
+
+// bindVariables takes the values of the variables of the parsed equation from the constants and the variables of the user.
+// It also checks that the equation references only the expressions of the user.
+func bindVariables(database *db.DB, script *agent.Script, userId int) (agent.Snapshot, error) {
+	err := agent.CheckReferences(script, userId, func(id int) (string, int, bool) {
+		equation, _, _, equationUserId := database.GetEquationInfo(id)
+		return equation, equationUserId, equation != ""
+	})
+	if err != nil {
+		return nil, err
+	}
+	variables, err := database.GetVariables(userId)
+	if err != nil {
+		return nil, err
+	}
+	return agent.Bind(script, variables)
+}
+
+// queueEquation adds the equation with the values of its variables to the database and evaluates it in a goroutine.
+// The callback URL, if it is not empty, is notified when the equation is finished.
+// The added hook, if it is not nil, is called with the id of the stored equation before any of its events is published,
+// so that a subscriber can start following it without missing one.
+// It returns the id of the new equation.
+func queueEquation(database *db.DB, text string, userId int, options agent.Options, snapshot agent.Snapshot, callbackURL string, added func(id int)) (int, error) {
+	id, err := database.AddEquation(0, text, "Equations", userId, options.String(), snapshot.String())
+	if err != nil {
+		return 0, err
+	}
+	if callbackURL != "" {
+		if err = database.SetEquationCallbackURL(id, callbackURL); err != nil {
+			return 0, err
+		}
+	}
+	if added != nil {
+		added(id)
+	}
+
+	publishQueued(userId, id)
+	evaluateInBackground(id)
+	return id, nil
+}
+
+// evaluateInBackground evaluates the queued equation in a goroutine.
+func evaluateInBackground(id int) {
+	go func() {
+		err := agent.Evaluate(id)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}()
+}
+
 // getEquationHandler handles the "/get/" route and retrieves an equation from the database based on its ID.
 // It first parses the URL path to get the ID, then connects to the database.
 // If the equation with the given ID is found, it is returned as a JSON response.
@@ -411,6 +518,13 @@ func getEquationHandler(w http.ResponseWriter, r *http.Request) {
 		}
 	}()
 
+	// The result is formatted with the options from the query
+	format, err := agent.ParseNumberFormat(r.URL.Query(), agent.DefaultNumberFormat)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
 	// Get the user id from the JWT token
 	userLogin, _ := getUserLogin(r)
 	userId, _ := database.GetUserID(userLogin)
@@ -437,14 +551,49 @@ func getEquationHandler(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "Equation not found", http.StatusNotFound)
 		return
 	}
-	// Prepare the JSON response
-	var jsonStr []byte
-	jsonStr, err = json.Marshal(map[string]interface{}{
+	// Report the critical path of the tree that is evaluated
+	response := map[string]interface{}{
 		"id":     id,
 		"text":   equation,
 		"status": status,
 		"result": result,
-	})
+	}
+	options := agent.ParseOptions(database.GetEquationOptions(id))
+	if script, err := options.ParseScript(equation); err == nil {
+		// The canonical form shows how the expression was read, like 2*(3+4) for 2(3+4)
+		response["canonical"] = script.String()
+		addSimplification(response, equation, script, options)
+	}
+	if script, err := agent.BuildScript(equation, options); err == nil {
+		durations, _ := database.GetOperationTimes()
+		depth, criticalPath := 0, 0
+		for _, root := range script.Roots() {
+			depth = max(depth, root.Depth())
+			criticalPath = max(criticalPath, root.CriticalPath(durations))
+		}
+		response["depth"] = depth
+		response["critical_path"] = criticalPath
+		response["rebalance"] = options.Rebalance
+	}
+	if mode, _ := agent.ParseMode(string(options.Mode)); mode != agent.FloatMode {
+		response["mode"] = mode
+	}
+	if text := database.GetEquationResultText(id); text != "" {
+		response["result_text"] = text
+	}
+	if status == "Computed" {
+		response["result_formatted"] = format.Format(resultText(response["result_text"], result))
+	}
+	if snapshot := agent.ParseSnapshot(database.GetEquationVariables(id)); len(snapshot) > 0 {
+		response["variables"] = snapshot
+	}
+	// The values of the variables assigned in a script
+	if bindings := agent.ParseBindings(database.GetEquationBindings(id)); len(bindings) > 0 {
+		response["bindings"] = bindings
+	}
+	// Prepare the JSON response
+	var jsonStr []byte
+	jsonStr, err = json.Marshal(response)
 	if err != nil {
 		// Send an HTTP 500 error for internal server error
 		http.Error(w, err.Error(), http.StatusInternalServerError)
@@ -460,7 +609,85 @@ func getEquationHandler(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+// pageNumberFormat is the default number format of the web pages: comma decimals and grouped thousands.
+var pageNumberFormat = agent.NumberFormat{Decimals: -1, Group: "\u00a0", Decimal: ","}
+
+// resultText returns the stored text of a result, or the text of its float64 value for older results.
+func resultText(text interface{}, result interface{}) string {
+	switch text := text.(type) {
+	case string:
+		if text != "" {
+			return text
+		}
+	case []byte:
+		if len(text) > 0 {
+			return string(text)
+		}
+	}
+	if result, ok := result.(float64); ok {
+		return strconv.FormatFloat(result, 'g', -1, 64)
+	}
+	return fmt.Sprint(result)
+}
+
 func equationsHandler(w http.ResponseWriter, r *http.Request) {
+	renderEquations(w, r, nil)
+}
+
+// importResult is the outcome of a file imported on the equations page.
+type importResult struct {
+	Accepted int
+	// Rejected are the rows with errors, like "line 3 (a1): unexpected ) at position 2".
+	Rejected []string
+	// Error is the error of a malformed file.
+	Error string
+}
+
+// importEquationsHandler handles the "/import_equations" route, the CSV file uploaded on the equations page.
+// The expressions are queued like with "POST /api/v1/import", and the page is shown with the outcome of the import.
+func importEquationsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "Invalid request method", http.StatusMethodNotAllowed)
+		return
+	}
+	database, err := db.Connect("data.db")
+	if err != nil {
+		http.Error(w, "Failed to connect to database", http.StatusInternalServerError)
+		return
+	}
+	defer database.Close()
+
+	userLogin, _ := getUserLogin(r)
+	userId, err := database.GetUserID(userLogin)
+	if err != nil {
+		http.Error(w, "User not found", http.StatusNotFound)
+		return
+	}
+	result := &importResult{}
+	_, items, _, err := importCSV(w, r, database, userId)
+	if err != nil {
+		result.Error = err.Error()
+	}
+	for _, item := range items {
+		if item.Error == nil {
+			result.Accepted++
+			continue
+		}
+		row := fmt.Sprintf("line %d", item.Line)
+		if item.ClientID != "" {
+			row += fmt.Sprintf(" (%s)", item.ClientID)
+		}
+		row += fmt.Sprintf(": %s", item.Error["message"])
+		if position, ok := item.Error["position"]; ok {
+			row += fmt.Sprintf(" at position %d", position)
+		}
+		result.Rejected = append(result.Rejected, row)
+	}
+	renderEquations(w, r, result)
+}
+
+// renderEquations shows the equations page of the user with the outcome of the import, if there is one.
+func renderEquations(w http.ResponseWriter, r *http.Request, imported *importResult) {
 	// Connect to the database
 	database, err := db.Connect("data.db")
 	if err != nil {
@@ -481,6 +708,32 @@ func equationsHandler(w http.ResponseWriter, r *http.Request) {
 		log.Fatal(err)
 	}
 
+	// Format the results, the page uses the Russian number format by default
+	format, err := agent.ParseNumberFormat(r.URL.Query(), pageNumberFormat)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	for _, value := range values {
+		if value["status"] == "Computed" {
+			value["result_formatted"] = format.Format(resultText(value["result_text"], value["result"]))
+		}
+	}
+
+	// Add the estimated completion time to the unfinished equations
+	estimates, err := agent.EstimateQueue(database)
+	if err == nil {
+		for _, value := range values {
+			id, ok := value["ID"].(int64)
+			if !ok {
+				continue
+			}
+			if estimate, ok := estimates[int(id)]; ok {
+				value["estimate"] = time.Now().Add(time.Duration(estimate.Remaining) * time.Millisecond).Format("15:04:05.000")
+			}
+		}
+	}
+
 	// Parse the HTML templates
 	var tmpl *template.Template
 	tmpl, err = template.ParseFiles("templates/base.html", "templates/equations.html")
@@ -496,11 +749,13 @@ func equationsHandler(w http.ResponseWriter, r *http.Request) {
 	data := struct {
 		Title     string
 		Equations []map[string]interface{}
+		Import    *importResult
 		IsAuth    bool
 		UserLogin string
 	}{
 		Title:     "Выражения",
 		Equations: values,
+		Import:    imported,
 		IsAuth:    isAuth,
 		UserLogin: userLogin,
 	}
@@ -579,12 +834,6 @@ func updateOperationsHandler(w http.ResponseWriter, r *http.Request) {
 			http.Error(w, err.Error(), http.StatusInternalServerError)
 			return
 		}
-		// Get the operation times from the form data
-		plusTime := r.FormValue("time_+")
-		minusTime := r.FormValue("time_-")
-		multiplyTime := r.FormValue("time_*")
-		divideTime := r.FormValue("time_/")
-
 		// Connect to the database
 		database, err := db.Connect("data.db")
 		if err != nil {
@@ -597,9 +846,16 @@ func updateOperationsHandler(w http.ResponseWriter, r *http.Request) {
 			}
 		}()
 
-		// Define the operation types and times
-		types := []string{"+", "-", "*", "/"}
-		times := []string{plusTime, minusTime, multiplyTime, divideTime}
+		// Get the time of every operation type from the form data
+		durations, err := database.GetOperationTimes()
+		if err != nil {
+			log.Fatal(err)
+		}
+		var types, times []string
+		for opType := range durations {
+			types = append(types, opType)
+			times = append(times, r.FormValue("time_"+opType))
+		}
 
 		// Update the operation times in the database
 		err = database.UpdateOperations(types, times)
@@ -708,14 +964,49 @@ func addComputerHandler(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
-func getUserLogin(r *http.Request) (string, bool) {
-	c, err := r.Cookie("token")
+// metricsHandler handles the "/api/v1/metrics" route and returns the server metrics as JSON.
+// For now it reports the hit and miss counts of the result cache.
+func metricsHandler(w http.ResponseWriter, r *http.Request) {
+	cache := map[string]interface{}{
+		"enabled": agent.Cache != nil,
+	}
+	if agent.Cache != nil {
+		hits, misses := agent.Cache.Stats()
+		cache["hits"] = hits
+		cache["misses"] = misses
+		cache["size"] = agent.Cache.Size
+		cache["ttl_seconds"] = agent.Cache.TTL.Seconds()
+	}
+
+	jsonStr, err := json.Marshal(map[string]interface{}{
+		"cache": cache,
+	})
 	if err != nil {
-		return "", false
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
 	}
+	w.Header().Set("Content-Type", "application/json")
+	_, err = w.Write(jsonStr)
+	if err != nil {
+		log.Println(err)
+	}
+}
 
-	tokenStr := c.Value
+func getUserLogin(r *http.Request) (string, bool) {
+	var tokenStr string
+	if c, err := r.Cookie("token"); err == nil {
+		tokenStr = c.Value
+	} else if header := r.Header.Get("Authorization"); strings.HasPrefix(header, "Bearer ") {
+		// API clients send the token from /api/v1/login in the Authorization header
+		tokenStr = strings.TrimPrefix(header, "Bearer ")
+	} else {
+		return "", false
+	}
+	return parseToken(tokenStr)
+}
 
+// parseToken returns the login of the user from the signed JWT.
+func parseToken(tokenStr string) (string, bool) {
 	token, err := jwt.Parse(tokenStr, func(token *jwt.Token) (interface{}, error) {
 		if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
 			return nil, fmt.Errorf("unexpected signing method: %v", token.Header["alg"])
@@ -736,6 +1027,29 @@ func getUserLogin(r *http.Request) (string, bool) {
 }
 
 func main() {
+	// Run the offline schedule simulator instead of the server
+	if len(os.Args) > 1 && os.Args[1] == "simulate" {
+		simulateCommand(os.Args[2:])
+	}
+
+	// Parse the command line flags
+	cacheEnabled := flag.Bool("cache", false, "cache the results of computed sub-expressions")
+	cacheSize := flag.Int("cache-size", 1000, "maximum number of cached results, 0 means unlimited")
+	cacheTTL := flag.Duration("cache-ttl", 24*time.Hour, "time a cached result stays valid, 0 means forever")
+	rebalance := flag.Bool("rebalance", false, "rebalance chains of + and * in every expression")
+	implicitMultiplication := flag.Bool("implicit-multiplication", false, "accept expressions like 2(3+4) in every expression")
+	simplify := flag.Bool("simplify", false, "simplify every expression before it is evaluated")
+	flag.IntVar(&webhookAttempts, "webhook-attempts", webhookAttempts, "number of attempts of a webhook delivery")
+	flag.DurationVar(&webhookBackoff, "webhook-backoff", webhookBackoff, "delay after the first failed webhook delivery, doubled after every next failure")
+	flag.BoolVar(&webhookAllowPrivate, "webhook-allow-private", webhookAllowPrivate, "allow webhooks to loopback, link-local and private addresses, for local testing only")
+	flag.Parse()
+	agent.DefaultOptions.Rebalance = *rebalance
+	agent.DefaultOptions.ImplicitMultiplication = *implicitMultiplication
+	agent.DefaultOptions.Simplify = *simplify
+	if *cacheEnabled {
+		agent.Cache = agent.NewResultCache(*cacheSize, *cacheTTL)
+	}
+
 	// Check if database exists and create it if it doesn't
 	_, err := os.Stat("data.db")
 	if os.IsNotExist(err) {
@@ -773,6 +1087,8 @@ func main() {
 	log.SetOutput(logFile)
 	// Log that the server has started
 	log.Println("Server started")
+	// Deliver the webhooks of the finished expressions, including the ones pending before the restart
+	startWebhooks()
 
 	// Define the HTTP routes and their handlers
 	http.HandleFunc("/register", RegisterHandler)
@@ -783,12 +1099,28 @@ func main() {
 	http.Handle("/add_equation", AuthMiddleware(http.HandlerFunc(addEquationHandler)))
 	http.Handle("/get/", AuthMiddleware(http.HandlerFunc(getEquationHandler)))
 	http.Handle("/equations", AuthMiddleware(http.HandlerFunc(equationsHandler)))
+	http.Handle("/import_equations", AuthMiddleware(http.HandlerFunc(importEquationsHandler)))
 	http.Handle("/operations", http.HandlerFunc(operationsHandler))
 	http.Handle("/computers", http.HandlerFunc(computersHandler))
 	http.Handle("/update_operations", http.HandlerFunc(updateOperationsHandler))
 	http.Handle("/add_computer", http.HandlerFunc(addComputerHandler))
 	http.HandleFunc("/api/v1/register", RegisterAPIHandler)
 	http.HandleFunc("/api/v1/login", LoginAPIHandler)
+	http.HandleFunc("/api/v1/metrics", metricsHandler)
+	http.HandleFunc("/api/v1/calculate", CalculateAPIHandler)
+	http.HandleFunc("/api/v1/calculate/batch", BatchCalculateAPIHandler)
+	http.HandleFunc("/api/v1/batches/", BatchesAPIHandler)
+	http.HandleFunc("/api/v1/import", ImportAPIHandler)
+	http.HandleFunc("/api/v1/export", ExportAPIHandler)
+	http.HandleFunc("/api/v1/events", EventsAPIHandler)
+	http.HandleFunc("/api/v1/computers/events", ComputerEventsAPIHandler)
+	http.HandleFunc("/api/v1/ws", SessionAPIHandler)
+	http.HandleFunc("/api/v1/validate", ValidateAPIHandler)
+	http.HandleFunc("/api/v1/expressions/", ExpressionsAPIHandler)
+	http.HandleFunc("/api/v1/variables", VariablesAPIHandler)
+	http.HandleFunc("/api/v1/variables/", VariablesAPIHandler)
+	http.HandleFunc("/api/v1/webhooks", WebhooksAPIHandler)
+	http.HandleFunc("/api/v1/webhooks/", WebhooksAPIHandler)
 
 	// Start the HTTP server
 	err = http.ListenAndServe(":8080", nil)
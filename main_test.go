@@ -0,0 +1,43 @@
+package main
+
+import (
+	"DistributedCalculator/db"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// useTestDatabase runs the test in a temporary directory with a new data.db, the database the handlers connect to.
+// It returns the database and the token of the user "user", who is added to it.
+func useTestDatabase(t *testing.T) (*db.DB, string) {
+	dir, err := os.Getwd()
+	if err != nil {
+		t.Fatalf("Getwd returned error %v", err)
+	}
+	if err = os.Chdir(t.TempDir()); err != nil {
+		t.Fatalf("Chdir returned error %v", err)
+	}
+	t.Cleanup(func() { os.Chdir(dir) })
+
+	database, err := db.Connect("data.db")
+	if err != nil {
+		t.Fatalf("Connect returned error %v", err)
+	}
+	t.Cleanup(func() { database.Close() })
+	if err = database.Init(); err != nil {
+		t.Fatalf("Init returned error %v", err)
+	}
+	if err = database.AddUser("user", "hash"); err != nil {
+		t.Fatalf("AddUser returned error %v", err)
+	}
+	token, err := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{
+		"name": "user",
+		"exp":  time.Now().Add(time.Hour).Unix(),
+	}).SignedString(hmacSampleSecret)
+	if err != nil {
+		t.Fatalf("SignedString returned error %v", err)
+	}
+	return database, token
+}
@@ -0,0 +1,298 @@
+package main
+
+import (
+	"DistributedCalculator/agent"
+	"DistributedCalculator/db"
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+)
+
+// sessionPingInterval is the interval of the ping frames of the server, the client must answer them
+// or send something within sessionTimeout.
+const (
+	sessionPingInterval = 30 * time.Second
+	sessionTimeout      = 3 * sessionPingInterval
+)
+
+// sessionMessage is a message of the client of a session. Type is one of
+//   - "submit" — queues the expression, like POST /api/v1/calculate, and follows it
+//   - "subscribe" — follows an expression of the user by its ID
+//   - "cancel" — cancels the evaluation of an expression of the user by its ID
+//   - "ping" — the server answers with "pong"
+//
+// Ref is an arbitrary value of the client, it is returned in the answer to the message.
+type sessionMessage struct {
+	expressionRequest
+	Type string          `json:"type"`
+	Ref  json.RawMessage `json:"ref,omitempty"`
+	ID   int             `json:"id"`
+}
+
+// session is a WebSocket connection of a user that follows several expressions at once.
+// Like the handlers of the requests, it connects to the database for every message and every resync only,
+// since the session may last for hours.
+type session struct {
+	conn   *websocketConn
+	userId int
+	format agent.NumberFormat
+	// mu guards followed, the IDs of the unfinished expressions whose events are sent to the client.
+	mu       sync.Mutex
+	followed map[int]bool
+}
+
+// sessionLogin returns the login of the user of the session request.
+// Besides the cookie and the Authorization header, the token may be passed as the "token" query parameter,
+// since the browsers cannot set headers on WebSocket requests.
+// A request authorized by the cookie must come from a page of this server, so that other sites cannot use the cookie.
+func sessionLogin(r *http.Request) (string, bool) {
+	if token := r.URL.Query().Get("token"); token != "" {
+		return parseToken(token)
+	}
+	if _, err := r.Cookie("token"); err == nil {
+		if origin := r.Header.Get("Origin"); origin != "" {
+			u, err := url.Parse(origin)
+			if err != nil || u.Host != r.Host {
+				return "", false
+			}
+		}
+	}
+	return getUserLogin(r)
+}
+
+// SessionAPIHandler handles "GET /api/v1/ws", a WebSocket session of the authorized user.
+// The client sends sessionMessage and receives JSON messages with a "type": the answers "accepted", "ack", "pong"
+// and "error", and the "status", "progress" and "result" events of the followed expressions, like the Server-Sent Events.
+// An expression is no longer followed after its result, error or cancellation.
+func SessionAPIHandler(w http.ResponseWriter, r *http.Request) {
+	userLogin, isAuth := sessionLogin(r)
+	if !isAuth {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+	format, err := agent.ParseNumberFormat(r.URL.Query(), agent.DefaultNumberFormat)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	database, err := db.Connect("data.db")
+	if err != nil {
+		http.Error(w, "Failed to connect to database", http.StatusInternalServerError)
+		return
+	}
+	userId, err := database.GetUserID(userLogin)
+	database.Close()
+	if err != nil {
+		http.Error(w, "User not found", http.StatusNotFound)
+		return
+	}
+
+	conn, err := upgradeWebsocket(w, r)
+	if err != nil {
+		return
+	}
+	s := &session{conn: conn, userId: userId, format: format, followed: make(map[int]bool)}
+	subscription := agent.Events.Subscribe(func(e agent.Event) bool {
+		return e.UserID == userId && e.Type != agent.ComputerEvent && s.following(e.EquationID)
+	})
+	done := make(chan struct{})
+	go func() {
+		s.forward(subscription)
+		close(done)
+	}()
+	s.read()
+	subscription.Close()
+	<-done
+	conn.Close(closeNormal, "")
+}
+
+// following reports whether the events of the expression are sent to the client.
+func (s *session) following(id int) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.followed[id]
+}
+
+// follow starts or stops sending the events of the expression to the client.
+func (s *session) follow(id int, follow bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if follow {
+		s.followed[id] = true
+	} else {
+		delete(s.followed, id)
+	}
+}
+
+// send writes the message to the client, the errors are noticed by read.
+func (s *session) send(message map[string]interface{}) {
+	data, _ := json.Marshal(message)
+	_ = s.conn.WriteMessage(data)
+}
+
+// sendEvent writes the event of a followed expression and stops following the finished expression.
+func (s *session) sendEvent(e agent.Event) {
+	message := e.Payload()
+	message["type"] = e.Type
+	if e.Type == agent.ResultEvent {
+		message["result_formatted"] = s.format.Format(e.ResultText)
+	}
+	s.send(message)
+	if e.Final() {
+		s.follow(e.EquationID, false)
+	}
+}
+
+// sendError answers the message of the client with an error.
+func (s *session) sendError(ref json.RawMessage, err map[string]interface{}) {
+	s.send(map[string]interface{}{"type": "error", "ref": ref, "error": err})
+}
+
+// forward sends the events of the subscription and pings the client until the subscription is closed.
+// Since the bus drops the events of a subscriber that falls behind, every ping also resends
+// the state of the followed expressions that have finished, so that no result is lost.
+func (s *session) forward(subscription *agent.Subscription) {
+	ping := time.NewTicker(sessionPingInterval)
+	defer ping.Stop()
+	for {
+		select {
+		case e, ok := <-subscription.C:
+			if !ok {
+				return
+			}
+			if s.following(e.EquationID) {
+				s.sendEvent(e)
+			}
+		case <-ping.C:
+			if err := s.conn.Ping(); err != nil {
+				return
+			}
+			s.resync()
+		}
+	}
+}
+
+// resync sends the final state of the followed expressions that have finished without their final event.
+func (s *session) resync() {
+	s.mu.Lock()
+	ids := make([]int, 0, len(s.followed))
+	for id := range s.followed {
+		ids = append(ids, id)
+	}
+	s.mu.Unlock()
+	if len(ids) == 0 {
+		return
+	}
+	database, err := db.Connect("data.db")
+	if err != nil {
+		return
+	}
+	defer database.Close()
+	for _, id := range ids {
+		_, status, _, _ := database.GetEquationInfo(id)
+		if !agent.Finished(status) {
+			continue
+		}
+		for _, e := range expressionEvents(database, id) {
+			s.sendEvent(e)
+		}
+	}
+}
+
+// read handles the messages of the client until the connection is closed or fails.
+func (s *session) read() {
+	for {
+		data, err := s.conn.ReadMessage(sessionTimeout)
+		if err != nil {
+			return
+		}
+		var message sessionMessage
+		if err := json.Unmarshal(data, &message); err != nil {
+			s.sendError(nil, map[string]interface{}{"message": "Invalid message"})
+			continue
+		}
+		switch message.Type {
+		case "submit", "subscribe", "cancel":
+			s.handle(message)
+		case "ping":
+			s.send(map[string]interface{}{"type": "pong", "ref": message.Ref})
+		default:
+			s.sendError(message.Ref, map[string]interface{}{"message": "Unknown message type"})
+		}
+	}
+}
+
+// handle answers a message of the client that needs the database.
+func (s *session) handle(message sessionMessage) {
+	database, err := db.Connect("data.db")
+	if err != nil {
+		s.sendError(message.Ref, map[string]interface{}{"message": "Failed to connect to database"})
+		return
+	}
+	defer database.Close()
+
+	switch message.Type {
+	case "submit":
+		s.submit(database, message)
+	case "subscribe":
+		if s.owned(database, message) {
+			// Follow before reading the current state, so that no change is missed
+			s.follow(message.ID, true)
+			s.send(map[string]interface{}{"type": "ack", "ref": message.Ref, "id": message.ID})
+			for _, e := range expressionEvents(database, message.ID) {
+				s.sendEvent(e)
+			}
+		}
+	case "cancel":
+		if s.owned(database, message) {
+			if !cancelExpression(database, message.ID) {
+				s.sendError(message.Ref, map[string]interface{}{"message": "The expression is already finished", "id": message.ID})
+				return
+			}
+			s.send(map[string]interface{}{"type": "ack", "ref": message.Ref, "id": message.ID})
+		}
+	}
+}
+
+// owned reports whether the expression of the message belongs to the user, otherwise it answers with an error.
+func (s *session) owned(database *db.DB, message sessionMessage) bool {
+	equationUserId, err := database.GetEquationUserId(message.ID)
+	if err != nil || equationUserId == 0 || equationUserId != s.userId {
+		s.sendError(message.Ref, map[string]interface{}{"message": "Equation not found", "id": message.ID})
+		return false
+	}
+	return true
+}
+
+// submit queues the expression of the message and follows it.
+// The answer "accepted" comes before the events of the expression.
+func (s *session) submit(database *db.DB, message sessionMessage) {
+	options, err := message.options()
+	if err != nil {
+		s.sendError(message.Ref, map[string]interface{}{"message": err.Error()})
+		return
+	}
+	script, err := options.ParseScript(message.Expression)
+	if err != nil {
+		s.sendError(message.Ref, validationError(err))
+		return
+	}
+	snapshot, err := bindVariables(database, script, s.userId)
+	if err != nil {
+		s.sendError(message.Ref, validationError(err))
+		return
+	}
+	if err := checkCallbackURL(message.CallbackURL); err != nil {
+		s.sendError(message.Ref, validationError(err))
+		return
+	}
+	_, err = queueEquation(database, message.Expression, s.userId, options, snapshot, message.CallbackURL, func(id int) {
+		s.follow(id, true)
+		s.send(map[string]interface{}{"type": "accepted", "ref": message.Ref, "id": id, "canonical": script.String()})
+	})
+	if err != nil {
+		s.sendError(message.Ref, map[string]interface{}{"message": "Failed to add equation to database"})
+	}
+}
@@ -0,0 +1,246 @@
+package main
+
+import (
+	"DistributedCalculator/agent"
+	"DistributedCalculator/db"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// parseComputers parses the computers of the simulate command.
+// A single number is the count of identical computers, for example "4".
+// Otherwise it is a comma separated list of computers with optional speeds, for example "fast:2,slow:0.5,usual".
+func parseComputers(spec string) ([]agent.Computer, error) {
+	if count, err := strconv.Atoi(spec); err == nil {
+		if count <= 0 {
+			return nil, errors.New("the number of computers must be positive")
+		}
+		return agent.Computers(count), nil
+	}
+	var computers []agent.Computer
+	for _, item := range strings.Split(spec, ",") {
+		name, speedStr, hasSpeed := strings.Cut(strings.TrimSpace(item), ":")
+		if name == "" {
+			return nil, fmt.Errorf("invalid computer %q", item)
+		}
+		speed := 1.0
+		if hasSpeed {
+			var err error
+			speed, err = strconv.ParseFloat(speedStr, 64)
+			if err != nil || speed <= 0 {
+				return nil, fmt.Errorf("invalid speed of computer %q", name)
+			}
+		}
+		computers = append(computers, agent.Computer{Name: name, Speed: speed})
+	}
+	return computers, nil
+}
+
+// parseDurations parses operation durations in milliseconds, for example "+=10,-=10,*=20,/=20".
+// Operations that are not listed keep the durations from defaults.
+func parseDurations(spec string, defaults map[string]int) (map[string]int, error) {
+	durations := make(map[string]int, len(defaults))
+	for opType, duration := range defaults {
+		durations[opType] = duration
+	}
+	if spec == "" {
+		return durations, nil
+	}
+	for _, item := range strings.Split(spec, ",") {
+		opType, durationStr, ok := strings.Cut(strings.TrimSpace(item), "=")
+		if !ok {
+			return nil, fmt.Errorf("invalid duration %q", item)
+		}
+		duration, err := strconv.Atoi(durationStr)
+		if err != nil || duration < 0 {
+			return nil, fmt.Errorf("invalid duration of operation %q", opType)
+		}
+		durations[opType] = duration
+	}
+	return durations, nil
+}
+
+// runSimulate runs the "simulate" command.
+// It places the operations of the expressions on the computers with a virtual clock
+// and prints the makespan and the timeline of every computer.
+func runSimulate(args []string, out io.Writer) error {
+	flags := flag.NewFlagSet("simulate", flag.ContinueOnError)
+	computersSpec := flags.String("computers", "", `number of computers or a list of computers with speeds, e.g. "4" or "fast:2,slow:0.5" (default 1, or the Computers table with -db)`)
+	durationsSpec := flags.String("durations", "", `operation durations in ms, e.g. "+=10,*=20" (default 1 ms, or the Operations table with -db)`)
+	databasePath := flags.String("db", "", "take the computers and the durations from this database")
+	format := flags.String("format", "text", "output format: text, json or mermaid")
+	rebalance := flags.Bool("rebalance", false, "rebalance chains of + and *")
+	implicitMultiplication := flags.Bool("implicit-multiplication", false, "accept expressions like 2(3+4)")
+	simplify := flags.Bool("simplify", false, "fold the operations on numbers and apply the algebraic identities")
+	flags.Usage = func() {
+		fmt.Fprintln(flags.Output(), "Usage: DistributedCalculator simulate [flags] expression...")
+		flags.PrintDefaults()
+	}
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if flags.NArg() == 0 {
+		flags.Usage()
+		return errors.New("no expressions to simulate")
+	}
+
+	// The defaults are the same as in a new database
+	defaults := map[string]int{"+": 1, "-": 1, "*": 1, "/": 1, "^": 1, "%": 1, "//": 1, "neg": 1, "pos": 1, "not": 1,
+		"<": 1, "<=": 1, "==": 1, "!=": 1, ">": 1, ">=": 1, "&&": 1, "||": 1}
+	for _, function := range agent.FunctionNames() {
+		defaults[function] = 1
+	}
+	computers := agent.Computers(1)
+	if *databasePath != "" {
+		database, err := db.Connect(*databasePath)
+		if err != nil {
+			return err
+		}
+		defer database.Close()
+		defaults, err = database.GetOperationTimes()
+		if err != nil {
+			return err
+		}
+		count, err := database.CountComputers()
+		if err != nil {
+			return err
+		}
+		computers = agent.Computers(count)
+	}
+	if *computersSpec != "" {
+		var err error
+		computers, err = parseComputers(*computersSpec)
+		if err != nil {
+			return err
+		}
+	}
+	durations, err := parseDurations(*durationsSpec, defaults)
+	if err != nil {
+		return err
+	}
+
+	options := agent.Options{Rebalance: *rebalance, ImplicitMultiplication: *implicitMultiplication, Simplify: *simplify}
+	var roots []*agent.Node
+	for _, equation := range flags.Args() {
+		root, err := agent.BuildTree(equation, options)
+		if err != nil {
+			return fmt.Errorf("invalid equation %q: %w", equation, err)
+		}
+		roots = append(roots, root)
+	}
+
+	schedule, err := agent.Simulate(roots, computers, durations)
+	if err != nil {
+		return err
+	}
+	switch *format {
+	case "text":
+		return printScheduleText(out, schedule, computers)
+	case "json":
+		return printScheduleJSON(out, schedule, computers, roots)
+	case "mermaid":
+		return printScheduleMermaid(out, schedule, computers)
+	default:
+		return fmt.Errorf("unknown format %q", *format)
+	}
+}
+
+// computerTasks groups the tasks of the schedule by computers.
+func computerTasks(schedule agent.Schedule, computers []agent.Computer) [][]agent.Task {
+	tasks := make([][]agent.Task, len(computers))
+	for _, task := range schedule.Tasks {
+		tasks[task.Computer-1] = append(tasks[task.Computer-1], task)
+	}
+	return tasks
+}
+
+// printScheduleText prints the makespan and the tasks of every computer as plain text.
+func printScheduleText(out io.Writer, schedule agent.Schedule, computers []agent.Computer) error {
+	fmt.Fprintf(out, "Makespan: %d ms\n", schedule.Makespan)
+	for i, tasks := range computerTasks(schedule, computers) {
+		fmt.Fprintf(out, "Computer %s (speed %g):\n", computers[i].Name, computers[i].Speed)
+		if len(tasks) == 0 {
+			fmt.Fprintln(out, "  idle")
+		}
+		for _, task := range tasks {
+			fmt.Fprintf(out, "  %6d - %6d ms  %s\n", task.Start, task.End, task.Node)
+		}
+	}
+	return nil
+}
+
+// printScheduleJSON prints the schedule as JSON.
+func printScheduleJSON(out io.Writer, schedule agent.Schedule, computers []agent.Computer, roots []*agent.Node) error {
+	type jsonTask struct {
+		Expression int    `json:"expression"`
+		Operation  string `json:"operation"`
+		Start      int    `json:"start_ms"`
+		End        int    `json:"end_ms"`
+	}
+	type jsonComputer struct {
+		Name  string     `json:"name"`
+		Speed float64    `json:"speed"`
+		Tasks []jsonTask `json:"tasks"`
+	}
+	type jsonExpression struct {
+		Expression string `json:"expression"`
+		Finish     int    `json:"finish_ms"`
+	}
+	result := struct {
+		Makespan    int              `json:"makespan_ms"`
+		Expressions []jsonExpression `json:"expressions"`
+		Computers   []jsonComputer   `json:"computers"`
+	}{Makespan: schedule.Makespan}
+	for i, root := range roots {
+		result.Expressions = append(result.Expressions, jsonExpression{Expression: root.String(), Finish: schedule.Finish[i]})
+	}
+	for i, tasks := range computerTasks(schedule, computers) {
+		computer := jsonComputer{Name: computers[i].Name, Speed: computers[i].Speed, Tasks: []jsonTask{}}
+		for _, task := range tasks {
+			computer.Tasks = append(computer.Tasks, jsonTask{
+				Expression: task.Expression,
+				Operation:  task.Node.String(),
+				Start:      task.Start,
+				End:        task.End,
+			})
+		}
+		result.Computers = append(result.Computers, computer)
+	}
+	encoder := json.NewEncoder(out)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(result)
+}
+
+// printScheduleMermaid prints the schedule as a Mermaid Gantt chart like the ones in the README.
+func printScheduleMermaid(out io.Writer, schedule agent.Schedule, computers []agent.Computer) error {
+	fmt.Fprintln(out, "gantt")
+	fmt.Fprintf(out, "    title %d ms, вычислителей: %d\n", schedule.Makespan, len(computers))
+	fmt.Fprintln(out, "    dateFormat x")
+	fmt.Fprintln(out, "    axisFormat %L ms")
+	number := 0
+	for i, tasks := range computerTasks(schedule, computers) {
+		fmt.Fprintf(out, "\n    section %s\n", computers[i].Name)
+		for _, task := range tasks {
+			number++
+			fmt.Fprintf(out, "    %s :t%d, %d, %d\n", task.Node, number, task.Start, task.End)
+		}
+	}
+	return nil
+}
+
+// simulateCommand runs the "simulate" command with the arguments following it and exits.
+func simulateCommand(args []string) {
+	if err := runSimulate(args, os.Stdout); err != nil {
+		if !errors.Is(err, flag.ErrHelp) {
+			fmt.Fprintln(os.Stderr, err)
+		}
+		os.Exit(2)
+	}
+	os.Exit(0)
+}
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"bytes"
+	"flag"
+	"strings"
+	"testing"
+)
+
+func TestRunSimulate(t *testing.T) {
+	testCases := []struct {
+		name string
+		args []string
+		want string
+		err  string
+	}{
+		{"text", []string{"-computers", "2", "-durations", "+=10,*=20", "(1+2)*(3+4)"}, `Makespan: 30 ms
+Computer 1 (speed 1):
+       0 -     10 ms  1+2
+      10 -     30 ms  (1+2)*(3+4)
+Computer 2 (speed 1):
+       0 -     10 ms  3+4
+`, ""},
+		{"idle computer", []string{"-computers", "2", "1+2"}, `Makespan: 1 ms
+Computer 1 (speed 1):
+       0 -      1 ms  1+2
+Computer 2 (speed 1):
+  idle
+`, ""},
+		// The computer with the speed 2 computes its operation in half the time
+		{"json", []string{"-format", "json", "-computers", "fast:2,slow", "-durations", "*=20", "2*3", "4*5"}, `{
+  "makespan_ms": 20,
+  "expressions": [
+    {
+      "expression": "2*3",
+      "finish_ms": 10
+    },
+    {
+      "expression": "4*5",
+      "finish_ms": 20
+    }
+  ],
+  "computers": [
+    {
+      "name": "fast",
+      "speed": 2,
+      "tasks": [
+        {
+          "expression": 0,
+          "operation": "2*3",
+          "start_ms": 0,
+          "end_ms": 10
+        }
+      ]
+    },
+    {
+      "name": "slow",
+      "speed": 1,
+      "tasks": [
+        {
+          "expression": 1,
+          "operation": "4*5",
+          "start_ms": 0,
+          "end_ms": 20
+        }
+      ]
+    }
+  ]
+}
+`, ""},
+		{"mermaid", []string{"-format", "mermaid", "-computers", "2", "-durations", "+=10,*=20", "(1+2)*(3+4)"}, `gantt
+    title 30 ms, вычислителей: 2
+    dateFormat x
+    axisFormat %L ms
+
+    section 1
+    1+2 :t1, 0, 10
+    (1+2)*(3+4) :t2, 10, 30
+
+    section 2
+    3+4 :t3, 0, 10
+`, ""},
+		// The options of the expressions
+		{"rebalance", []string{"-rebalance", "-computers", "2", "-durations", "+=10", "1+2+3+4"}, `Makespan: 20 ms
+Computer 1 (speed 1):
+       0 -     10 ms  1+2
+      10 -     20 ms  1+2+(3+4)
+Computer 2 (speed 1):
+       0 -     10 ms  3+4
+`, ""},
+		{"implicit multiplication", []string{"-implicit-multiplication", "2(3+4)"}, `Makespan: 2 ms
+Computer 1 (speed 1):
+       0 -      1 ms  3+4
+       1 -      2 ms  2*(3+4)
+`, ""},
+		// Invalid arguments
+		{"no computers", []string{"-computers", "0", "1+2"}, "", "the number of computers must be positive"},
+		{"invalid speed", []string{"-computers", "a:x", "1+2"}, "", `invalid speed of computer "a"`},
+		{"zero speed", []string{"-computers", "a:0", "1+2"}, "", `invalid speed of computer "a"`},
+		{"computer without a name", []string{"-computers", ",a", "1+2"}, "", `invalid computer ""`},
+		{"duration without =", []string{"-durations", "+10", "1+2"}, "", `invalid duration "+10"`},
+		{"negative duration", []string{"-durations", "+=-1", "1+2"}, "", `invalid duration of operation "+"`},
+		{"unknown format", []string{"-format", "xml", "1+2"}, "", `unknown format "xml"`},
+		{"invalid expression", []string{"1+"}, "", `invalid equation "1+": expected a number at position 2`},
+		{"no expressions", []string{"-computers", "2"}, "", "no expressions to simulate"},
+		{"unknown flag", []string{"-bogus", "1+2"}, "", "flag provided but not defined: -bogus"},
+		{"help", []string{"-h"}, "", flag.ErrHelp.Error()},
+	}
+
+	for _, tc := range testCases {
+		var out bytes.Buffer
+		err := runSimulate(tc.args, &out)
+		if tc.err != "" {
+			if err == nil || err.Error() != tc.err {
+				t.Errorf("%s: runSimulate() returned error %v; want %s", tc.name, err, tc.err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: runSimulate() returned error %v", tc.name, err)
+			continue
+		}
+		if out.String() != tc.want {
+			t.Errorf("%s: runSimulate() printed\n%s\nwant\n%s", tc.name, out.String(), tc.want)
+		}
+	}
+}
+
+func TestRunSimulateDatabase(t *testing.T) {
+	database, _ := useTestDatabase(t)
+	for i := 0; i < 2; i++ {
+		if err := database.AddComputer(); err != nil {
+			t.Fatalf("AddComputer returned error %v", err)
+		}
+	}
+	if err := database.UpdateOperations([]string{"+", "*"}, []string{"10", "20"}); err != nil {
+		t.Fatalf("UpdateOperations returned error %v", err)
+	}
+
+	// The computers and the durations come from the database, the flags override them
+	testCases := []struct {
+		args []string
+		want string
+	}{
+		{[]string{"-db", "data.db", "(1+2)*(3+4)"}, "Makespan: 30 ms"},
+		{[]string{"-db", "data.db", "-computers", "1", "(1+2)*(3+4)"}, "Makespan: 40 ms"},
+		{[]string{"-db", "data.db", "-durations", "*=5", "(1+2)*(3+4)"}, "Makespan: 15 ms"},
+	}
+
+	for _, tc := range testCases {
+		var out bytes.Buffer
+		if err := runSimulate(tc.args, &out); err != nil {
+			t.Errorf("runSimulate(%q) returned error %v", tc.args, err)
+			continue
+		}
+		if got, _, _ := strings.Cut(out.String(), "\n"); got != tc.want {
+			t.Errorf("runSimulate(%q) printed %q; want %q", tc.args, got, tc.want)
+		}
+	}
+}
@@ -0,0 +1,180 @@
+package main
+
+import (
+	"DistributedCalculator/agent"
+	"DistributedCalculator/db"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// sseHeartbeat is the interval of the comments that keep an idle event stream open through the proxies.
+// It is a variable so that the tests can shorten it.
+var sseHeartbeat = 15 * time.Second
+
+// streamEvents writes the initial events and then the events of the subscription as Server-Sent Events, like
+//
+//	event: progress
+//	data: {"completed":2,"id":5,"total":3}
+//
+// The results also have result_formatted, the result in the number format of the request.
+// The stream ends when the client disconnects or when stop, if it is not nil, returns true for a written event.
+// Since the bus drops the events of a subscriber that falls behind, every heartbeat also writes the events
+// returned by resync, if it is not nil, so that the final event is not lost.
+func streamEvents(w http.ResponseWriter, r *http.Request, subscription *agent.Subscription, initial []agent.Event,
+	stop func(agent.Event) bool, resync func() []agent.Event) {
+	defer subscription.Close()
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "Streaming is not supported", http.StatusInternalServerError)
+		return
+	}
+	format, err := agent.ParseNumberFormat(r.URL.Query(), agent.DefaultNumberFormat)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	write := func(e agent.Event) bool {
+		payload := e.Payload()
+		if e.Type == agent.ResultEvent {
+			payload["result_formatted"] = format.Format(e.ResultText)
+		}
+		data, _ := json.Marshal(payload)
+		if _, err := fmt.Fprintf(w, "event: %s\ndata: %s\n\n", e.Type, data); err != nil {
+			return true
+		}
+		flusher.Flush()
+		return stop != nil && stop(e)
+	}
+	for _, e := range initial {
+		if write(e) {
+			return
+		}
+	}
+	heartbeat := time.NewTicker(sseHeartbeat)
+	defer heartbeat.Stop()
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-heartbeat.C:
+			if _, err := fmt.Fprint(w, ": heartbeat\n\n"); err != nil {
+				return
+			}
+			flusher.Flush()
+			if resync == nil {
+				continue
+			}
+			for _, e := range resync() {
+				if write(e) {
+					return
+				}
+			}
+		case e, ok := <-subscription.C:
+			if !ok || write(e) {
+				return
+			}
+		}
+	}
+}
+
+// expressionEvents returns the events that describe the current state of the expression.
+func expressionEvents(database *db.DB, id int) []agent.Event {
+	_, status, result, userId := database.GetEquationInfo(id)
+	if status == "Computed" {
+		return []agent.Event{{Type: agent.ResultEvent, EquationID: id, UserID: userId, Status: status, Result: result,
+			ResultText: resultText(database.GetEquationResultText(id), result)}}
+	}
+	if status == "in queue" {
+		status = "In queue"
+	}
+	events := []agent.Event{{Type: agent.StatusEvent, EquationID: id, UserID: userId, Status: status}}
+	if completed, total, ok := agent.Progress(id); ok {
+		events = append(events, agent.Event{Type: agent.ProgressEvent, EquationID: id, UserID: userId, Completed: completed, Total: total})
+	}
+	return events
+}
+
+// expressionEventsAPIHandler streams the events of the expression, see streamEvents.
+// It starts with the current status and progress, or with the result of a finished expression,
+// and ends when the expression is computed or has failed.
+// The database is closed once the current state is read, as the stream needs only the events;
+// a heartbeat connects again to send the final state of an expression whose final event was dropped.
+func expressionEventsAPIHandler(w http.ResponseWriter, r *http.Request, database *db.DB, id int) {
+	// Subscribe before reading the current state, so that no change is missed
+	subscription := agent.Events.Subscribe(func(e agent.Event) bool {
+		return e.EquationID == id && e.Type != agent.ComputerEvent
+	})
+	initial := expressionEvents(database, id)
+	database.Close()
+	resync := func() []agent.Event {
+		database, err := db.Connect("data.db")
+		if err != nil {
+			return nil
+		}
+		defer database.Close()
+		if _, status, _, _ := database.GetEquationInfo(id); !agent.Finished(status) {
+			return nil
+		}
+		return expressionEvents(database, id)
+	}
+	streamEvents(w, r, subscription, initial, agent.Event.Final, resync)
+}
+
+// EventsAPIHandler handles "GET /api/v1/events".
+// It streams the status, progress and result events of all expressions of the authorized user, see streamEvents.
+func EventsAPIHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "Invalid request method", http.StatusMethodNotAllowed)
+		return
+	}
+	userLogin, isAuth := getUserLogin(r)
+	if !isAuth {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+	database, err := db.Connect("data.db")
+	if err != nil {
+		http.Error(w, "Failed to connect to database", http.StatusInternalServerError)
+		return
+	}
+	userId, err := database.GetUserID(userLogin)
+	database.Close()
+	if err != nil {
+		http.Error(w, "User not found", http.StatusNotFound)
+		return
+	}
+
+	subscription := agent.Events.Subscribe(func(e agent.Event) bool {
+		return e.UserID == userId && e.Type != agent.ComputerEvent
+	})
+	streamEvents(w, r, subscription, nil, nil, nil)
+}
+
+// ComputerEventsAPIHandler handles "GET /api/v1/computers/events".
+// It streams the computer events: the computer and the expression whose operation it has taken,
+// or the equation_id 0 when it becomes free. Like the computers page, it needs no authorization.
+func ComputerEventsAPIHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "Invalid request method", http.StatusMethodNotAllowed)
+		return
+	}
+	subscription := agent.Events.Subscribe(func(e agent.Event) bool {
+		return e.Type == agent.ComputerEvent
+	})
+	streamEvents(w, r, subscription, nil, nil, nil)
+}
+
+// publishQueued publishes the status of the expressions added to the queue of the user.
+func publishQueued(userId int, ids ...int) {
+	for _, id := range ids {
+		agent.Events.Publish(agent.Event{Type: agent.StatusEvent, EquationID: id, UserID: userId, Status: "In queue"})
+	}
+}
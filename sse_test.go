@@ -0,0 +1,64 @@
+package main
+
+import (
+	"DistributedCalculator/agent"
+	"bufio"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestExpressionEventsResync(t *testing.T) {
+	database, token := useTestDatabase(t)
+	id, err := database.AddEquation(0, "2+2*2", "Equations", 1, "", "")
+	if err != nil {
+		t.Fatalf("AddEquation returned error %v", err)
+	}
+	if err = database.UpdateEquation(id, "Computing", 0); err != nil {
+		t.Fatalf("UpdateEquation returned error %v", err)
+	}
+	heartbeat := sseHeartbeat
+	sseHeartbeat = 20 * time.Millisecond
+	defer func() { sseHeartbeat = heartbeat }()
+
+	server := httptest.NewServer(http.HandlerFunc(ExpressionsAPIHandler))
+	defer server.Close()
+	request, _ := http.NewRequest("GET", server.URL+"/api/v1/expressions/1/events", nil)
+	request.Header.Set("Authorization", "Bearer "+token)
+	client := &http.Client{Timeout: 5 * time.Second}
+	response, err := client.Do(request)
+	if err != nil {
+		t.Fatalf("GET events returned error %v", err)
+	}
+	defer response.Body.Close()
+	reader := bufio.NewReader(response.Body)
+	// The current status comes after the subscription, the events published from now on are received
+	if line, _ := reader.ReadString('\n'); line != "event: status\n" {
+		t.Fatalf("the stream started with %q; want the status event", line)
+	}
+
+	// The subscription is filled up and the result is lost, as if the bus dropped it
+	for i := 0; i < 1000; i++ {
+		agent.Events.Publish(agent.Event{Type: agent.ProgressEvent, EquationID: id, UserID: 1, Completed: i, Total: 1000})
+	}
+	if err = database.SetEquationResult(id, 6, "6"); err != nil {
+		t.Fatalf("SetEquationResult returned error %v", err)
+	}
+
+	// The heartbeat finds the expression finished, sends its result and ends the stream
+	var last string
+	for {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			break
+		}
+		if strings.HasPrefix(line, "event: ") {
+			last = line
+		}
+	}
+	if last != "event: result\n" {
+		t.Errorf("the stream ended after %q; want the result event", last)
+	}
+}
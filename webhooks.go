@@ -0,0 +1,599 @@
+package main
+
+import (
+	"DistributedCalculator/agent"
+	"DistributedCalculator/db"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+const (
+	// maxWebhooks limits the number of the webhooks of a user.
+	maxWebhooks = 10
+	// webhookWorkers is the number of the deliveries attempted at once.
+	webhookWorkers = 4
+	// webhookPollInterval is the interval of the checks for the deliveries to retry.
+	webhookPollInterval = time.Second
+	// webhookTimeout limits an attempt of a delivery.
+	webhookTimeout = 10 * time.Second
+	// webhookLookupTimeout limits the resolution of the host of a submitted callback URL.
+	webhookLookupTimeout = 5 * time.Second
+	// webhookEventBuffer is the number of the finished expressions waiting for their deliveries to be recorded.
+	webhookEventBuffer = 10000
+	// webhookSweepInterval is the interval of the searches for the finished expressions without deliveries.
+	webhookSweepInterval = 10 * time.Second
+	// maxDeliveriesListed limits the deliveries returned by GET /api/v1/webhooks/deliveries.
+	maxDeliveriesListed = 100
+)
+
+// webhookAttempts and webhookBackoff are the number of the attempts of a delivery and the delay after the first failed one,
+// the delay doubles after every next failure. webhookAllowPrivate allows the webhooks to the loopback, link-local
+// and private addresses, for the local testing only. They are set by the flags of the server.
+var (
+	webhookAttempts     = 6
+	webhookBackoff      = 10 * time.Second
+	webhookAllowPrivate = false
+)
+
+// checkCallbackURL checks the callback URL of a submitted expression, the empty URL means no callback.
+// The host must resolve to public addresses only, so that the users cannot make the server call its own network.
+func checkCallbackURL(callbackURL string) error {
+	u, err := parseCallbackURL(callbackURL)
+	if err != nil || u == nil || webhookAllowPrivate {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), webhookLookupTimeout)
+	defer cancel()
+	addresses, err := net.DefaultResolver.LookupIPAddr(ctx, u.Hostname())
+	if err != nil || len(addresses) == 0 {
+		return errors.New("invalid callback_url: the host cannot be resolved")
+	}
+	for _, address := range addresses {
+		if forbiddenWebhookIP(address.IP) {
+			return fmt.Errorf("invalid callback_url: the address %s is not public", address.IP)
+		}
+	}
+	return nil
+}
+
+// parseCallbackURL checks the callback URL without resolving its host, the nil URL means no callback.
+// Only an address written in the URL is checked. The batches use it instead of checkCallbackURL, since resolving
+// the hosts of thousands of expressions would block the request; webhookDialControl checks the address of the receiver
+// when a delivery is attempted anyway.
+func parseCallbackURL(callbackURL string) (*url.URL, error) {
+	if callbackURL == "" {
+		return nil, nil
+	}
+	u, err := url.Parse(callbackURL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Hostname() == "" {
+		return nil, errors.New("invalid callback_url: an http or https URL is required")
+	}
+	if ip := net.ParseIP(u.Hostname()); ip != nil && !webhookAllowPrivate && forbiddenWebhookIP(ip) {
+		return nil, fmt.Errorf("invalid callback_url: the address %s is not public", ip)
+	}
+	return u, nil
+}
+
+// forbiddenWebhookIP reports whether the webhooks must not be sent to the address:
+// a loopback, link-local, private, unspecified or multicast one.
+func forbiddenWebhookIP(ip net.IP) bool {
+	return ip.IsLoopback() || ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() || ip.IsPrivate() ||
+		ip.IsUnspecified() || ip.IsMulticast()
+}
+
+// webhookDialControl rejects the connections to the forbidden addresses when a delivery is attempted,
+// since the host of a callback URL may resolve to another address than it did when the URL was submitted.
+func webhookDialControl(network, address string, _ syscall.RawConn) error {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	if ip := net.ParseIP(host); ip == nil || forbiddenWebhookIP(ip) {
+		return fmt.Errorf("the address %s is not public", host)
+	}
+	return nil
+}
+
+// newWebhookClient returns the client of the deliveries. It does not use a proxy,
+// so that the address checked by webhookDialControl is the address of the receiver.
+func newWebhookClient() *http.Client {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.Proxy = nil
+	dialer := &net.Dialer{Timeout: webhookTimeout}
+	if !webhookAllowPrivate {
+		dialer.Control = webhookDialControl
+	}
+	transport.DialContext = dialer.DialContext
+	return &http.Client{Timeout: webhookTimeout, Transport: transport}
+}
+
+// webhookSecret returns the secret the webhooks of the user are signed with, creating it on the first use.
+func webhookSecret(database *db.DB, userId int) (string, error) {
+	secret, err := database.GetWebhookSecret(userId)
+	if err != nil || secret != "" {
+		return secret, err
+	}
+	if err = database.AddWebhookSecret(userId, newWebhookSecret()); err != nil {
+		return "", err
+	}
+	// Another request may have created the secret first
+	return database.GetWebhookSecret(userId)
+}
+
+// newWebhookSecret returns a random secret.
+func newWebhookSecret() string {
+	secret := make([]byte, 32)
+	_, _ = rand.Read(secret)
+	return "whsec_" + hex.EncodeToString(secret)
+}
+
+// webhookDispatcher records a delivery for the callback URL of every finished expression and for every webhook of its user,
+// and attempts the deliveries with webhookWorkers goroutines. The failed deliveries are retried with exponential backoff
+// until they succeed or make webhookAttempts attempts. The deliveries are kept in the database,
+// so they are recorded and retried after a restart of the server too.
+type webhookDispatcher struct {
+	client *http.Client
+	queue  chan int
+	// mu guards scheduled, the IDs of the deliveries in the queue or being attempted.
+	mu        sync.Mutex
+	scheduled map[int]bool
+}
+
+// newWebhookDispatcher returns a dispatcher with an empty queue.
+func newWebhookDispatcher() *webhookDispatcher {
+	return &webhookDispatcher{
+		client:    newWebhookClient(),
+		queue:     make(chan int, webhookEventBuffer),
+		scheduled: make(map[int]bool),
+	}
+}
+
+// startWebhooks starts delivering the webhooks of the finished expressions.
+func startWebhooks() {
+	d := newWebhookDispatcher()
+	// The bus drops the events of a slow subscriber, so they are moved to a larger buffer at once.
+	// The events only make the deliveries fast: the dropped ones, and the ones lost by a restart,
+	// are found by the sweep of the finished expressions without deliveries.
+	subscription := agent.Events.Subscribe(agent.Event.Final)
+	finished := make(chan int, webhookEventBuffer)
+	go func() {
+		for e := range subscription.C {
+			select {
+			case finished <- e.EquationID:
+			default:
+			}
+		}
+	}()
+	// The deliveries are recorded by a single goroutine, so that an expression does not get a delivery twice
+	go func() {
+		d.sweep()
+		ticker := time.NewTicker(webhookSweepInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case id := <-finished:
+				d.record(id)
+			case <-ticker.C:
+				d.sweep()
+			}
+		}
+	}()
+	for i := 0; i < webhookWorkers; i++ {
+		go func() {
+			for id := range d.queue {
+				d.attempt(id)
+			}
+		}()
+	}
+	go d.poll()
+}
+
+// sweep records the missing deliveries of the finished expressions.
+func (d *webhookDispatcher) sweep() {
+	database, err := db.Connect("data.db")
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	ids, err := database.GetUnrecordedWebhookEquations(webhookEventBuffer)
+	database.Close()
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	for _, id := range ids {
+		d.record(id)
+	}
+}
+
+// record adds the missing deliveries of the finished expression and schedules them: one for its callback URL
+// and one for every webhook of its user added before the expression was finished.
+func (d *webhookDispatcher) record(equationId int) {
+	database, err := db.Connect("data.db")
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	defer database.Close()
+
+	e := expressionEvents(database, equationId)[0]
+	finishedAt := database.GetEquationFinishedAt(equationId)
+	if !e.Final() || finishedAt == 0 {
+		return
+	}
+	recorded, err := database.GetRecordedWebhookIDs(equationId)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	var targets []db.WebhookDelivery
+	if callbackURL := database.GetEquationCallbackURL(equationId); callbackURL != "" && !recorded[0] {
+		targets = append(targets, db.WebhookDelivery{URL: callbackURL})
+	}
+	webhooks, err := database.GetWebhooks(e.UserID)
+	if err != nil {
+		log.Println(err)
+	}
+	for _, webhook := range webhooks {
+		if webhook.CreatedAt <= finishedAt && !recorded[webhook.ID] {
+			targets = append(targets, db.WebhookDelivery{WebhookID: webhook.ID, URL: webhook.URL})
+		}
+	}
+	if len(targets) == 0 {
+		return
+	}
+
+	text, _, _, _ := database.GetEquationInfo(equationId)
+	now := time.Now()
+	payload := string(agent.WebhookPayload(e, text, time.Unix(finishedAt, 0)))
+	for _, delivery := range targets {
+		delivery.UserID = e.UserID
+		delivery.EquationID = equationId
+		delivery.Event = agent.WebhookEvent(e)
+		delivery.Payload = payload
+		delivery.Status = db.DeliveryPending
+		delivery.CreatedAt = now.Unix()
+		delivery.UpdatedAt = now.Unix()
+		delivery.NextAttemptAt = now.Unix()
+		id, err := database.AddWebhookDelivery(delivery)
+		if err != nil {
+			log.Println(err)
+			continue
+		}
+		d.schedule(id)
+	}
+}
+
+// schedule queues the delivery unless it is queued already.
+// A delivery that does not fit into the queue is picked up by poll later.
+func (d *webhookDispatcher) schedule(id int) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.scheduled[id] {
+		return
+	}
+	select {
+	case d.queue <- id:
+		d.scheduled[id] = true
+	default:
+	}
+}
+
+// poll schedules the pending deliveries whose next attempt is due.
+func (d *webhookDispatcher) poll() {
+	ticker := time.NewTicker(webhookPollInterval)
+	defer ticker.Stop()
+	for range ticker.C {
+		database, err := db.Connect("data.db")
+		if err != nil {
+			log.Println(err)
+			continue
+		}
+		ids, err := database.GetDueWebhookDeliveries(time.Now().Unix(), webhookEventBuffer)
+		database.Close()
+		if err != nil {
+			log.Println(err)
+			continue
+		}
+		for _, id := range ids {
+			d.schedule(id)
+		}
+	}
+}
+
+// attempt delivers the scheduled delivery, which can be scheduled again afterwards.
+func (d *webhookDispatcher) attempt(id int) {
+	d.deliver(id)
+	d.mu.Lock()
+	delete(d.scheduled, id)
+	d.mu.Unlock()
+}
+
+// deliver makes an attempt of the pending delivery and stores its outcome.
+func (d *webhookDispatcher) deliver(id int) {
+	database, err := db.Connect("data.db")
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	defer database.Close()
+
+	now := time.Now()
+	delivery, ok, err := database.GetWebhookDelivery(id)
+	// The delivery may have been attempted since it was found by poll
+	if err != nil || !ok || delivery.Status != db.DeliveryPending || delivery.NextAttemptAt > now.Unix() {
+		return
+	}
+	secret, err := webhookSecret(database, delivery.UserID)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+
+	code, err := agent.DeliverWebhook(d.client, agent.WebhookRequest{
+		URL:        delivery.URL,
+		Secret:     secret,
+		DeliveryID: delivery.ID,
+		Event:      delivery.Event,
+		Payload:    []byte(delivery.Payload),
+	}, now)
+	delivery.Attempts++
+	delivery.ResponseCode = code
+	delivery.UpdatedAt = time.Now().Unix()
+	switch {
+	case err == nil:
+		delivery.Status = db.DeliveryDelivered
+		delivery.Error = ""
+	case delivery.Attempts >= webhookAttempts:
+		delivery.Status = db.DeliveryFailed
+		delivery.Error = err.Error()
+	default:
+		delivery.Error = err.Error()
+		delivery.NextAttemptAt = now.Add(agent.WebhookBackoff(webhookBackoff, delivery.Attempts)).Unix()
+	}
+	if err = database.UpdateWebhookDelivery(delivery); err != nil {
+		log.Println(err)
+	}
+}
+
+// webhookResponse describes the webhook for the API.
+func webhookResponse(webhook db.Webhook) map[string]interface{} {
+	return map[string]interface{}{"id": webhook.ID, "url": webhook.URL, "created_at": exportTime(webhook.CreatedAt)}
+}
+
+// deliveryResponse describes the delivery for the API, the payload is included only if full is true.
+func deliveryResponse(delivery db.WebhookDelivery, full bool) map[string]interface{} {
+	response := map[string]interface{}{
+		"id":          delivery.ID,
+		"equation_id": delivery.EquationID,
+		"url":         delivery.URL,
+		"event":       delivery.Event,
+		"status":      delivery.Status,
+		"attempts":    delivery.Attempts,
+		"created_at":  exportTime(delivery.CreatedAt),
+		"updated_at":  exportTime(delivery.UpdatedAt),
+	}
+	if delivery.WebhookID != 0 {
+		response["webhook_id"] = delivery.WebhookID
+	}
+	if delivery.ResponseCode != 0 {
+		response["response_code"] = delivery.ResponseCode
+	}
+	if delivery.Error != "" {
+		response["error"] = delivery.Error
+	}
+	if delivery.Status == db.DeliveryPending {
+		response["next_attempt_at"] = exportTime(delivery.NextAttemptAt)
+	}
+	if full {
+		response["payload"] = json.RawMessage(delivery.Payload)
+	}
+	return response
+}
+
+// WebhooksAPIHandler handles the "/api/v1/webhooks" routes of the authorized user.
+// Supported routes:
+//   - GET /api/v1/webhooks — the secret the webhooks are signed with and the webhooks of the user
+//   - POST /api/v1/webhooks — adds a webhook with the URL from the JSON body {"url": "..."}
+//   - DELETE /api/v1/webhooks/{id} — deletes the webhook
+//   - POST /api/v1/webhooks/secret — replaces the secret with a new one
+//   - GET /api/v1/webhooks/deliveries — the newest deliveries, filtered by the status and equation_id parameters
+//   - GET /api/v1/webhooks/deliveries/{id} — the delivery with its payload
+//   - POST /api/v1/webhooks/deliveries/{id}/replay — delivers the payload of the delivery again as a new delivery
+func WebhooksAPIHandler(w http.ResponseWriter, r *http.Request) {
+	path := strings.Split(strings.Trim(strings.TrimPrefix(r.URL.Path, "/api/v1/webhooks"), "/"), "/")
+
+	userLogin, isAuth := getUserLogin(r)
+	if !isAuth {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	database, err := db.Connect("data.db")
+	if err != nil {
+		http.Error(w, "Failed to connect to database", http.StatusInternalServerError)
+		return
+	}
+	defer database.Close()
+
+	userId, err := database.GetUserID(userLogin)
+	if err != nil {
+		http.Error(w, "User not found", http.StatusNotFound)
+		return
+	}
+
+	switch {
+	case path[0] == "" && r.Method == "GET":
+		listWebhooks(w, database, userId)
+	case path[0] == "" && r.Method == "POST":
+		addWebhook(w, r, database, userId)
+	case path[0] == "secret" && len(path) == 1 && r.Method == "POST":
+		secret := newWebhookSecret()
+		if err := database.SetWebhookSecret(userId, secret); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		writeJSON(w, http.StatusOK, map[string]interface{}{"secret": secret})
+	case path[0] == "deliveries" && len(path) == 1 && r.Method == "GET":
+		listDeliveries(w, r, database, userId)
+	case path[0] == "deliveries" && len(path) == 1:
+		http.Error(w, "Invalid request method", http.StatusMethodNotAllowed)
+	case path[0] == "deliveries" && len(path) >= 2 && len(path) <= 3:
+		deliveryAPIHandler(w, r, database, userId, path[1:])
+	case len(path) == 1 && r.Method == "DELETE":
+		id, err := strconv.Atoi(path[0])
+		if err != nil {
+			http.Error(w, "Invalid ID", http.StatusBadRequest)
+			return
+		}
+		deleted, err := database.DeleteWebhook(userId, id)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if !deleted {
+			http.Error(w, "Webhook not found", http.StatusNotFound)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		http.Error(w, "Not found", http.StatusNotFound)
+	}
+}
+
+// listWebhooks returns the secret and the webhooks of the user.
+func listWebhooks(w http.ResponseWriter, database *db.DB, userId int) {
+	secret, err := webhookSecret(database, userId)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	webhooks, err := database.GetWebhooks(userId)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	list := make([]map[string]interface{}, len(webhooks))
+	for i, webhook := range webhooks {
+		list[i] = webhookResponse(webhook)
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{"secret": secret, "webhooks": list})
+}
+
+// addWebhook adds a webhook of the user, up to maxWebhooks of them.
+func addWebhook(w http.ResponseWriter, r *http.Request, database *db.DB, userId int) {
+	var request struct {
+		URL string `json:"url"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil || request.URL == "" {
+		http.Error(w, "Bad request", http.StatusBadRequest)
+		return
+	}
+	if err := checkCallbackURL(request.URL); err != nil {
+		http.Error(w, strings.Replace(err.Error(), "callback_url", "url", 1), http.StatusBadRequest)
+		return
+	}
+	webhooks, err := database.GetWebhooks(userId)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if len(webhooks) >= maxWebhooks {
+		http.Error(w, fmt.Sprintf("A user has at most %d webhooks", maxWebhooks), http.StatusConflict)
+		return
+	}
+	webhook := db.Webhook{UserID: userId, URL: request.URL, CreatedAt: time.Now().Unix()}
+	webhook.ID, err = database.AddWebhook(userId, webhook.URL, webhook.CreatedAt)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, http.StatusCreated, webhookResponse(webhook))
+}
+
+// listDeliveries returns the newest deliveries of the user.
+func listDeliveries(w http.ResponseWriter, r *http.Request, database *db.DB, userId int) {
+	status := r.URL.Query().Get("status")
+	if status != "" && status != db.DeliveryPending && status != db.DeliveryDelivered && status != db.DeliveryFailed {
+		http.Error(w, "Invalid status", http.StatusBadRequest)
+		return
+	}
+	equationId := 0
+	if value := r.URL.Query().Get("equation_id"); value != "" {
+		var err error
+		if equationId, err = strconv.Atoi(value); err != nil {
+			http.Error(w, "Invalid equation_id", http.StatusBadRequest)
+			return
+		}
+	}
+	deliveries, err := database.GetWebhookDeliveries(userId, status, equationId, maxDeliveriesListed)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	list := make([]map[string]interface{}, len(deliveries))
+	for i, delivery := range deliveries {
+		list[i] = deliveryResponse(delivery, false)
+	}
+	writeJSON(w, http.StatusOK, list)
+}
+
+// deliveryAPIHandler handles the routes of a delivery of the user, the path is its ID and the action.
+func deliveryAPIHandler(w http.ResponseWriter, r *http.Request, database *db.DB, userId int, path []string) {
+	id, err := strconv.Atoi(path[0])
+	if err != nil {
+		http.Error(w, "Invalid ID", http.StatusBadRequest)
+		return
+	}
+	delivery, ok, err := database.GetWebhookDelivery(id)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	// Only the owner of the delivery can access it
+	if !ok || delivery.UserID != userId {
+		http.Error(w, "Delivery not found", http.StatusNotFound)
+		return
+	}
+
+	switch {
+	case len(path) == 1 && r.Method == "GET":
+		writeJSON(w, http.StatusOK, deliveryResponse(delivery, true))
+	case len(path) == 2 && path[1] == "replay" && r.Method == "POST":
+		// The replay is a new delivery of the same payload, the original one keeps its history
+		now := time.Now().Unix()
+		replay := db.WebhookDelivery{
+			UserID:        userId,
+			EquationID:    delivery.EquationID,
+			WebhookID:     delivery.WebhookID,
+			URL:           delivery.URL,
+			Event:         delivery.Event,
+			Payload:       delivery.Payload,
+			Status:        db.DeliveryPending,
+			CreatedAt:     now,
+			UpdatedAt:     now,
+			NextAttemptAt: now,
+		}
+		replay.ID, err = database.AddWebhookDelivery(replay)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		writeJSON(w, http.StatusAccepted, deliveryResponse(replay, false))
+	default:
+		http.Error(w, "Not found", http.StatusNotFound)
+	}
+}
@@ -0,0 +1,204 @@
+package main
+
+import (
+	"DistributedCalculator/db"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestCheckCallbackURL(t *testing.T) {
+	// parseCallbackURL does not resolve the host, it checks only the address written in the URL
+	testCases := []struct {
+		url    string
+		valid  bool
+		parsed bool
+	}{
+		{"", true, true},
+		{"https://93.184.216.34/hook", true, true},
+		{"http://[2606:2800:220:1:248:1893:25c8:1946]:8080/hook", true, true},
+		{"ftp://93.184.216.34/hook", false, false},
+		{"https:///hook", false, false},
+		// The loopback, link-local, private and unspecified addresses are not public
+		{"http://127.0.0.1:8080/hook", false, false},
+		{"http://localhost/hook", false, true},
+		{"http://[::1]/hook", false, false},
+		{"http://169.254.169.254/latest/meta-data", false, false},
+		{"http://10.1.2.3/hook", false, false},
+		{"http://192.168.0.1/hook", false, false},
+		{"http://[fd00::1]/hook", false, false},
+		{"http://0.0.0.0/hook", false, false},
+		{"http://[::ffff:127.0.0.1]/hook", false, false},
+		{"https://host.invalid/hook", false, true},
+	}
+
+	for _, tc := range testCases {
+		err := checkCallbackURL(tc.url)
+		if (err == nil) != tc.valid {
+			t.Errorf("checkCallbackURL(%q) = %v; want valid %v", tc.url, err, tc.valid)
+		}
+		if _, err := parseCallbackURL(tc.url); (err == nil) != tc.parsed {
+			t.Errorf("parseCallbackURL(%q) = %v; want valid %v", tc.url, err, tc.parsed)
+		}
+	}
+}
+
+func TestWebhookClient(t *testing.T) {
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer receiver.Close()
+
+	// The address is checked when the connection is made, whatever the URL was when it was submitted
+	if _, err := newWebhookClient().Get(receiver.URL); err == nil {
+		t.Errorf("the webhook client connected to the loopback receiver %s", receiver.URL)
+	}
+
+	webhookAllowPrivate = true
+	defer func() { webhookAllowPrivate = false }()
+	if err := checkCallbackURL(receiver.URL); err != nil {
+		t.Errorf("checkCallbackURL(%q) with -webhook-allow-private = %v", receiver.URL, err)
+	}
+	response, err := newWebhookClient().Get(receiver.URL)
+	if err != nil {
+		t.Fatalf("the webhook client with -webhook-allow-private failed: %v", err)
+	}
+	response.Body.Close()
+}
+
+func TestWebhooksAPIHandlerDeliveries(t *testing.T) {
+	database, token := useTestDatabase(t)
+	now := time.Now().Unix()
+	_, err := database.AddWebhookDelivery(db.WebhookDelivery{UserID: 1, EquationID: 1, URL: "https://example.com/hook", Event: "computed",
+		Payload: "{}", Status: db.DeliveryDelivered, CreatedAt: now, UpdatedAt: now, NextAttemptAt: now})
+	if err != nil {
+		t.Fatalf("AddWebhookDelivery returned error %v", err)
+	}
+
+	testCases := []struct {
+		method string
+		path   string
+		token  string
+		code   int
+	}{
+		{"GET", "/api/v1/webhooks/deliveries", token, http.StatusOK},
+		{"GET", "/api/v1/webhooks/deliveries/1", token, http.StatusOK},
+		{"POST", "/api/v1/webhooks/deliveries/1/replay", token, http.StatusAccepted},
+		// The collection of the deliveries is read-only
+		{"POST", "/api/v1/webhooks/deliveries", token, http.StatusMethodNotAllowed},
+		{"DELETE", "/api/v1/webhooks/deliveries", token, http.StatusMethodNotAllowed},
+		{"DELETE", "/api/v1/webhooks/deliveries/", token, http.StatusMethodNotAllowed},
+		{"GET", "/api/v1/webhooks/deliveries/abc", token, http.StatusBadRequest},
+		{"GET", "/api/v1/webhooks/deliveries/100", token, http.StatusNotFound},
+		{"DELETE", "/api/v1/webhooks/deliveries/1", token, http.StatusNotFound},
+		{"POST", "/api/v1/webhooks/deliveries/1/replay/again", token, http.StatusNotFound},
+		{"GET", "/api/v1/webhooks/deliveries", "", http.StatusUnauthorized},
+	}
+
+	for _, tc := range testCases {
+		request := httptest.NewRequest(tc.method, tc.path, nil)
+		if tc.token != "" {
+			request.Header.Set("Authorization", "Bearer "+tc.token)
+		}
+		recorder := httptest.NewRecorder()
+		WebhooksAPIHandler(recorder, request)
+		if recorder.Code != tc.code {
+			t.Errorf("%s %s = %d; want %d", tc.method, tc.path, recorder.Code, tc.code)
+		}
+	}
+}
+
+func TestWebhookDispatcher(t *testing.T) {
+	database, _ := useTestDatabase(t)
+	// The callback URL fails once, the webhook always
+	var mu sync.Mutex
+	calls := make(map[string]int)
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		calls[r.URL.Path]++
+		failed := r.URL.Path == "/webhook" || calls[r.URL.Path] == 1
+		mu.Unlock()
+		if failed {
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+	}))
+	defer receiver.Close()
+	allowPrivate, attempts, backoff := webhookAllowPrivate, webhookAttempts, webhookBackoff
+	webhookAllowPrivate, webhookAttempts, webhookBackoff = true, 3, 10*time.Minute
+	defer func() { webhookAllowPrivate, webhookAttempts, webhookBackoff = allowPrivate, attempts, backoff }()
+
+	// The expression was finished before a restart of the server, with no deliveries recorded
+	id, err := database.AddEquation(0, "2+2*2", "Equations", 1, "", "")
+	if err != nil {
+		t.Fatalf("AddEquation returned error %v", err)
+	}
+	if err = database.SetEquationCallbackURL(id, receiver.URL+"/callback"); err != nil {
+		t.Fatalf("SetEquationCallbackURL returned error %v", err)
+	}
+	if _, err = database.AddWebhook(1, receiver.URL+"/webhook", time.Now().Unix()-60); err != nil {
+		t.Fatalf("AddWebhook returned error %v", err)
+	}
+	if err = database.SetEquationResult(id, 6, "6"); err != nil {
+		t.Fatalf("SetEquationResult returned error %v", err)
+	}
+
+	d := newWebhookDispatcher()
+	// The sweep of a new server records the deliveries once and schedules them
+	d.sweep()
+	d.sweep()
+	// Every round attempts the scheduled deliveries, then lets their backoff pass and schedules the due ones like poll
+	testCases := []struct {
+		want  []string
+		calls string
+	}{
+		{[]string{"/webhook pending 1 500 10m0s", "/callback pending 1 500 10m0s"}, "map[/callback:1 /webhook:1]"},
+		// The delay doubles after every failure
+		{[]string{"/webhook pending 2 500 20m0s", "/callback delivered 2 200"}, "map[/callback:2 /webhook:2]"},
+		// The delivery fails after webhookAttempts attempts
+		{[]string{"/webhook failed 3 500", "/callback delivered 2 200"}, "map[/callback:2 /webhook:3]"},
+		{[]string{"/webhook failed 3 500", "/callback delivered 2 200"}, "map[/callback:2 /webhook:3]"},
+	}
+
+	for round, tc := range testCases {
+		for len(d.queue) > 0 {
+			d.attempt(<-d.queue)
+		}
+		deliveries, err := database.GetWebhookDeliveries(1, "", id, 10)
+		if err != nil {
+			t.Fatalf("GetWebhookDeliveries returned error %v", err)
+		}
+		got := make([]string, len(deliveries))
+		for i, delivery := range deliveries {
+			got[i] = fmt.Sprintf("%s %s %d %d", strings.TrimPrefix(delivery.URL, receiver.URL), delivery.Status, delivery.Attempts, delivery.ResponseCode)
+			if delivery.Status == db.DeliveryPending {
+				got[i] += " " + (time.Duration(delivery.NextAttemptAt-delivery.UpdatedAt) * time.Second).Round(time.Minute).String()
+			}
+		}
+		if fmt.Sprint(got) != fmt.Sprint(tc.want) {
+			t.Errorf("round %d: the deliveries are %q; want %q", round+1, got, tc.want)
+		}
+		mu.Lock()
+		if got := fmt.Sprint(calls); got != tc.calls {
+			t.Errorf("round %d: the receiver got %s; want %s", round+1, got, tc.calls)
+		}
+		mu.Unlock()
+
+		// Nothing is due before the backoff passes
+		now := time.Now().Unix()
+		if due, _ := database.GetDueWebhookDeliveries(now, 10); len(due) != 0 {
+			t.Errorf("round %d: the deliveries %v are due before their backoff", round+1, due)
+		}
+		for _, delivery := range deliveries {
+			if delivery.Status == db.DeliveryPending {
+				delivery.NextAttemptAt = now
+				database.UpdateWebhookDelivery(delivery)
+			}
+		}
+		due, _ := database.GetDueWebhookDeliveries(now, 10)
+		for _, id := range due {
+			d.schedule(id)
+		}
+	}
+}
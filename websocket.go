@@ -0,0 +1,270 @@
+package main
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// websocketGUID is appended to the key of the client to compute the accept header, see RFC 6455, section 1.3.
+const websocketGUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+
+// maxWebsocketMessage limits the size of a message received from a client in bytes.
+const maxWebsocketMessage = 1 << 20
+
+// The opcodes of the WebSocket frames.
+const (
+	continuationFrame = 0x0
+	textFrame         = 0x1
+	binaryFrame       = 0x2
+	closeFrame        = 0x8
+	pingFrame         = 0x9
+	pongFrame         = 0xA
+)
+
+// The status codes of the close frames.
+const (
+	closeNormal          = 1000
+	closeProtocolError   = 1002
+	closeUnsupportedData = 1003
+	closeInvalidData     = 1007
+	closeTooBig          = 1009
+)
+
+// errWebsocketClosed is returned by ReadMessage when the client has closed the connection.
+var errWebsocketClosed = errors.New("websocket closed")
+
+// websocketError is a violation of the protocol by the client, the connection is closed with its code.
+type websocketError struct {
+	code int
+	msg  string
+}
+
+func (e *websocketError) Error() string {
+	return e.msg
+}
+
+// websocketConn is a WebSocket connection on the server side.
+// The messages are read by one goroutine, the frames may be written by several goroutines.
+type websocketConn struct {
+	conn   net.Conn
+	reader *bufio.Reader
+	// writeMu serializes the frames written by the goroutines.
+	writeMu sync.Mutex
+	// closeOnce sends the close frame only once.
+	closeOnce sync.Once
+}
+
+// headerContains reports whether the comma separated header has the token, ignoring the case.
+func headerContains(header http.Header, name, token string) bool {
+	for _, value := range header.Values(name) {
+		for _, part := range strings.Split(value, ",") {
+			if strings.EqualFold(strings.TrimSpace(part), token) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// upgradeWebsocket performs the opening handshake and takes over the connection of the request.
+// On failure it has already answered the request with an error.
+func upgradeWebsocket(w http.ResponseWriter, r *http.Request) (*websocketConn, error) {
+	key := r.Header.Get("Sec-WebSocket-Key")
+	if r.Method != "GET" || !headerContains(r.Header, "Connection", "upgrade") ||
+		!headerContains(r.Header, "Upgrade", "websocket") || key == "" {
+		http.Error(w, "WebSocket upgrade required", http.StatusUpgradeRequired)
+		return nil, errors.New("not a websocket handshake")
+	}
+	if r.Header.Get("Sec-WebSocket-Version") != "13" {
+		w.Header().Set("Sec-WebSocket-Version", "13")
+		http.Error(w, "Unsupported WebSocket version", http.StatusUpgradeRequired)
+		return nil, errors.New("unsupported websocket version")
+	}
+	hijacker, ok := w.(http.Hijacker)
+	if !ok {
+		http.Error(w, "WebSocket is not supported", http.StatusInternalServerError)
+		return nil, errors.New("the connection cannot be hijacked")
+	}
+	conn, buffer, err := hijacker.Hijack()
+	if err != nil {
+		return nil, err
+	}
+
+	hash := sha1.Sum([]byte(key + websocketGUID))
+	response := "HTTP/1.1 101 Switching Protocols\r\n" +
+		"Upgrade: websocket\r\n" +
+		"Connection: Upgrade\r\n" +
+		"Sec-WebSocket-Accept: " + base64.StdEncoding.EncodeToString(hash[:]) + "\r\n\r\n"
+	if _, err := buffer.WriteString(response); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	if err := buffer.Flush(); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return &websocketConn{conn: conn, reader: buffer.Reader}, nil
+}
+
+// readFrame reads a frame and unmasks its payload.
+func (c *websocketConn) readFrame() (fin bool, opcode byte, payload []byte, err error) {
+	var header [2]byte
+	if _, err = io.ReadFull(c.reader, header[:]); err != nil {
+		return false, 0, nil, err
+	}
+	fin = header[0]&0x80 != 0
+	opcode = header[0] & 0x0F
+	if header[0]&0x70 != 0 {
+		return false, 0, nil, &websocketError{closeProtocolError, "reserved bits are set"}
+	}
+	// The frames of the clients are always masked
+	if header[1]&0x80 == 0 {
+		return false, 0, nil, &websocketError{closeProtocolError, "the frame is not masked"}
+	}
+	length := uint64(header[1] & 0x7F)
+	switch length {
+	case 126:
+		var extended [2]byte
+		if _, err = io.ReadFull(c.reader, extended[:]); err != nil {
+			return false, 0, nil, err
+		}
+		length = uint64(binary.BigEndian.Uint16(extended[:]))
+	case 127:
+		var extended [8]byte
+		if _, err = io.ReadFull(c.reader, extended[:]); err != nil {
+			return false, 0, nil, err
+		}
+		length = binary.BigEndian.Uint64(extended[:])
+	}
+	if opcode >= closeFrame && (length > 125 || !fin) {
+		return false, 0, nil, &websocketError{closeProtocolError, "invalid control frame"}
+	}
+	if length > maxWebsocketMessage {
+		return false, 0, nil, &websocketError{closeTooBig, "the message is too big"}
+	}
+	var mask [4]byte
+	if _, err = io.ReadFull(c.reader, mask[:]); err != nil {
+		return false, 0, nil, err
+	}
+	payload = make([]byte, length)
+	if _, err = io.ReadFull(c.reader, payload); err != nil {
+		return false, 0, nil, err
+	}
+	for i := range payload {
+		payload[i] ^= mask[i%4]
+	}
+	return fin, opcode, payload, nil
+}
+
+// writeFrame writes an unmasked frame with the payload in one piece.
+func (c *websocketConn) writeFrame(opcode byte, payload []byte) error {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	header := []byte{0x80 | opcode}
+	switch {
+	case len(payload) < 126:
+		header = append(header, byte(len(payload)))
+	case len(payload) <= 0xFFFF:
+		header = append(header, 126, byte(len(payload)>>8), byte(len(payload)))
+	default:
+		header = append(header, 127)
+		header = binary.BigEndian.AppendUint64(header, uint64(len(payload)))
+	}
+	_ = c.conn.SetWriteDeadline(time.Now().Add(10 * time.Second))
+	if _, err := c.conn.Write(append(header, payload...)); err != nil {
+		return err
+	}
+	return nil
+}
+
+// ReadMessage reads the next text message, answering the pings and assembling the fragments.
+// The deadline of every frame is extended by timeout. Binary messages close the connection.
+// It returns errWebsocketClosed when the client closes the connection.
+func (c *websocketConn) ReadMessage(timeout time.Duration) ([]byte, error) {
+	var message []byte
+	fragmented := false
+	for {
+		_ = c.conn.SetReadDeadline(time.Now().Add(timeout))
+		fin, opcode, payload, err := c.readFrame()
+		if err != nil {
+			var protocolError *websocketError
+			if errors.As(err, &protocolError) {
+				c.Close(protocolError.code, protocolError.msg)
+			}
+			return nil, err
+		}
+		switch opcode {
+		case pingFrame:
+			if err := c.writeFrame(pongFrame, payload); err != nil {
+				return nil, err
+			}
+			continue
+		case pongFrame:
+			continue
+		case closeFrame:
+			code := closeNormal
+			if len(payload) >= 2 {
+				code = int(binary.BigEndian.Uint16(payload))
+			}
+			c.Close(code, "")
+			return nil, errWebsocketClosed
+		case binaryFrame:
+			c.Close(closeUnsupportedData, "only text messages are supported")
+			return nil, errWebsocketClosed
+		case textFrame:
+			if fragmented {
+				c.Close(closeProtocolError, "a new message inside a fragmented one")
+				return nil, errWebsocketClosed
+			}
+		case continuationFrame:
+			if !fragmented {
+				c.Close(closeProtocolError, "unexpected continuation frame")
+				return nil, errWebsocketClosed
+			}
+		default:
+			c.Close(closeProtocolError, "unknown opcode")
+			return nil, errWebsocketClosed
+		}
+		message = append(message, payload...)
+		if len(message) > maxWebsocketMessage {
+			c.Close(closeTooBig, "the message is too big")
+			return nil, errWebsocketClosed
+		}
+		if !fin {
+			fragmented = true
+			continue
+		}
+		return message, nil
+	}
+}
+
+// WriteMessage writes a text message.
+func (c *websocketConn) WriteMessage(message []byte) error {
+	return c.writeFrame(textFrame, message)
+}
+
+// Ping writes a ping frame, the client answers it with a pong that extends the read deadline.
+func (c *websocketConn) Ping() error {
+	return c.writeFrame(pingFrame, nil)
+}
+
+// Close sends the close frame with the code and the reason, once, and closes the connection.
+func (c *websocketConn) Close(code int, reason string) {
+	c.closeOnce.Do(func() {
+		payload := binary.BigEndian.AppendUint16(nil, uint16(code))
+		if len(reason) > 123 {
+			reason = reason[:123]
+		}
+		_ = c.writeFrame(closeFrame, append(payload, reason...))
+		c.conn.Close()
+	})
+}
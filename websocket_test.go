@@ -0,0 +1,223 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+// clientFrame returns a frame of the client, masked unless the mask is nil.
+func clientFrame(fin bool, opcode byte, payload []byte, mask []byte) []byte {
+	first := opcode
+	if fin {
+		first |= 0x80
+	}
+	maskBit := byte(0)
+	if mask != nil {
+		maskBit = 0x80
+	}
+	frame := []byte{first}
+	switch {
+	case len(payload) < 126:
+		frame = append(frame, maskBit|byte(len(payload)))
+	case len(payload) <= 0xFFFF:
+		frame = append(frame, maskBit|126)
+		frame = binary.BigEndian.AppendUint16(frame, uint16(len(payload)))
+	default:
+		frame = append(frame, maskBit|127)
+		frame = binary.BigEndian.AppendUint64(frame, uint64(len(payload)))
+	}
+	if mask == nil {
+		return append(frame, payload...)
+	}
+	frame = append(frame, mask...)
+	for i, b := range payload {
+		frame = append(frame, b^mask[i%4])
+	}
+	return frame
+}
+
+// masked returns a masked frame of the client.
+func masked(fin bool, opcode byte, payload string) []byte {
+	return clientFrame(fin, opcode, []byte(payload), []byte{0x37, 0xfa, 0x21, 0x3d})
+}
+
+// serverFrames reads the frames written by the server until the connection is closed and describes them
+// like "text 5 hello", "pong 4 ping" or "close 1002 the frame is not masked". A long payload is described by its length only.
+func serverFrames(r io.Reader) []string {
+	var frames []string
+	reader := bufio.NewReader(r)
+	for {
+		var header [2]byte
+		if _, err := io.ReadFull(reader, header[:]); err != nil {
+			return frames
+		}
+		if header[0]&0x80 == 0 || header[1]&0x80 != 0 {
+			frames = append(frames, "not a final unmasked frame")
+		}
+		length := uint64(header[1] & 0x7F)
+		switch length {
+		case 126:
+			var extended [2]byte
+			io.ReadFull(reader, extended[:])
+			length = uint64(binary.BigEndian.Uint16(extended[:]))
+		case 127:
+			var extended [8]byte
+			io.ReadFull(reader, extended[:])
+			length = binary.BigEndian.Uint64(extended[:])
+		}
+		payload := make([]byte, length)
+		if _, err := io.ReadFull(reader, payload); err != nil {
+			return append(frames, "truncated frame")
+		}
+		switch opcode := header[0] & 0x0F; {
+		case opcode == closeFrame:
+			frames = append(frames, fmt.Sprintf("close %d %s", binary.BigEndian.Uint16(payload), payload[2:]))
+		case opcode == textFrame && length > 125:
+			frames = append(frames, fmt.Sprintf("text %d", length))
+		case opcode == textFrame:
+			frames = append(frames, fmt.Sprintf("text %d %s", length, payload))
+		case opcode == pingFrame:
+			frames = append(frames, fmt.Sprintf("ping %d %s", length, payload))
+		case opcode == pongFrame:
+			frames = append(frames, fmt.Sprintf("pong %d %s", length, payload))
+		default:
+			frames = append(frames, fmt.Sprintf("opcode %d", opcode))
+		}
+	}
+}
+
+// websocketPipe returns the server side of a connection and the client side of it.
+func websocketPipe() (*websocketConn, net.Conn) {
+	server, client := net.Pipe()
+	return &websocketConn{conn: server, reader: bufio.NewReader(server)}, client
+}
+
+func TestWebsocketReadMessage(t *testing.T) {
+	long := strings.Repeat("a", 200)
+	veryLong := strings.Repeat("b", 70000)
+	testCases := []struct {
+		name    string
+		frames  [][]byte
+		message string
+		err     string
+		written []string
+	}{
+		{"short", [][]byte{masked(true, textFrame, "hello")}, "hello", "", nil},
+		{"empty", [][]byte{masked(true, textFrame, "")}, "", "", nil},
+		// The lengths from 126 to 65535 take two more bytes, the longer ones eight
+		{"16-bit length", [][]byte{masked(true, textFrame, long)}, long, "", nil},
+		{"64-bit length", [][]byte{masked(true, textFrame, veryLong)}, veryLong, "", nil},
+		// The control frames may come between the fragments of a message
+		{"fragments", [][]byte{masked(false, textFrame, "hel"), masked(true, pingFrame, "ping"), masked(false, continuationFrame, "l"),
+			masked(true, pongFrame, ""), masked(true, continuationFrame, "o")}, "hello", "", []string{"pong 4 ping"}},
+		{"close", [][]byte{masked(true, closeFrame, "\x03\xe8bye")}, "", "websocket closed", []string{"close 1000 "}},
+		{"close without a code", [][]byte{masked(true, closeFrame, "")}, "", "websocket closed", []string{"close 1000 "}},
+		{"close with another code", [][]byte{masked(true, closeFrame, "\x03\xe9")}, "", "websocket closed", []string{"close 1001 "}},
+		// The violations of the protocol close the connection with their code
+		{"unmasked", [][]byte{clientFrame(true, textFrame, []byte("hello"), nil)}, "", "the frame is not masked",
+			[]string{"close 1002 the frame is not masked"}},
+		{"reserved bits", [][]byte{{0xC1, 0x80, 0, 0, 0, 0}}, "", "reserved bits are set", []string{"close 1002 reserved bits are set"}},
+		{"long control frame", [][]byte{masked(true, pingFrame, long)}, "", "invalid control frame", []string{"close 1002 invalid control frame"}},
+		{"fragmented control frame", [][]byte{masked(false, pingFrame, "ping")}, "", "invalid control frame",
+			[]string{"close 1002 invalid control frame"}},
+		{"binary", [][]byte{masked(true, binaryFrame, "\x00\x01")}, "", "websocket closed",
+			[]string{"close 1003 only text messages are supported"}},
+		{"continuation without a message", [][]byte{masked(true, continuationFrame, "x")}, "", "websocket closed",
+			[]string{"close 1002 unexpected continuation frame"}},
+		{"message inside a message", [][]byte{masked(false, textFrame, "a"), masked(true, textFrame, "b")}, "", "websocket closed",
+			[]string{"close 1002 a new message inside a fragmented one"}},
+		{"unknown opcode", [][]byte{masked(true, 0x3, "x")}, "", "websocket closed", []string{"close 1002 unknown opcode"}},
+		// A frame above the limit is rejected by its header, a message above the limit by its fragments
+		{"too big frame", [][]byte{binary.BigEndian.AppendUint64([]byte{0x81, 0xFF}, maxWebsocketMessage+1)}, "", "the message is too big",
+			[]string{"close 1009 the message is too big"}},
+		{"too big message", [][]byte{masked(false, textFrame, strings.Repeat("c", maxWebsocketMessage/2+1)),
+			masked(true, continuationFrame, strings.Repeat("c", maxWebsocketMessage/2+1))}, "", "websocket closed",
+			[]string{"close 1009 the message is too big"}},
+	}
+
+	for _, tc := range testCases {
+		conn, client := websocketPipe()
+		go func(frames [][]byte) {
+			for _, frame := range frames {
+				if _, err := client.Write(frame); err != nil {
+					return
+				}
+			}
+		}(tc.frames)
+		written := make(chan []string)
+		go func() {
+			written <- serverFrames(client)
+		}()
+
+		message, err := conn.ReadMessage(time.Second)
+		conn.conn.Close()
+		if tc.err != "" {
+			if err == nil || err.Error() != tc.err {
+				t.Errorf("%s: ReadMessage() returned error %v; want %s", tc.name, err, tc.err)
+			}
+		} else if err != nil || string(message) != tc.message {
+			t.Errorf("%s: ReadMessage() = %d bytes, %v; want %d bytes", tc.name, len(message), err, len(tc.message))
+		}
+		if got := <-written; fmt.Sprint(got) != fmt.Sprint(tc.written) {
+			t.Errorf("%s: the server wrote %q; want %q", tc.name, got, tc.written)
+		}
+		client.Close()
+	}
+}
+
+func TestWebsocketWriteMessage(t *testing.T) {
+	testCases := []struct {
+		length int
+		want   string
+	}{
+		{5, "text 5 aaaaa"},
+		{125, "text 125 " + strings.Repeat("a", 125)},
+		{126, "text 126"},
+		{65535, "text 65535"},
+		{65536, "text 65536"},
+	}
+
+	for _, tc := range testCases {
+		conn, client := websocketPipe()
+		written := make(chan []string)
+		go func() {
+			written <- serverFrames(client)
+		}()
+		if err := conn.WriteMessage(bytes.Repeat([]byte("a"), tc.length)); err != nil {
+			t.Errorf("WriteMessage(%d bytes) returned error %v", tc.length, err)
+		}
+		conn.conn.Close()
+		if got := <-written; len(got) != 1 || got[0] != tc.want {
+			t.Errorf("WriteMessage(%d bytes) wrote %.40q; want %.40q", tc.length, got, tc.want)
+		}
+	}
+}
+
+func TestWebsocketClose(t *testing.T) {
+	conn, client := websocketPipe()
+	written := make(chan []string)
+	go func() {
+		written <- serverFrames(client)
+	}()
+	if err := conn.Ping(); err != nil {
+		t.Fatalf("Ping() returned error %v", err)
+	}
+	// The close frame is sent once with the reason cut to fit a control frame, then the connection is closed
+	conn.Close(closeNormal, strings.Repeat("r", 200))
+	conn.Close(closeProtocolError, "again")
+	want := []string{"ping 0 ", "close 1000 " + strings.Repeat("r", 123)}
+	if got := <-written; fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("Ping() and Close() wrote %q; want %q", got, want)
+	}
+	if err := conn.WriteMessage([]byte("late")); !errors.Is(err, io.ErrClosedPipe) {
+		t.Errorf("WriteMessage() after Close() returned error %v; want %v", err, io.ErrClosedPipe)
+	}
+}